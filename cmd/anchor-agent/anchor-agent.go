@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hainesc/anchor/internal/pkg/agent"
+	"github.com/hainesc/anchor/internal/pkg/vlan"
+	"github.com/hainesc/anchor/pkg/runtime/k8s"
+	"github.com/vishvananda/netlink"
+)
+
+const tokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// anchor-agent runs on each node, it keeps the shim interfaces of the masters and the
+// CNI network config of the node, and fixes them once they are changed, such as the
+// NICs flap, until it is stopped.
+func main() {
+	node := flag.String("node", nodeName(), "name of the node")
+	networkCRD := flag.Bool("node-network-crd", os.Getenv("NODE_NETWORK_CRD") == "true",
+		"read the node network from the AnchorNodeNetworks")
+	kubeconfig := flag.String("kubeconfig", "", "kubeconfig to read the AnchorNodeNetworks, in cluster config is used if empty")
+	networkFile := flag.String("node-network", os.Getenv("NODE_NETWORK_FILE"),
+		"JSON file of the node networks, cluster-network is used if it is empty")
+	clusterNetwork := flag.String("cluster-network", os.Getenv("CLUSTER_NETWORK"),
+		"cluster network in the form of hostname,master,ip,gateway,mask separated by semicolons")
+	createShims := flag.Bool("create-shims", os.Getenv("CREATE_MACVLAN") == "true",
+		"create the shim interfaces of the masters")
+	confPath := flag.String("cni-conf", "/host/etc/cni/net.d/"+env("CNI_CONF_NAME", "10-anchor.conf"),
+		"where to write the CNI network config")
+	stateDir := flag.String("state-dir", "/var/lib/cni/octopus", "state dir of octopus")
+	interval := flag.Duration("interval", 10*time.Second, "how often to reconcile")
+	once := flag.Bool("once", false, "reconcile once and exit")
+	flag.Parse()
+
+	load := func() (*agent.NodeNetwork, error) {
+		if *networkFile != "" {
+			return agent.LoadNodeNetwork(*networkFile, *node)
+		}
+		return agent.ParseClusterNetwork(*clusterNetwork, *node)
+	}
+	if *networkCRD {
+		k8sConfig, err := k8s.NewK8sConfig(k8s.Kubernetes{Kubeconfig: *kubeconfig}, k8s.Policy{})
+		if err != nil {
+			log.Fatal("Failed to load the config of k8s, ", err.Error())
+		}
+		source, err := agent.NewNodeNetworkSource(k8sConfig)
+		if err != nil {
+			log.Fatal("Failed to create the client of k8s, ", err.Error())
+		}
+		load = func() (*agent.NodeNetwork, error) {
+			return source.NodeNetwork(*node)
+		}
+	}
+	vlans := vlan.NewManager(*stateDir)
+	mode := env("ANCHOR_MODE", agent.ModeMacvlan)
+
+	updates := make(chan netlink.LinkUpdate, 64)
+	done := make(chan struct{})
+	defer close(done)
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		log.Printf("Failed to watch the links, reconcile every %s only: %v", interval.String(), err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	// The last network loaded is kept if it fails to load, such as the API server is down.
+	var network *agent.NodeNetwork
+	for {
+		if n, err := load(); err == agent.ErrNotSelected {
+			log.Printf("Node %s is not found in the node networks, keep the last one", *node)
+		} else if err != nil {
+			log.Printf("Failed to load the node network: %v", err)
+		} else {
+			network = n
+		}
+		if network != nil {
+			if *createShims {
+				if err := agent.NewReconciler(network, vlans, mode).Reconcile(); err != nil {
+					log.Printf("Failed to reconcile the shim interfaces: %v", err)
+				}
+			}
+			if err := writeConf(*confPath, *node, mode, network); err != nil {
+				log.Printf("Failed to write the CNI network config: %v", err)
+			}
+		}
+		if *once {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-updates:
+			// The updates come in bursts, such as a NIC flaps, reconcile after the burst.
+			time.Sleep(time.Second)
+			for len(updates) > 0 {
+				<-updates
+			}
+		case s := <-signals:
+			// The interfaces are left for the pods.
+			log.Printf("Received %s, exiting", s.String())
+			return
+		}
+	}
+}
+
+// writeConf renders the CNI network config in CNI_NETWORK_CONFIG for mode and writes it to path.
+func writeConf(path, node, mode string, network *agent.NodeNetwork) error {
+	hostNetDir := env("CNI_NET_DIR", "/etc/cni/net.d")
+	token, _ := ioutil.ReadFile(tokenFile)
+	values := map[string]string{
+		"__KUBERNETES_SERVICE_HOST__":  os.Getenv("KUBERNETES_SERVICE_HOST"),
+		"__KUBERNETES_SERVICE_PORT__":  os.Getenv("KUBERNETES_SERVICE_PORT"),
+		"__KUBERNETES_NODE_NAME__":     node,
+		"__KUBECONFIG_FILENAME__":      "anchor-kubeconfig",
+		"__KUBECONFIG_FILEPATH__":      filepath.Join(hostNetDir, "anchor-kubeconfig"),
+		"__CNI_MTU__":                  env("CNI_MTU", "1500"),
+		"__ETCD_ENDPOINTS__":           os.Getenv("ETCD_ENDPOINTS"),
+		"__ETCD_KEY_FILE__":            os.Getenv("ETCD_KEY"),
+		"__ETCD_CERT_FILE__":           os.Getenv("ETCD_CERT"),
+		"__ETCD_CA_CERT_FILE__":        os.Getenv("ETCD_CA"),
+		"__SERVICE_CLUSTER_IP_RANGE__": os.Getenv("SERVICE_CLUSTER_IP_RANGE"),
+		"__MACVLAN_INTERFACE__":        "",
+		"__SERVICEACCOUNT_TOKEN__":     strings.TrimSpace(string(token)),
+	}
+	data, err := agent.RenderConf(os.Getenv("CNI_NETWORK_CONFIG"), values, mode, network)
+	if err != nil {
+		return err
+	}
+	written, err := agent.WriteConf(path, data)
+	if written {
+		log.Printf("Wrote CNI network config %s", path)
+	}
+	return err
+}
+
+// nodeName returns KUBERNETES_NODE_NAME, or the hostname if it is not set.
+func nodeName() string {
+	if name := os.Getenv("KUBERNETES_NODE_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// env returns the environment variable key, or value if it is not set.
+func env(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
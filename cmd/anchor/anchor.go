@@ -8,11 +8,18 @@
 package main
 
 import (
-	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/version"
 	"github.com/hainesc/anchor/internal/app"
+	"github.com/hainesc/anchor/internal/pkg/skel"
 )
 
 func main() {
-	skel.PluginMain(app.CmdAdd, app.CmdDel, version.All)
+	skel.PluginMain(skel.CNIFuncs{
+		Add:      app.CmdAdd,
+		Del:      app.CmdDel,
+		Check:    app.CmdCheck,
+		GC:       app.CmdGC,
+		Status:   app.CmdStatus,
+		Commit:   app.CmdCommit,
+		Conflict: app.CmdConflict,
+	}, skel.All)
 }
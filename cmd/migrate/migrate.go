@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/hainesc/anchor/pkg/store/etcd"
+)
+
+// migrate rewrites the reservations written by the early versions of anchor,
+// which are in comma separated values, to the versioned JSON records.
+func main() {
+	endpoints := flag.String("etcd-endpoints", "http://127.0.0.1:2379", "comma separated etcd endpoints")
+	certFile := flag.String("etcd-cert-file", "", "etcd client cert file")
+	keyFile := flag.String("etcd-key-file", "", "etcd client key file")
+	caFile := flag.String("etcd-ca-cert-file", "", "etcd ca cert file")
+	flag.Parse()
+
+	var store *etcd.Etcd
+	var err error
+	if strings.Contains(*endpoints, "https://") {
+		tlsInfo := &transport.TLSInfo{
+			CertFile:      *certFile,
+			KeyFile:       *keyFile,
+			TrustedCAFile: *caFile,
+		}
+		tlsConfig, _ := tlsInfo.ClientConfig()
+		store, err = etcd.NewEtcdClient("migrate", strings.Split(*endpoints, ","), tlsConfig)
+	} else {
+		store, err = etcd.NewEtcdClientWithoutSSl("migrate", strings.Split(*endpoints, ","))
+	}
+	if err != nil {
+		log.Fatal("Failed to connect to etcd, ", err.Error())
+	}
+	defer store.Close()
+
+	migrated, err := store.Migrate()
+	if err != nil {
+		log.Fatalf("Migrated %d reservations before failure: %s", migrated, err.Error())
+	}
+	log.Printf("Migrated %d reservations", migrated)
+}
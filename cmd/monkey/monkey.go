@@ -11,10 +11,17 @@ import (
 	// "os"
 	"github.com/coreos/etcd/pkg/transport"
 	"github.com/hainesc/anchor/pkg/monkey"
+	"github.com/hainesc/anchor/pkg/runtime/k8s"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/store/crd"
 	"github.com/hainesc/anchor/pkg/store/etcd"
+	"github.com/hainesc/anchor/pkg/store/file"
 	"log"
 	"net/http"
 	"strings"
+	"time"
+
+	"k8s.io/client-go/rest"
 )
 
 func main() {
@@ -23,8 +30,15 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	var store *etcd.Etcd
-	if strings.Contains(conf.Endpoints, "https://") {
+	var store store.Monkey
+	if conf.Store.Type == "file" {
+		store, err = file.NewFile(conf.Store.Path, 30*time.Second)
+	} else if conf.Store.Type == "crd" {
+		var k8sConfig *rest.Config
+		if k8sConfig, err = k8s.NewK8sConfig(k8s.Kubernetes{Kubeconfig: conf.Store.Kubeconfig}, k8s.Policy{}); err == nil {
+			store, err = crd.NewCRDClient(k8sConfig)
+		}
+	} else if strings.Contains(conf.Endpoints, "https://") {
 		tlsInfo := &transport.TLSInfo{
 			CertFile:      conf.CertFile,
 			KeyFile:       conf.KeyFile,
@@ -35,15 +49,19 @@ func main() {
 	} else {
 		store, err = etcd.NewEtcdClientWithoutSSl("monkey", strings.Split(conf.Endpoints, ","))
 	}
-	defer store.Close()
-
 	if err != nil {
-		log.Fatal("Failed to connect to etcd, ", err.Error())
+		log.Fatal("Failed to open the store, ", err.Error())
 	}
+	defer store.Close()
 
 	http.Handle("/", http.FileServer(http.Dir("./powder")))
 	http.Handle("/api/v1/binding", monkey.NewInUseHandler(store))
 	http.Handle("/api/v1/gateway", monkey.NewGatewayHandler(store))
 	http.Handle("/api/v1/allocate", monkey.NewAllocateHandler(store))
+	http.Handle("/api/v1/sticky", monkey.NewStickyHandler(store))
+	http.Handle("/api/v1/quarantine", monkey.NewQuarantineHandler(store))
+	http.Handle("/api/v1/conflict", monkey.NewConflictHandler(store))
+	http.Handle("/api/v1/quota", monkey.NewQuotaHandler(store))
+	http.Handle("/api/v1/strategy", monkey.NewStrategyHandler(store))
 	http.ListenAndServe(":8964", nil)
 }
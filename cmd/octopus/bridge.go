@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/hainesc/anchor/internal/pkg/config"
+	"github.com/vishvananda/netlink"
+)
+
+// ensureBridge returns the bridge of master, which is created if missing, and attaches
+// master to it. It refuses to attach the master in use, see checkDetached, which should
+// be attached by anchor-agent or by hand along with moving the IP of the host to the bridge.
+func ensureBridge(conf *config.OctopusConf, master string) (*netlink.Bridge, error) {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	name := config.BridgeName(master)
+	if _, err = netlink.LinkByName(name); err != nil {
+		br := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: name,
+				MTU:  conf.MTU,
+			},
+		}
+		// Another pod may create it at the same time.
+		if err = netlink.LinkAdd(br); err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("failed to create bridge %q: %v", name, err)
+		}
+	}
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup bridge %q: %v", name, err)
+	}
+	br, ok := l.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%s is %s instead of bridge", name, l.Type())
+	}
+	if err = netlink.LinkSetUp(br); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+
+	if m.Attrs().MasterIndex != br.Attrs().Index {
+		if err = checkDetached(m, name); err != nil {
+			return nil, err
+		}
+		if err = netlink.LinkSetMaster(m, br); err != nil {
+			return nil, fmt.Errorf("failed to attach master %q to bridge %q: %v", master, name, err)
+		}
+	}
+	return br, nil
+}
+
+// checkDetached returns error if master is attached to another device, or it has addresses
+// or upper devices such as macvlan, which stop working once master is attached to the bridge.
+func checkDetached(master netlink.Link, bridge string) error {
+	name := master.Attrs().Name
+	if master.Attrs().MasterIndex != 0 {
+		return fmt.Errorf("master %q is attached to another device, could not attach it to bridge %q", name, bridge)
+	}
+	addrs, err := netlink.AddrList(master, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", name, err)
+	}
+	for _, addr := range addrs {
+		if !addr.IP.IsLinkLocalUnicast() {
+			return fmt.Errorf("master %q has address %s, move it to bridge %q before using the bridge driver",
+				name, addr.IPNet.String(), bridge)
+		}
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		// The parent index of a veth is the index of its peer, which may be in another netns.
+		switch l.(type) {
+		case *netlink.Macvlan, *netlink.Macvtap, *netlink.IPVlan, *netlink.Vlan:
+		default:
+			continue
+		}
+		if l.Attrs().ParentIndex == master.Attrs().Index {
+			return fmt.Errorf("master %q has upper device %q, recreate it on bridge %q before using the bridge driver",
+				name, l.Attrs().Name, bridge)
+		}
+	}
+	return nil
+}
+
+// createVeth creates a veth pair, names the end in netns ifName, and attaches the other
+// end to the bridge of master.
+func createVeth(conf *config.OctopusConf, ifName string, netns ns.NetNS, master string) (*current.Interface, error) {
+	br, err := ensureBridge(conf, master)
+	if err != nil {
+		return nil, err
+	}
+
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the netns of the host: %v", err)
+	}
+	defer hostNS.Close()
+
+	contIface := &current.Interface{}
+	var hostVeth net.Interface
+	err = netns.Do(func(_ ns.NetNS) error {
+		host, cont, err := ip.SetupVeth(ifName, conf.MTU, hostNS)
+		if err != nil {
+			return err
+		}
+		hostVeth = host
+		contIface.Name = cont.Name
+		contIface.Mac = cont.HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hostLink, err := netlink.LinkByName(hostVeth.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", hostVeth.Name, err)
+	}
+	if err = netlink.LinkSetMaster(hostLink, br); err != nil {
+		// Both ends are gone with the host one.
+		_ = netlink.LinkDel(hostLink)
+		return nil, fmt.Errorf("failed to attach %q to bridge %q: %v", hostVeth.Name, br.Attrs().Name, err)
+	}
+	return contIface, nil
+}
+
+// checkVeth checks the veth in prevResult exists and the other end is attached to the
+// bridge, it must be called in the netns of the container.
+func checkVeth(intf *current.Interface, bridgeIndex int, hostNS ns.NetNS) (netlink.Link, error) {
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", intf.Name, err)
+	}
+	if _, ok := link.(*netlink.Veth); !ok {
+		return nil, fmt.Errorf("%s is %s instead of veth", intf.Name, link.Type())
+	}
+	if intf.Mac != "" && intf.Mac != link.Attrs().HardwareAddr.String() {
+		return nil, fmt.Errorf("%s has mac %s instead of %s",
+			intf.Name, link.Attrs().HardwareAddr.String(), intf.Mac)
+	}
+
+	// The parent index of the veth is the index of the other end in the netns of the host.
+	peerIndex := link.Attrs().ParentIndex
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		peer, err := netlink.LinkByIndex(peerIndex)
+		if err != nil {
+			return fmt.Errorf("failed to lookup the peer of %s: %v", intf.Name, err)
+		}
+		if peer.Attrs().MasterIndex != bridgeIndex {
+			return fmt.Errorf("the peer of %s is not attached to the expected bridge", intf.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
@@ -12,17 +12,21 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
-	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 
 	"github.com/hainesc/anchor/internal/app"
 	"github.com/hainesc/anchor/internal/pkg/config"
+	"github.com/hainesc/anchor/internal/pkg/dad"
+	skelx "github.com/hainesc/anchor/internal/pkg/skel"
+	"github.com/hainesc/anchor/internal/pkg/vlan"
 	"github.com/hainesc/anchor/pkg/runtime/k8s"
+	"github.com/hainesc/anchor/pkg/utils"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
@@ -33,6 +37,8 @@ import (
 const (
 	// IPv4InterfaceArpProxySysctlTemplate represents a template for format output.
 	IPv4InterfaceArpProxySysctlTemplate = "net.ipv4.conf.%s.proxy_arp"
+	// maxAttempts is how many times to allocate before giving up if the IPs are in conflict.
+	maxAttempts = 3
 )
 
 func init() {
@@ -42,13 +48,38 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func createMacvlan(conf *config.OctopusConf, ifName string, netns ns.NetNS, master string) (*current.Interface, error) {
-	macvlan := &current.Interface{}
+// newLink returns the link of the driver in conf attached to master, which is named
+// tmpName and created in netns.
+func newLink(conf *config.OctopusConf, tmpName string, master netlink.Link, netns ns.NetNS) (netlink.Link, error) {
+	attrs := netlink.LinkAttrs{
+		MTU:         conf.MTU,
+		Name:        tmpName,
+		ParentIndex: master.Attrs().Index,
+		Namespace:   netlink.NsFd(int(netns.Fd())),
+	}
+	switch conf.Driver {
+	case config.DriverIPvlan:
+		mode, err := app.IPVlanModeFromString(conf.Mode)
+		if err != nil {
+			return nil, err
+		}
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: mode}, nil
+	default:
+		mode, err := app.ModeFromString(conf.Mode)
+		if err != nil {
+			return nil, err
+		}
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: mode}, nil
+	}
+}
 
-	mode, err := app.ModeFromString(conf.Mode)
-	if err != nil {
-		return nil, err
+// createLink attaches netns to master with the driver in conf, the interface in netns is
+// named ifName.
+func createLink(conf *config.OctopusConf, ifName string, netns ns.NetNS, master string) (*current.Interface, error) {
+	if conf.Driver == config.DriverBridge {
+		return createVeth(conf, ifName, netns, master)
 	}
+	contIface := &current.Interface{}
 
 	m, err := netlink.LinkByName(master)
 	if err != nil {
@@ -62,43 +93,40 @@ func createMacvlan(conf *config.OctopusConf, ifName string, netns ns.NetNS, mast
 		return nil, err
 	}
 
-	mv := &netlink.Macvlan{
-		LinkAttrs: netlink.LinkAttrs{
-			MTU:         conf.MTU,
-			Name:        tmpName,
-			ParentIndex: m.Attrs().Index,
-			Namespace:   netlink.NsFd(int(netns.Fd())),
-		},
-		Mode: mode,
+	link, err := newLink(conf, tmpName, m, netns)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := netlink.LinkAdd(mv); err != nil {
-		return nil, fmt.Errorf("failed to create macvlan: %v", err)
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", conf.Driver, err)
 	}
 
 	err = netns.Do(func(_ ns.NetNS) error {
-		// TODO: duplicate following lines for ipv6 support, when it will be added in other places
-		ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, tmpName)
-		if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
-			// remove the newly added link and ignore errors, because we already are in a failed state
-			_ = netlink.LinkDel(mv)
-			return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
+		// The ipvlan shares the MAC of the master, so it never answers ARP for others.
+		if conf.Driver == config.DriverMacvlan {
+			// TODO: duplicate following lines for ipv6 support, when it will be added in other places
+			ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, tmpName)
+			if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
+				// remove the newly added link and ignore errors, because we already are in a failed state
+				_ = netlink.LinkDel(link)
+				return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
+			}
 		}
 
 		err := ip.RenameLink(tmpName, ifName)
 		if err != nil {
-			_ = netlink.LinkDel(mv)
-			return fmt.Errorf("failed to rename macvlan to %q: %v", ifName, err)
+			_ = netlink.LinkDel(link)
+			return fmt.Errorf("failed to rename %s to %q: %v", conf.Driver, ifName, err)
 		}
-		macvlan.Name = ifName
+		contIface.Name = ifName
 
-		// Re-fetch macvlan to get all properties/attributes
-		contMacvlan, err := netlink.LinkByName(ifName)
+		// Re-fetch the link to get all properties/attributes
+		contLink, err := netlink.LinkByName(ifName)
 		if err != nil {
-			return fmt.Errorf("failed to refetch macvlan %q: %v", ifName, err)
+			return fmt.Errorf("failed to refetch %s %q: %v", conf.Driver, ifName, err)
 		}
-		macvlan.Mac = contMacvlan.Attrs().HardwareAddr.String()
-		macvlan.Sandbox = netns.Path()
+		contIface.Mac = contLink.Attrs().HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
 
 		return nil
 	})
@@ -106,69 +134,179 @@ func createMacvlan(conf *config.OctopusConf, ifName string, netns ns.NetNS, mast
 		return nil, err
 	}
 
-	return macvlan, nil
+	return contIface, nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
-	// n, cniVersion, err := loadConf(args.StdinData)
-	n, cniVersion, err := config.LoadOctopusConf(args.StdinData)
-	if err != nil {
-		return err
+// usesARP returns false if the link of the driver in conf resolves no address with ARP,
+// which is the case of ipvlan in l3 and l3s mode.
+func usesARP(conf *config.OctopusConf) bool {
+	return conf.Driver != config.DriverIPvlan || conf.Mode == "" || conf.Mode == "l2"
+}
+
+// probeAddresses sends ARP probes for the IPv4 addresses in result over ifName, and returns
+// the first one in use by others, or nil if none, dad_timeout is not set or the link resolves
+// no address with ARP.
+func probeAddresses(conf *config.OctopusConf, ifName string, netns ns.NetNS, result *current.Result) (net.IP, error) {
+	if conf.DADDuration == 0 || !usesARP(conf) {
+		return nil, nil
 	}
+	var conflict net.IP
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		// The probes could be sent only if the link is up.
+		if err = netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		}
+		iface, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to look up %q: %v", ifName, err)
+		}
 
-	netns, err := ns.GetNS(args.Netns)
-	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		for _, ipc := range result.IPs {
+			if ipc.Version != "4" {
+				continue
+			}
+			mac, err := dad.Probe(ipc.Address.IP, iface, conf.DADDuration)
+			if err != nil {
+				return err
+			}
+			if mac != nil {
+				conflict = ipc.Address.IP
+				return nil
+			}
+		}
+		return nil
+	})
+	return conflict, err
+}
+
+// subnetOfRange returns the subnet in octopus which contains the range, or empty if not found.
+func subnetOfRange(octopus map[string]config.Master, r string) string {
+	first := utils.FirstIP(r)
+	if first == nil {
+		return ""
 	}
-	defer netns.Close()
+	for subnet := range octopus {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		if n.Contains(first) {
+			return subnet
+		}
+	}
+	return ""
+}
+
+// masterOf returns the master interface for the subnets, which are separated by comma for dual-stack.
+func masterOf(octopus map[string]config.Master, subnets string) (config.Master, error) {
+	master := config.Master{}
+	for _, subnet := range strings.Split(subnets, ",") {
+		m, ok := octopus[strings.TrimSpace(subnet)]
+		if !ok {
+			continue
+		}
+		if master.Master != "" && master != m {
+			return master, fmt.Errorf("subnets %s are on different master interfaces %s and %s",
+				subnets, master.Name(), m.Name())
+		}
+		master = m
+	}
+	return master, nil
+}
 
-	// Get annotations of the pod and decide which host interface will be used.
+// masterOfPod decides which host interface will be used by the pod via its annotations.
+func masterOfPod(n *config.OctopusConf, args *skel.CmdArgs) (config.Master, error) {
+	none := config.Master{}
 	// 1. Get conf for k8s client and create a k8s_client
 	k8sClient, err := k8s.NewK8sClient(n.Kubernetes, n.Policy)
 	if err != nil {
-		return err
+		return none, err
 	}
 
 	// 2. Get K8S_POD_NAME and K8S_POD_NAMESPACE.
 	k8sArgs := k8s.Args{}
 	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
-		return err
+		return none, err
 	}
 
 	// 3. Get annotations from k8s_client via K8S_POD_NAME and K8S_POD_NAMESPACE.
 	_, annot, err := k8s.GetK8sPodInfo(k8sClient, string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE))
 	if err != nil {
-		return fmt.Errorf("failed to read annotaions for pod " + err.Error())
+		return none, fmt.Errorf("failed to read annotaions for pod " + err.Error())
 	}
 	subnet := annot["cni.anchor.org/subnet"]
+	if subnet == "" && annot["cni.anchor.org/range"] != "" {
+		// The subnet is omitted, find the one contains the range.
+		subnet = subnetOfRange(n.Octopus, annot["cni.anchor.org/range"])
+	}
+	if subnet == "" && k8sArgs.IP != nil {
+		subnet = subnetOfRange(n.Octopus, k8sArgs.IP.String())
+	}
+	if subnet == "" && annot["cni.anchor.org/ip"] != "" {
+		subnet = subnetOfRange(n.Octopus, annot["cni.anchor.org/ip"])
+	}
 
-	master := n.Octopus[subnet]
-	if master == "" {
+	master, err := masterOf(n.Octopus, subnet)
+	if err != nil {
+		return none, err
+	}
+	if master.Master == "" {
 		if subnet == "" {
-			return fmt.Errorf("failed to find annotation named cni.anchor.org/subnet")
+			return none, fmt.Errorf("failed to find annotation named cni.anchor.org/subnet")
 		}
-		return fmt.Errorf("Master interface not found for VLAN %s on this node", subnet)
+		return none, fmt.Errorf("Master interface not found for VLAN %s on this node", subnet)
 	}
-	macvlanInterface, err := createMacvlan(n, args.IfName, netns, master)
+	return master, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	// n, cniVersion, err := loadConf(args.StdinData)
+	n, cniVersion, err := config.LoadOctopusConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	// Delete link if err to avoid link leak in this ns
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+	}
+	defer netns.Close()
+
+	master, err := masterOfPod(n, args)
+	if err != nil {
+		return err
+	}
+	// The VLAN sub-interface is created for the first pod of the VLAN on the node.
+	vlans := vlan.NewManager(n.StateDir)
+	masterName, err := vlans.Acquire(master, n.Name, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	// Release the VLAN sub-interface if err, after the link is deleted.
 	defer func() {
 		if err != nil {
-			netns.Do(func(_ ns.NetNS) error {
-				return ip.DelLinkByName(args.IfName)
-			})
+			vlans.Release(n.Name, args.ContainerID, args.IfName)
 		}
 	}()
 
-	// run the IPAM plugin and get back the config to apply
-	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	contIface, err := createLink(n, args.IfName, netns, masterName)
 	if err != nil {
 		return err
 	}
 
+	// Delete link if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
 	// Invoke ipam del if err to avoid ip leak
 	defer func() {
 		if err != nil {
@@ -176,19 +314,47 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}()
 
-	// Convert whatever the IPAM result was into the current Result type
-	result, err := current.NewResultFromResult(r)
-	if err != nil {
-		return err
-	}
+	// run the IPAM plugin and get back the config to apply, again if the IP is in conflict
+	var result *current.Result
+	for attempt := 1; ; attempt++ {
+		var r types.Result
+		if r, err = skelx.ExecAdd(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
 
-	if len(result.IPs) == 0 {
-		return errors.New("IPAM plugin returned missing IP config")
+		// Convert whatever the IPAM result was into the current Result type
+		if result, err = current.NewResultFromResult(r); err != nil {
+			return err
+		}
+		if len(result.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		var conflict net.IP
+		if conflict, err = probeAddresses(n, args.IfName, netns, result); err != nil {
+			return err
+		}
+		if conflict == nil {
+			break
+		}
+		if attempt < maxAttempts {
+			err = skelx.ExecConflict(n.IPAM.Type, args.StdinData, conflict)
+		}
+		// The IPAM plugins not knowing CONFLICT may hand the IP out again, so give up.
+		if attempt == maxAttempts || err == skelx.ErrVerbNotSupported {
+			err = fmt.Errorf("%s allocated is in use by others", conflict)
+			return err
+		}
+		if err != nil {
+			return err
+		}
 	}
-	result.Interfaces = []*current.Interface{macvlanInterface}
+
+	result.Interfaces = []*current.Interface{contIface}
 
 	for _, ipc := range result.IPs {
-		// All addresses apply to the container macvlan interface
+		// All addresses apply to the container interface
 		ipc.Interface = current.Int(0)
 	}
 
@@ -203,7 +369,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 
 		for _, ipc := range result.IPs {
-			if ipc.Version == "4" {
+			if ipc.Version == "4" && usesARP(n) {
 				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
 			}
 		}
@@ -213,9 +379,18 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// The reservations are pending until committed now the interface is ready. Nothing
+	// is pending for the IPAM plugins not knowing COMMIT.
+	if err = skelx.ExecCommit(n.IPAM.Type, args.StdinData); err == skelx.ErrVerbNotSupported {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
 	result.DNS = n.DNS
 
-	return types.PrintResult(result, cniVersion)
+	return skelx.PrintResult(result, cniVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -229,24 +404,189 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	if args.Netns == "" {
-		return nil
+	if args.Netns != "" {
+		// There is a netns so try to clean up. Delete can be called multiple times
+		// so don't return an error if the device is already removed.
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			if err := ip.DelLinkByName(args.IfName); err != nil {
+				if err != ip.ErrLinkNotFound {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		if err := ip.DelLinkByName(args.IfName); err != nil {
-			if err != ip.ErrLinkNotFound {
-				return err
-			}
+	// The VLAN sub-interface is deleted after the last pod of the VLAN on the node is gone.
+	return vlan.NewManager(n.StateDir).Release(n.Name, args.ContainerID, args.IfName)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := config.LoadOctopusConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	// The IPs should still be held by the container.
+	if err = skelx.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	master, err := masterOfPod(n, args)
+	if err != nil {
+		return err
+	}
+	// The veth of the bridge driver is attached to the bridge of master.
+	attached := master.Name()
+	if n.Driver == config.DriverBridge {
+		attached = config.BridgeName(attached)
+	}
+	m, err := netlink.LinkByName(attached)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", attached, err)
+	}
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return fmt.Errorf("failed to open the netns of the host: %v", err)
+	}
+	defer hostNS.Close()
+
+	var contIface *current.Interface
+	for _, intf := range n.PrevResult.Interfaces {
+		if intf.Name == args.IfName && intf.Sandbox != "" {
+			contIface = intf
 		}
-		return nil
+	}
+	if contIface == nil {
+		return fmt.Errorf("interface %s not found in prevResult", args.IfName)
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		var link netlink.Link
+		var err error
+		if n.Driver == config.DriverBridge {
+			link, err = checkVeth(contIface, m.Attrs().Index, hostNS)
+		} else {
+			link, err = checkLink(n.Driver, contIface, m.Attrs().Index)
+		}
+		if err != nil {
+			return err
+		}
+		if err = checkAddresses(link, n.PrevResult.IPs); err != nil {
+			return err
+		}
+		return checkRoutes(link, n.PrevResult.Routes)
 	})
+}
+
+// checkLink checks the link of the driver in prevResult exists and attaches to the master,
+// it must be called in the netns of the container.
+func checkLink(driver string, intf *current.Interface, masterIndex int) (netlink.Link, error) {
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", intf.Name, err)
+	}
+	if link.Type() != driver {
+		return nil, fmt.Errorf("%s is %s instead of %s", intf.Name, link.Type(), driver)
+	}
+	if link.Attrs().ParentIndex != masterIndex {
+		return nil, fmt.Errorf("%s is not attached to the expected master", intf.Name)
+	}
+	if intf.Mac != "" && intf.Mac != link.Attrs().HardwareAddr.String() {
+		return nil, fmt.Errorf("%s has mac %s instead of %s",
+			intf.Name, link.Attrs().HardwareAddr.String(), intf.Mac)
+	}
+	return link, nil
+}
+
+// checkAddresses checks the link has all the addresses in prevResult.
+func checkAddresses(link netlink.Link, ips []*current.IPConfig) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %s: %v", link.Attrs().Name, err)
+	}
+	for _, ipc := range ips {
+		found := false
+		for _, addr := range addrs {
+			if addr.IPNet.IP.Equal(ipc.Address.IP) && addr.IPNet.Mask.String() == ipc.Address.Mask.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("address %s not found on %s", ipc.Address.String(), link.Attrs().Name)
+		}
+	}
+	return nil
+}
 
-	return err
+// checkRoutes checks the routes in prevResult exist in the netns.
+func checkRoutes(link netlink.Link, routes []*types.Route) error {
+	for _, route := range routes {
+		family := netlink.FAMILY_V4
+		if route.Dst.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		existing, err := netlink.RouteList(link, family)
+		if err != nil {
+			return fmt.Errorf("failed to list routes of %s: %v", link.Attrs().Name, err)
+		}
+		found := false
+		for _, r := range existing {
+			// The default route has no Dst in netlink.
+			dst := "0.0.0.0/0"
+			if family == netlink.FAMILY_V6 {
+				dst = "::/0"
+			}
+			if r.Dst != nil {
+				dst = r.Dst.String()
+			}
+			if dst == route.Dst.String() && (route.GW == nil || route.GW.Equal(r.Gw)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("route %s via %s not found on %s", route.Dst.String(), route.GW, link.Attrs().Name)
+		}
+	}
+	return nil
+}
+
+// cmdGC forgets the containers gone using the VLAN sub-interfaces, and delegates GC
+// to the IPAM plugin.
+func cmdGC(args *skel.CmdArgs) error {
+	n, _, err := config.LoadOctopusConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if err = vlan.NewManager(n.StateDir).Prune(n.Name, n.ValidAttachments); err != nil {
+		return err
+	}
+	return skelx.ExecGC(n.IPAM.Type, args.StdinData)
+}
+
+// cmdStatus delegates STATUS to the IPAM plugin.
+func cmdStatus(args *skel.CmdArgs) error {
+	n, _, err := config.LoadOctopusConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return skelx.ExecStatus(n.IPAM.Type, args.StdinData)
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skelx.PluginMain(skelx.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, skelx.All)
 }
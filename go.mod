@@ -5,7 +5,7 @@ require (
 	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/containernetworking/cni v0.6.0
 	github.com/containernetworking/plugins v0.7.4
-	github.com/coreos/bbolt v1.3.0 // indirect
+	github.com/coreos/bbolt v1.3.0
 	github.com/coreos/etcd v3.3.9+incompatible
 	github.com/coreos/go-iptables v0.4.0 // indirect
 	github.com/coreos/go-semver v0.2.0 // indirect
@@ -8,20 +8,29 @@
 package app
 
 import (
+	"fmt"
+	"net"
+	"os"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
 
 	"github.com/coreos/etcd/pkg/transport"
 
 	"github.com/hainesc/anchor/internal/pkg/config"
+	skelx "github.com/hainesc/anchor/internal/pkg/skel"
 	"github.com/hainesc/anchor/pkg/allocator/anchor"
 	"github.com/hainesc/anchor/pkg/runtime/k8s"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/store/crd"
 	"github.com/hainesc/anchor/pkg/store/etcd"
+	"github.com/hainesc/anchor/pkg/store/file"
 )
 
+// ErrQuotaExceeded is the code of the error returned by ADD if a quota of the namespace is used up.
+const ErrQuotaExceeded uint = 101
+
 // CmdAdd allocates IP for pod
 func CmdAdd(args *skel.CmdArgs) error {
 	ipamConf, confVersion, err := config.LoadIPAMConf(args.StdinData, args.Args)
@@ -29,50 +38,179 @@ func CmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	alloc, err := newAllocator(args, ipamConf)
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	allocs, err := newAllocators(args, ipamConf, store)
 	if err != nil { // Error during init Allocator
 		return err
 	}
 
-	// Init result here, which will be printed in json format.
-	result := &current.Result{}
+	// One allocator for each address family, dual-stack pods have two.
+	result, err := anchor.AllocateAll(allocs, args.ContainerID, ipamConf.ServiceIPNet, ipamConf.NodeIPs)
+	if err != nil {
+		if e, ok := err.(*anchor.QuotaExceededError); ok {
+			return &types.Error{
+				Code:    ErrQuotaExceeded,
+				Msg:     "IP quota exceeded",
+				Details: e.Error(),
+			}
+		}
+		return err
+	}
+	return skelx.PrintResult(result, confVersion)
+}
+
+// CmdDel deletes IP for pod
+func CmdDel(args *skel.CmdArgs) error {
+	ipamConf, _, err := config.LoadIPAMConf(args.StdinData, args.Args)
+	if err != nil { // Error in config file.
+		return err
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
 
-	// Handle customized network configurations.
-	if result, err = alloc.CustomizeGateway(result); err != nil {
+	cleaner, err := newCleaner(args, ipamConf, store)
+	if err != nil {
 		return err
 	}
-	if result, err = alloc.CustomizeRoutes(result); err != nil {
+	return cleaner.Clean(args.ContainerID)
+}
+
+// CmdCheck checks whether the IPs in prevResult are still held by the container.
+func CmdCheck(args *skel.CmdArgs) error {
+	ipamConf, _, err := config.LoadIPAMConf(args.StdinData, args.Args)
+	if err != nil { // Error in config file.
 		return err
 	}
-	if result, err = alloc.CustomizeDNS(result); err != nil {
+	if ipamConf.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
 		return err
 	}
-	// Add an item of route:
-	//   service-cluster-ip-range -> Node IP
-	if result, err = alloc.AddServiceRoute(result, ipamConf.ServiceIPNet, ipamConf.NodeIPs); err != nil {
+	defer store.Close()
+
+	return anchor.NewChecker(store).Check(args.ContainerID, ipamConf.PrevResult.IPs)
+}
+
+// CmdGC releases the IPs reserved on this node by the containers not in valid attachments.
+func CmdGC(args *skel.CmdArgs) error {
+	ipamConf, _, err := config.LoadIPAMConf(args.StdinData, args.Args)
+	if err != nil { // Error in config file.
 		return err
 	}
 
-	ipConf, err := alloc.Allocate(args.ContainerID)
+	store, err := newStore(ipamConf)
 	if err != nil {
 		return err
 	}
-	result.IPs = append(result.IPs, ipConf)
-	return types.PrintResult(result, confVersion)
+	defer store.Close()
+
+	valid := make([]string, 0, len(ipamConf.ValidAttachments))
+	for _, attachment := range ipamConf.ValidAttachments {
+		valid = append(valid, attachment.ContainerID)
+	}
+	return anchor.NewCollector(store, nodeName(ipamConf), ipamConf.Name, ipamConf.LockDuration, ipamConf.CooldownDuration).Collect(valid)
 }
 
-// CmdDel deletes IP for pod
-func CmdDel(args *skel.CmdArgs) error {
+// CmdCommit commits the pending reservations of the container, it is called by octopus
+// once the interface is configured.
+func CmdCommit(args *skel.CmdArgs) error {
 	ipamConf, _, err := config.LoadIPAMConf(args.StdinData, args.Args)
 	if err != nil { // Error in config file.
 		return err
 	}
 
-	cleaner, err := newCleaner(args, ipamConf)
-	return cleaner.Clean(args.ContainerID)
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return store.Commit(args.ContainerID)
 }
 
-func newAllocator(args *skel.CmdArgs, conf *config.IPAMConf) (*anchor.Allocator, error) {
+// CmdConflict marks the IP in CONFLICT_IP as in conflict, and releases the other IPs held by
+// the container. It is called by octopus once the IP is found in use by others, then ADD is
+// called again for another IP.
+func CmdConflict(args *skel.CmdArgs) error {
+	conflictArgs := skelx.ConflictArgs{}
+	// Other args such as K8S_POD_NAME are passed along.
+	conflictArgs.IgnoreUnknown = true
+	if err := types.LoadArgs(args.Args, &conflictArgs); err != nil {
+		return err
+	}
+	ip := net.ParseIP(string(conflictArgs.CONFLICT_IP))
+	if ip == nil {
+		return fmt.Errorf("invalid CONFLICT_IP %q", conflictArgs.CONFLICT_IP)
+	}
+
+	ipamConf, _, err := config.LoadIPAMConf(args.StdinData, args.Args)
+	if err != nil { // Error in config file.
+		return err
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return store.Conflict(args.ContainerID, ip)
+}
+
+// CmdStatus returns error if the store is unreachable.
+func CmdStatus(args *skel.CmdArgs) error {
+	ipamConf, _, err := config.LoadIPAMConf(args.StdinData, args.Args)
+	if err != nil { // Error in config file.
+		return err
+	}
+
+	store, err := newStore(ipamConf)
+	if err == nil {
+		defer store.Close()
+		err = store.Status()
+	}
+	if err != nil {
+		return &types.Error{
+			Code:    skelx.ErrPluginNotAvailable,
+			Msg:     "store is unreachable",
+			Details: err.Error(),
+		}
+	}
+	return nil
+}
+
+// nodeName returns the name of this node, which is recorded along with the reservations.
+func nodeName(conf *config.IPAMConf) string {
+	if conf.Kubernetes.NodeName != "" {
+		return conf.Kubernetes.NodeName
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func newStore(conf *config.IPAMConf) (store.Store, error) {
+	switch conf.Store.Type {
+	case config.StoreFile:
+		return file.NewFile(conf.Store.Path, conf.LockDuration)
+	case config.StoreCRD:
+		k8sConfig, err := k8s.NewK8sConfig(conf.Kubernetes, conf.Policy)
+		if err != nil {
+			return nil, err
+		}
+		return crd.NewCRDClient(k8sConfig)
+	}
 	tlsInfo := &transport.TLSInfo{
 		CertFile:      conf.CertFile,
 		KeyFile:       conf.KeyFile,
@@ -80,14 +218,12 @@ func newAllocator(args *skel.CmdArgs, conf *config.IPAMConf) (*anchor.Allocator,
 	}
 	tlsConfig, _ := tlsInfo.ClientConfig()
 	// Use etcd as store
-	store, err := etcd.NewEtcdClient(conf.Name,
+	return etcd.NewEtcdClient(conf.Name,
 		strings.Split(conf.Endpoints, ","),
 		tlsConfig)
-	defer store.Close()
-	if err != nil {
-		return nil, err
-	}
+}
 
+func newAllocators(args *skel.CmdArgs, conf *config.IPAMConf, store store.Store) ([]*anchor.Allocator, error) {
 	// 1. Get K8S_POD_NAME and K8S_POD_NAMESPACE.
 	k8sArgs := k8s.Args{}
 	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
@@ -113,33 +249,36 @@ func newAllocator(args *skel.CmdArgs, conf *config.IPAMConf) (*anchor.Allocator,
 	for k, v := range annot {
 		customized[k] = v
 	}
+	// IP passed via CNI_ARGS overrides the one in annotations.
+	if k8sArgs.IP != nil {
+		customized["cni.anchor.org/ip"] = k8sArgs.IP.String()
+	}
 
 	// It is friendly to show which controller the pods controled by.
 	// TODO: maybe it is meaningless. the pod name starts with the controller name.
-	controllerName, _ := k8s.ResourceControllerName(runtime,  string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE))
+	controllerKind, controllerName, _ := k8s.ResourceController(runtime, string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE))
 	if controllerName != "" {
 		customized["cni.anchor.org/controller"] = controllerName
 	}
-
-	return anchor.NewAllocator(store, string(k8sArgs.K8S_POD_NAME),
-		string(k8sArgs.K8S_POD_NAMESPACE), customized)
-}
-
-func newCleaner(args *skel.CmdArgs, ipamConf *config.IPAMConf) (*anchor.Cleaner, error) {
-	tlsInfo := &transport.TLSInfo{
-		CertFile:      ipamConf.CertFile,
-		KeyFile:       ipamConf.KeyFile,
-		TrustedCAFile: ipamConf.TrustedCAFile,
+	// Where the IP is used, which is recorded along with the reservation.
+	customized["cni.anchor.org/ifname"] = args.IfName
+	customized["cni.anchor.org/node"] = nodeName(conf)
+	customized["cni.anchor.org/network"] = conf.Name
+	// The lease is decided by the config rather than the pod.
+	delete(customized, "cni.anchor.org/lease")
+	if conf.LeaseDuration > 0 {
+		customized["cni.anchor.org/lease"] = conf.LeaseDuration.String()
 	}
-	tlsConfig, _ := tlsInfo.ClientConfig()
-
-	store, err := etcd.NewEtcdClient(ipamConf.Name,
-		strings.Split(ipamConf.Endpoints, ","), tlsConfig)
-	defer store.Close()
-	if err != nil {
-		return nil, err
+	// Pods of StatefulSet have stable names, so their IPs are sticky by default.
+	if controllerKind == "StatefulSet" && customized["cni.anchor.org/sticky"] == "" {
+		customized["cni.anchor.org/sticky"] = "true"
 	}
 
+	return anchor.NewAllocators(store, string(k8sArgs.K8S_POD_NAME),
+		string(k8sArgs.K8S_POD_NAMESPACE), customized, conf.LockDuration)
+}
+
+func newCleaner(args *skel.CmdArgs, conf *config.IPAMConf, store store.Store) (*anchor.Cleaner, error) {
 	// Read pod name and namespace from args
 	k8sArgs := k8s.Args{}
 	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
@@ -148,5 +287,7 @@ func newCleaner(args *skel.CmdArgs, ipamConf *config.IPAMConf) (*anchor.Cleaner,
 
 	return anchor.NewCleaner(store,
 		string(k8sArgs.K8S_POD_NAME),
-		string(k8sArgs.K8S_POD_NAMESPACE))
+		string(k8sArgs.K8S_POD_NAMESPACE),
+		conf.LockDuration,
+		conf.CooldownDuration)
 }
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/store/file"
+)
+
+func Test_CmdGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anchor")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "anchor.db")
+	s, err := file.NewFile(path, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, id := range []string{"valid", "stale"} {
+		ip := map[string]string{"valid": "10.0.1.2", "stale": "10.0.1.3"}[id]
+		if _, err := s.Reserve(id, &store.Record{
+			IP:        net.ParseIP(ip),
+			Subnet:    "10.0.1.0/24",
+			Namespace: "default",
+			Pod:       id,
+			Node:      "node1",
+			Network:   "anchor",
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	s.Close()
+
+	conf := fmt.Sprintf(`{
+		"cniVersion": "1.1.0",
+		"name": "anchor",
+		"type": "octopus",
+		"ipam": {
+			"type": "anchor-ipam",
+			"store": {"type": "file", "path": %q},
+			"kubernetes": {"node_name": "node1"}
+		},
+		"cni.dev/valid-attachments": [{"containerID": "valid", "ifname": "eth0"}]
+	}`, path)
+	if err := CmdGC(&skel.CmdArgs{StdinData: []byte(conf)}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if s, err = file.NewFile(path, time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	reservations, err := s.RetrieveReservations()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reservations["valid"]) != 1 || len(reservations["stale"]) != 0 {
+		t.Fatal("expected IP of the container not in valid attachments released")
+	}
+}
@@ -27,3 +27,17 @@ func ModeFromString(s string) (netlink.MacvlanMode, error) {
 		return 0, fmt.Errorf("unknown macvlan mode: %q", s)
 	}
 }
+
+// IPVlanModeFromString configures different mode for ipvlan
+func IPVlanModeFromString(s string) (netlink.IPVlanMode, error) {
+	switch s {
+	case "", "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan mode: %q", s)
+	}
+}
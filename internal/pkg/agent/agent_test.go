@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hainesc/anchor/internal/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_ParseClusterNetwork(t *testing.T) {
+	n, err := ParseClusterNetwork("node01,eth0.2,10.0.2.8,10.0.2.1,24; node02,eth3,10.0.12.3,10.0.12.1,24;"+
+		"node01, bond0.102, 10.0.102.8, 10.0.102.1, 24", "node01")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(n.Interfaces) != 2 || n.Interfaces[1].Master != "bond0.102" || n.Interfaces[1].IP != "10.0.102.8/24" {
+		t.Fatalf("unexpected interfaces %v", n.Interfaces)
+	}
+	if ips := n.NodeIPs(); !reflect.DeepEqual(ips, []string{"10.0.2.8", "10.0.102.8"}) {
+		t.Fatalf("unexpected node IPs %v", ips)
+	}
+
+	for _, s := range []string{"node01,eth0,10.0.2.8,10.0.2.1", "node01,eth0,10.0.2.8,10.0.3.1,24"} {
+		if _, err = ParseClusterNetwork(s, "node01"); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
+
+func Test_RenderConf(t *testing.T) {
+	template := `{
+    "name": "anchor",
+    "type": "__ANCHOR_MODE__",
+    "master": "__MACVLAN_INTERFACE__",
+    "octopus": {__OCTOPUS__},
+    "ipam": {
+        "type": "anchor",
+        "etcd_endpoints": "__ETCD_ENDPOINTS__",
+        "node_ips": [__NODE_IPS__]
+    }
+}`
+	n := &NodeNetwork{Node: "node01", Interfaces: []Interface{
+		{Master: "eth0", IP: "10.0.2.8/24", Gateway: "10.0.2.1"},
+		{Master: "bond0", VLAN: 102, IP: "10.0.102.8/24", Gateway: "10.0.102.1"},
+	}}
+	values := map[string]string{"__ETCD_ENDPOINTS__": "http://10.0.1.2:2379", "__MACVLAN_INTERFACE__": ""}
+
+	data, err := RenderConf(template, values, ModeOctopus, n)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conf := &config.OctopusConf{}
+	if err = json.Unmarshal(data, conf); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]config.Master{
+		"10.0.2.0/24":   {Master: "eth0"},
+		"10.0.102.0/24": {Master: "bond0", VLAN: 102},
+	}
+	if conf.Type != ModeOctopus || !reflect.DeepEqual(conf.Octopus, expected) {
+		t.Fatalf("unexpected octopus config %s", string(data))
+	}
+	ipam := &config.CNIConf{}
+	if err = json.Unmarshal(data, ipam); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ipam.Master != "" || ipam.IPAM.Endpoints != "http://10.0.1.2:2379" ||
+		!reflect.DeepEqual(ipam.IPAM.NodeIPs, []string{"10.0.2.8", "10.0.102.8"}) {
+		t.Fatalf("unexpected ipam config %s", string(data))
+	}
+
+	if data, err = RenderConf(template, values, ModeMacvlan, n); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = json.Unmarshal(data, ipam); err != nil || ipam.Master != "eth0" {
+		t.Fatalf("expected the first master for macvlan, got %s %v", string(data), err)
+	}
+
+	if data, err = RenderConf(template, values, ModeBridge, n); err != nil {
+		t.Fatal(err.Error())
+	}
+	conf = &config.OctopusConf{}
+	if err = json.Unmarshal(data, conf); err != nil || conf.Type != ModeOctopus ||
+		conf.Driver != config.DriverBridge || !reflect.DeepEqual(conf.Octopus, expected) {
+		t.Fatalf("expected octopus with the bridge driver, got %s %v", string(data), err)
+	}
+}
+
+func Test_ReconcileEmpty(t *testing.T) {
+	// Nothing is touched, or the shims would be removed and the node cut off.
+	if err := NewReconciler(&NodeNetwork{Node: "node01"}, nil, ModeMacvlan).Reconcile(); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_WriteConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "10-anchor.conf")
+
+	for _, c := range []struct {
+		data    string
+		written bool
+	}{
+		{"{}", true},
+		{"{}", false},
+		{`{"name": "anchor"}`, true},
+	} {
+		written, err := WriteConf(path, []byte(c.data))
+		if err != nil || written != c.written {
+			t.Fatalf("expected written %v for %s, got %v %v", c.written, c.data, written, err)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected the temporary files removed, got %d files", len(files))
+	}
+}
+
+func Test_SelectNodeNetwork(t *testing.T) {
+	rack := []Interface{
+		{Master: "bond0", VLAN: 102, Gateway: "10.0.102.1", Subnets: []string{"10.0.103.0/24"},
+			HostIPs: map[string]string{"node01": "10.0.102.8/24", "node02": "10.0.102.9/24"}},
+	}
+	specs := map[string]*NodeNetworkSpec{
+		"rack01": {NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"rack": "r01"}}, Interfaces: rack},
+		"node02": {NodeName: "node02", Interfaces: []Interface{{Master: "eth0", IP: "10.0.2.9/24", Gateway: "10.0.2.1"}}},
+	}
+
+	n, err := SelectNodeNetwork(specs, "node01", map[string]string{"rack": "r01"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(n.Interfaces) != 1 || n.Interfaces[0].IP != "10.0.102.8/24" {
+		t.Fatalf("unexpected interfaces %v", n.Interfaces)
+	}
+	expected := map[string]config.Master{
+		"10.0.102.0/24": {Master: "bond0", VLAN: 102},
+		"10.0.103.0/24": {Master: "bond0", VLAN: 102},
+	}
+	if octopus := n.Octopus(); !reflect.DeepEqual(octopus, expected) {
+		t.Fatalf("unexpected octopus map %v", octopus)
+	}
+
+	// The one naming the node wins.
+	if n, err = SelectNodeNetwork(specs, "node02", map[string]string{"rack": "r01"}); err != nil || n.Interfaces[0].Master != "eth0" {
+		t.Fatalf("expected the network of node02, got %v %v", n, err)
+	}
+	// Not an empty network, which would remove the shims.
+	if n, err = SelectNodeNetwork(specs, "node03", map[string]string{"rack": "r02"}); err != ErrNotSelected {
+		t.Fatalf("expected ErrNotSelected, got %v %v", n, err)
+	}
+	// No IP for the node.
+	if _, err = SelectNodeNetwork(specs, "node03", map[string]string{"rack": "r01"}); err == nil {
+		t.Fatal("expected error for the node without IP")
+	}
+	specs["rack01-copy"] = specs["rack01"]
+	if _, err = SelectNodeNetwork(specs, "node01", map[string]string{"rack": "r01"}); err == nil {
+		t.Fatal("expected error for the node selected twice")
+	}
+}
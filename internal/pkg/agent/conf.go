@@ -0,0 +1,90 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hainesc/anchor/internal/pkg/config"
+)
+
+// Modes of anchor, which are the main plugins.
+const (
+	ModeMacvlan = "macvlan"
+	ModeOctopus = "octopus"
+	// ModeBridge is octopus with the bridge driver, see config.DriverBridge.
+	ModeBridge = "bridge"
+)
+
+// RenderConf renders the CNI network config from the template in deployment/anchor.yaml.
+// The placeholders such as __ETCD_ENDPOINTS__ are replaced by values, then the octopus
+// map and the node IPs are filled in from the node network. The octopus map is removed
+// for macvlan, and the master is removed for octopus and bridge.
+func RenderConf(template string, values map[string]string, mode string, network *NodeNetwork) ([]byte, error) {
+	// The fields filled in later are left empty, so the template is valid JSON.
+	pairs := []string{"__OCTOPUS__", "", "__NODE_IPS__", "", "__ANCHOR_MODE__", mode}
+	for k, v := range values {
+		pairs = append(pairs, k, v)
+	}
+	conf := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(strings.NewReplacer(pairs...).Replace(template)), &conf); err != nil {
+		return nil, fmt.Errorf("failed to render CNI network config: %v", err)
+	}
+
+	switch mode {
+	case ModeOctopus:
+		delete(conf, "master")
+		conf["octopus"] = network.Octopus()
+	case ModeBridge:
+		delete(conf, "master")
+		conf["type"] = ModeOctopus
+		conf["driver"] = config.DriverBridge
+		conf["octopus"] = network.Octopus()
+	case ModeMacvlan:
+		delete(conf, "octopus")
+		if master, _ := conf["master"].(string); master == "" && len(network.Interfaces) > 0 {
+			conf["master"] = network.Interfaces[0].master().Name()
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	if ipam, ok := conf["ipam"].(map[string]interface{}); ok {
+		ipam["node_ips"] = network.NodeIPs()
+	}
+	return json.MarshalIndent(conf, "", "    ")
+}
+
+// WriteConf writes data to path if it is changed, and returns true if written. The file
+// is replaced at once, so the runtime never reads a part of it.
+func WriteConf(path string, data []byte) (bool, error) {
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return false, nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err = tmp.Close(); err != nil {
+		return false, err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
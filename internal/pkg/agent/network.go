@@ -0,0 +1,380 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"syscall"
+
+	"github.com/hainesc/anchor/internal/pkg/config"
+	"github.com/hainesc/anchor/internal/pkg/vlan"
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+)
+
+// agentNetwork is the network of the shim interfaces using the VLAN sub-interfaces,
+// so octopus keeps the sub-interfaces as long as the shims are there.
+const agentNetwork = "anchor-agent"
+
+// shimPattern matches the names of the shim interfaces.
+var shimPattern = regexp.MustCompile(`^acr[0-9]{2,}$`)
+
+// shimName returns the name of the shim interface of the i-th interface.
+func shimName(i int) string {
+	return fmt.Sprintf("acr%02d", i)
+}
+
+// Reconciler keeps the shim interfaces of the node as the node network, the shims are
+// macvlan interfaces of the masters, which take over the IPs of the node from the
+// masters, since the pods attached to a master could not reach the master itself.
+// In ModeBridge the bridges of the masters take over the IPs instead, and the masters
+// are attached to them, see config.DriverBridge.
+type Reconciler struct {
+	network *NodeNetwork
+	vlans   *vlan.Manager
+	mode    string
+}
+
+// NewReconciler returns a reconciler of the node network in mode, the VLAN sub-interfaces
+// are kept by vlans, which should be the same as octopus uses.
+func NewReconciler(network *NodeNetwork, vlans *vlan.Manager, mode string) *Reconciler {
+	return &Reconciler{network: network, vlans: vlans, mode: mode}
+}
+
+// Reconcile creates or fixes the shim interfaces, their addresses and routes, and removes
+// the shims no longer in the node network, whose addresses and routes are moved back to
+// the masters first. Nothing is removed if the node network is empty, which is more likely
+// a mistake, such as the node is missing in the file, than cutting the node off on purpose.
+// It is safe to call it again and again.
+func (r *Reconciler) Reconcile() error {
+	if len(r.network.Interfaces) == 0 {
+		return nil
+	}
+	desired := make(map[string]bool)
+	for i, iface := range r.network.Interfaces {
+		name := shimName(i)
+		if r.mode == ModeBridge {
+			// The bridges are never removed, since the pods are attached to them.
+			if err := r.reconcileBridge(name, iface, i == 0); err != nil {
+				return fmt.Errorf("failed to reconcile the bridge of master %s: %v", iface.Master, err)
+			}
+			continue
+		}
+		desired[name] = true
+		if err := r.reconcileShim(name, iface, i == 0); err != nil {
+			return fmt.Errorf("failed to reconcile %s of master %s: %v", name, iface.Master, err)
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if _, ok := link.(*netlink.Macvlan); !ok || !shimPattern.MatchString(name) || desired[name] {
+			continue
+		}
+		if err = restore(link); err != nil {
+			return fmt.Errorf("failed to restore the addresses of %q: %v", name, err)
+		}
+		if err = netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", name, err)
+		}
+		if err = r.vlans.Release(agentNetwork, r.network.Node, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileShim keeps the shim of the interface, the default route goes via it if
+// defaultRoute is true.
+func (r *Reconciler) reconcileShim(name string, iface Interface, defaultRoute bool) error {
+	master, err := r.master(name, iface)
+	if err != nil {
+		return err
+	}
+	shim, err := ensureShim(name, master)
+	if err != nil {
+		return err
+	}
+	return takeOver(shim, master, iface, defaultRoute)
+}
+
+// reconcileBridge keeps the bridge of the interface, which the master is attached to,
+// the default route goes via it if defaultRoute is true. The VLAN sub-interface is
+// kept for name as reconcileShim does.
+func (r *Reconciler) reconcileBridge(name string, iface Interface, defaultRoute bool) error {
+	master, err := r.master(name, iface)
+	if err != nil {
+		return err
+	}
+	br, err := ensureBridge(master)
+	if err != nil {
+		return err
+	}
+	if master.Attrs().MasterIndex != br.Attrs().Index {
+		if err = netlink.LinkSetMaster(master, br); err != nil {
+			return fmt.Errorf("failed to attach %q to bridge %q: %v", master.Attrs().Name, br.Attrs().Name, err)
+		}
+	}
+	return takeOver(br, master, iface, defaultRoute)
+}
+
+// master returns the master of the interface, which is set up. The VLAN sub-interface is
+// created if needed, and kept for name.
+func (r *Reconciler) master(name string, iface Interface) (netlink.Link, error) {
+	if _, _, _, err := iface.parse(); err != nil {
+		return nil, err
+	}
+	masterName, err := r.vlans.Acquire(iface.master(), agentNetwork, r.network.Node, name)
+	if err != nil {
+		return nil, err
+	}
+	master, err := netlink.LinkByName(masterName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", masterName, err)
+	}
+	if err = netlink.LinkSetUp(master); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", masterName, err)
+	}
+	return master, nil
+}
+
+// takeOver moves the IP of the interface from master to link, which is set up, and keeps
+// the route of the subnet via link, and the default route too if defaultRoute is true.
+// The IP is added to link before deleted from master, and moved back on error, so the
+// node is not left unreachable.
+func takeOver(link, master netlink.Link, iface Interface, defaultRoute bool) (err error) {
+	addr, subnet, gateway, err := iface.parse()
+	if err != nil {
+		return err
+	}
+	name := link.Attrs().Name
+	ip := &netlink.Addr{IPNet: addr}
+	added := false
+	if found, err := hasAddr(link, addr); err != nil {
+		return err
+	} else if !found {
+		if err = netlink.AddrAdd(link, ip); err != nil {
+			return fmt.Errorf("failed to add %s to %q: %v", addr.String(), name, err)
+		}
+		added = true
+	}
+	deleted := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if deleted {
+			netlink.AddrAdd(master, ip)
+			if defaultRoute {
+				netlink.RouteReplace(&netlink.Route{LinkIndex: master.Attrs().Index, Gw: gateway})
+			}
+		}
+		if added {
+			netlink.AddrDel(link, ip)
+		}
+	}()
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	if found, err := hasAddr(master, addr); err != nil {
+		return err
+	} else if found {
+		if err = netlink.AddrDel(master, ip); err != nil {
+			return fmt.Errorf("failed to delete %s from %q: %v", addr.String(), master.Attrs().Name, err)
+		}
+		deleted = true
+	}
+
+	index := link.Attrs().Index
+	if err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: index,
+		Dst:       subnet,
+		Scope:     netlink.SCOPE_LINK,
+		Src:       addr.IP,
+	}); err != nil {
+		return fmt.Errorf("failed to replace the route of %s: %v", subnet.String(), err)
+	}
+	if defaultRoute {
+		if err = netlink.RouteReplace(&netlink.Route{LinkIndex: index, Gw: gateway}); err != nil {
+			return fmt.Errorf("failed to replace the default route via %s: %v", gateway.String(), err)
+		}
+	}
+
+	if added && addr.IP.To4() != nil {
+		// Flush the caches of the switches and the gateway, which point the IP to the master.
+		if i, err := net.InterfaceByIndex(index); err == nil {
+			_ = arping.GratuitousArpOverIface(addr.IP, *i)
+		}
+	}
+	return nil
+}
+
+// restore moves the addresses of the shim back to its master, along with the routes via
+// them, so the node is still reachable once the shim is removed. The addresses taken over
+// by other links, such as another shim or the bridge of the master, are left to them.
+func restore(shim netlink.Link) error {
+	master, err := netlink.LinkByIndex(shim.Attrs().ParentIndex)
+	if err != nil {
+		return fmt.Errorf("failed to lookup the master: %v", err)
+	}
+	if master.Attrs().MasterIndex != 0 {
+		// Attached to a bridge, which takes over the addresses.
+		return nil
+	}
+	addrs, err := netlink.AddrList(shim, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	restored := make([]*net.IPNet, 0)
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		taken, err := takenOver(links, shim, addr.IPNet)
+		if err != nil {
+			return err
+		}
+		if taken {
+			continue
+		}
+		if found, err := hasAddr(master, addr.IPNet); err != nil {
+			return err
+		} else if !found {
+			if err = netlink.AddrAdd(master, &netlink.Addr{IPNet: addr.IPNet}); err != nil {
+				return fmt.Errorf("failed to add %s to %q: %v", addr.IPNet.String(), master.Attrs().Name, err)
+			}
+		}
+		restored = append(restored, &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+	}
+
+	routes, err := netlink.RouteList(shim, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		// The routes of the prefixes are added along with the addresses.
+		if route.Protocol == syscall.RTPROT_KERNEL || prefixOf(route, restored) || !routeVia(route, restored) {
+			continue
+		}
+		route.LinkIndex = master.Attrs().Index
+		if err = netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("failed to move the route %s to %q: %v", route.String(), master.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// takenOver returns true if addr is on one of links other than the shim.
+func takenOver(links []netlink.Link, shim netlink.Link, addr *net.IPNet) (bool, error) {
+	for _, link := range links {
+		if link.Attrs().Index == shim.Attrs().Index {
+			continue
+		}
+		if found, err := hasAddr(link, addr); err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// prefixOf returns true if the destination of the route is one of subnets.
+func prefixOf(route netlink.Route, subnets []*net.IPNet) bool {
+	for _, subnet := range subnets {
+		if route.Dst != nil && route.Dst.String() == subnet.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// routeVia returns true if the destination or the gateway of the route is in subnets.
+func routeVia(route netlink.Route, subnets []*net.IPNet) bool {
+	for _, subnet := range subnets {
+		if (route.Dst != nil && subnet.Contains(route.Dst.IP)) || (route.Gw != nil && subnet.Contains(route.Gw)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureShim returns the shim named name attached to master, which is created if missing,
+// or created again if it is attached to another one, such as the master is recreated.
+func ensureShim(name string, master netlink.Link) (netlink.Link, error) {
+	if link, err := netlink.LinkByName(name); err == nil {
+		if _, ok := link.(*netlink.Macvlan); ok && link.Attrs().ParentIndex == master.Attrs().Index {
+			return link, nil
+		}
+		if err = restore(link); err != nil {
+			return nil, fmt.Errorf("failed to restore the addresses of %q: %v", name, err)
+		}
+		if err = netlink.LinkDel(link); err != nil {
+			return nil, fmt.Errorf("failed to delete %q: %v", name, err)
+		}
+	}
+	shim := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: master.Attrs().Index,
+		},
+		Mode: netlink.MACVLAN_MODE_BRIDGE,
+	}
+	if err := netlink.LinkAdd(shim); err != nil {
+		return nil, fmt.Errorf("failed to create %q: %v", name, err)
+	}
+	return netlink.LinkByName(name)
+}
+
+// ensureBridge returns the bridge of master, which is created if missing, see
+// config.BridgeName. Octopus attaches the pods to it with the bridge driver.
+func ensureBridge(master netlink.Link) (*netlink.Bridge, error) {
+	name := config.BridgeName(master.Attrs().Name)
+	if _, err := netlink.LinkByName(name); err != nil {
+		br := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: name,
+				MTU:  master.Attrs().MTU,
+			},
+		}
+		if err = netlink.LinkAdd(br); err != nil {
+			return nil, fmt.Errorf("failed to create bridge %q: %v", name, err)
+		}
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup bridge %q: %v", name, err)
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%s is %s instead of bridge", name, link.Type())
+	}
+	return br, nil
+}
+
+// hasAddr returns true if addr is on link.
+func hasAddr(link netlink.Link, addr *net.IPNet) (bool, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, fmt.Errorf("failed to list addresses of %s: %v", link.Attrs().Name, err)
+	}
+	for _, a := range addrs {
+		if a.IPNet.IP.Equal(addr.IP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
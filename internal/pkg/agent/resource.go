@@ -0,0 +1,158 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hainesc/anchor/pkg/store/crd"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// NodeNetworkSpec is the spec of AnchorNodeNetwork, which selects the nodes by the name
+// or by the labels. The IPs of the interfaces are taken from HostIPs by the node name if
+// they are not given, so the resource could be shared by the nodes of a rack.
+type NodeNetworkSpec struct {
+	NodeName     string                `json:"nodeName,omitempty"`
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	Interfaces   []Interface           `json:"interfaces"`
+}
+
+// selects returns true if the spec selects the node by its labels.
+func (s *NodeNetworkSpec) selects(nodeLabels map[string]string) (bool, error) {
+	if s.NodeSelector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(s.NodeSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(nodeLabels)), nil
+}
+
+// network returns the network of node in the spec.
+func (s *NodeNetworkSpec) network(node string) *NodeNetwork {
+	n := &NodeNetwork{Node: node}
+	for _, i := range s.Interfaces {
+		if i.IP == "" {
+			i.IP = i.HostIPs[node]
+		}
+		i.HostIPs = nil
+		n.Interfaces = append(n.Interfaces, i)
+	}
+	return n
+}
+
+// ErrNotSelected is returned if the node is not selected by any AnchorNodeNetwork, or not
+// found in the file of node networks. It is not an empty network, so the callers could
+// keep the last one instead of removing the shims and the masters in the CNI config.
+var ErrNotSelected = errors.New("node is not selected by any node network")
+
+// SelectNodeNetwork returns the network of node in specs keyed by the resource names.
+// The one naming the node wins over the ones selecting it by labels, and it is an error
+// if the node is selected by more than one at the same level. It returns ErrNotSelected
+// if the node is not selected.
+func SelectNodeNetwork(specs map[string]*NodeNetworkSpec, node string, nodeLabels map[string]string) (*NodeNetwork, error) {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	named, selected := make([]string, 0), make([]string, 0)
+	for _, name := range names {
+		spec := specs[name]
+		if spec.NodeName != "" {
+			if spec.NodeName == node {
+				named = append(named, name)
+			}
+			continue
+		}
+		ok, err := spec.selects(nodeLabels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node selector of AnchorNodeNetwork %s: %v", name, err)
+		}
+		if ok {
+			selected = append(selected, name)
+		}
+	}
+	for _, matched := range [][]string{named, selected} {
+		switch len(matched) {
+		case 0:
+			continue
+		case 1:
+			n := specs[matched[0]].network(node)
+			if err := n.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid AnchorNodeNetwork %s for node %s: %v", matched[0], node, err)
+			}
+			return n, nil
+		default:
+			return nil, fmt.Errorf("node %s is selected by AnchorNodeNetworks %v", node, matched)
+		}
+	}
+	return nil, ErrNotSelected
+}
+
+// NodeNetworkSource reads the network of nodes from AnchorNodeNetworks.
+type NodeNetworkSource struct {
+	nodes  kubernetes.Interface
+	client dynamic.Interface
+}
+
+// NewNodeNetworkSource returns the source with the config of k8s, see k8s.NewK8sConfig.
+func NewNodeNetworkSource(config *rest.Config) (*NodeNetworkSource, error) {
+	nodes, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	c := *config
+	c.APIPath = "/apis"
+	c.GroupVersion = &crd.GroupVersion
+	client, err := dynamic.NewClient(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeNetworkSource{nodes: nodes, client: client}, nil
+}
+
+// NodeNetwork returns the network of node, see SelectNodeNetwork.
+func (s *NodeNetworkSource) NodeNetwork(node string) (*NodeNetwork, error) {
+	n, err := s.nodes.CoreV1().Nodes().Get(node, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.Resource(crd.NodeNetworks, "").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list of %s", crd.NodeNetworks.Kind)
+	}
+	specs := make(map[string]*NodeNetworkSpec)
+	for _, item := range list.Items {
+		spec := &NodeNetworkSpec{}
+		data, err := json.Marshal(item.Object["spec"])
+		if err == nil {
+			err = json.Unmarshal(data, spec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid spec of %s %s: %v", item.GetKind(), item.GetName(), err)
+		}
+		specs[item.GetName()] = spec
+	}
+	return SelectNodeNetwork(specs, node, n.Labels)
+}
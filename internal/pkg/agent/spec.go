@@ -0,0 +1,154 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+// Package agent configures the network of a node for anchor, which is the shim interfaces
+// of the masters taking over the IPs of the node, and the CNI network config.
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hainesc/anchor/internal/pkg/config"
+)
+
+// NodeNetwork is the network of a node. The default route of the node goes via the
+// gateway of the first interface.
+type NodeNetwork struct {
+	Node       string      `json:"node"`
+	Interfaces []Interface `json:"interfaces"`
+}
+
+// Interface is a master on the node and the subnet it serves. The IP of the node in the
+// subnet is moved from the master to its shim interface, so the node could reach the pods.
+type Interface struct {
+	Master string `json:"master"`
+	// VLAN is the VLAN ID, the sub-interface of the master is used if it is set.
+	VLAN int `json:"vlan,omitempty"`
+	// IP of the node with the prefix length of the subnet, such as 10.0.2.8/24.
+	IP      string `json:"ip,omitempty"`
+	Gateway string `json:"gateway"`
+	// Subnets are the other subnets served by the master, in which the node has no IP.
+	Subnets []string `json:"subnets,omitempty"`
+	// HostIPs are the IPs of the nodes keyed by the node names, in the same form as IP.
+	// It is used if the interface is shared by nodes, see NodeNetworkSpec.
+	HostIPs map[string]string `json:"hostIPs,omitempty"`
+}
+
+// master returns the master in the octopus map.
+func (i *Interface) master() config.Master {
+	return config.Master{Master: i.Master, VLAN: i.VLAN}
+}
+
+// parse returns the IP, the subnet and the gateway of the interface.
+func (i *Interface) parse() (*net.IPNet, *net.IPNet, net.IP, error) {
+	if err := i.master().Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	ip, subnet, err := net.ParseCIDR(i.IP)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid IP %q of master %s: %v", i.IP, i.Master, err)
+	}
+	gateway := net.ParseIP(i.Gateway)
+	if gateway == nil || !subnet.Contains(gateway) {
+		return nil, nil, nil, fmt.Errorf("invalid gateway %q of master %s", i.Gateway, i.Master)
+	}
+	for _, s := range i.Subnets {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid subnet %q of master %s: %v", s, i.Master, err)
+		}
+	}
+	return &net.IPNet{IP: ip, Mask: subnet.Mask}, subnet, gateway, nil
+}
+
+// Validate returns error if any interface is invalid.
+func (n *NodeNetwork) Validate() error {
+	for _, i := range n.Interfaces {
+		if _, _, _, err := i.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Octopus returns the octopus map of the node, which maps the subnets to the masters.
+func (n *NodeNetwork) Octopus() map[string]config.Master {
+	octopus := make(map[string]config.Master)
+	for _, i := range n.Interfaces {
+		if _, subnet, _, err := i.parse(); err == nil {
+			octopus[subnet.String()] = i.master()
+			for _, s := range i.Subnets {
+				_, served, _ := net.ParseCIDR(s)
+				octopus[served.String()] = i.master()
+			}
+		}
+	}
+	return octopus
+}
+
+// NodeIPs returns the IPs of the node, which are used as the gateways to the services.
+func (n *NodeNetwork) NodeIPs() []string {
+	ips := make([]string, 0, len(n.Interfaces))
+	for _, i := range n.Interfaces {
+		if ip, _, _, err := i.parse(); err == nil {
+			ips = append(ips, ip.IP.String())
+		}
+	}
+	return ips
+}
+
+// LoadNodeNetwork loads the network of node from the JSON file, which is a list of
+// NodeNetwork. It returns ErrNotSelected if node is not found.
+func LoadNodeNetwork(path, node string) (*NodeNetwork, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	networks := make([]NodeNetwork, 0)
+	if err = json.Unmarshal(data, &networks); err != nil {
+		return nil, fmt.Errorf("failed to load node network from %s: %v", path, err)
+	}
+	for _, n := range networks {
+		if n.Node == node {
+			return &n, n.Validate()
+		}
+	}
+	return nil, ErrNotSelected
+}
+
+// ParseClusterNetwork parses the network of node from the cluster network written for
+// install-cni.sh, such as "node01,eth0.2,10.0.2.8,10.0.2.1,24;node02,...", the fields
+// are the hostname, the master, the IP, the gateway and the prefix length.
+func ParseClusterNetwork(s, node string) (*NodeNetwork, error) {
+	n := &NodeNetwork{Node: node}
+	for _, item := range strings.Split(s, ";") {
+		item = strings.Join(strings.Fields(item), "")
+		if item == "" {
+			continue
+		}
+		fields := strings.Split(item, ",")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid item %q of cluster network", item)
+		}
+		if fields[0] != node {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[4]); err != nil {
+			return nil, fmt.Errorf("invalid mask of item %q of cluster network", item)
+		}
+		n.Interfaces = append(n.Interfaces, Interface{
+			Master:  fields[1],
+			IP:      fields[2] + "/" + fields[4],
+			Gateway: fields[3],
+		})
+	}
+	return n, n.Validate()
+}
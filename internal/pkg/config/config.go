@@ -10,25 +10,96 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/hainesc/anchor/pkg/runtime/k8s"
 )
 
 // OctopusConf represents the Octopus configuration.
 type OctopusConf struct {
 	types.NetConf
-	Mode       string            `json:"mode"`
-	MTU        int               `json:"mtu"`
-	Octopus    map[string]string `json:"octopus"`
+	// Driver attaches the pods to the master, macvlan if omitted.
+	Driver string `json:"driver,omitempty"`
+	// Mode of the driver, bridge, private, vepa or passthru for macvlan, bridge by default,
+	// and l2, l3 or l3s for ipvlan, l2 by default. It is ignored by the bridge driver.
+	Mode string `json:"mode"`
+	MTU  int    `json:"mtu"`
+	// Octopus maps the subnets to the masters on the node.
+	Octopus    map[string]Master `json:"octopus"`
 	Kubernetes k8s.Kubernetes    `json:"kubernetes"`
 	Policy     k8s.Policy        `json:"policy"`
+	// Where octopus keeps the containers using the VLAN sub-interfaces it creates,
+	// /var/lib/cni/octopus if omitted.
+	StateDir string `json:"state_dir,omitempty"`
+	// How long to wait for replies to the ARP probes of the IPv4 addresses allocated, such
+	// as "200ms". The addresses are not probed if it is omitted.
+	DADTimeout  string        `json:"dad_timeout,omitempty"`
+	DADDuration time.Duration `json:"-"`
+	// The result of ADD, passed in for CHECK.
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+	// The attachments still in use, passed in for GC.
+	ValidAttachments []Attachment `json:"cni.dev/valid-attachments,omitempty"`
+}
+
+// Master is the host interface of a subnet in the octopus map. It is written as the name
+// of an existing interface such as "eth0.2", or as the parent and the VLAN ID such as
+// {"master": "bond0", "vlan": 102}, then octopus creates the VLAN sub-interface bond0.102
+// for the first pod of the VLAN on the node, and deletes it after the last one is gone.
+type Master struct {
+	Master string `json:"master"`
+	VLAN   int    `json:"vlan,omitempty"`
+}
+
+// UnmarshalJSON accepts both the name and the object.
+func (m *Master) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*m = Master{Master: name}
+		return nil
+	}
+	// The alias has no UnmarshalJSON, so it does not recurse.
+	type master Master
+	return json.Unmarshal(data, (*master)(m))
+}
+
+// MarshalJSON writes the name only if the master has no VLAN ID.
+func (m Master) MarshalJSON() ([]byte, error) {
+	if m.VLAN == 0 {
+		return json.Marshal(m.Master)
+	}
+	type master Master
+	return json.Marshal(master(m))
+}
+
+// Name returns the name of the interface the pods are attached to.
+func (m Master) Name() string {
+	if m.VLAN == 0 {
+		return m.Master
+	}
+	return fmt.Sprintf("%s.%d", m.Master, m.VLAN)
+}
+
+// Validate returns error if the VLAN ID is out of range.
+func (m Master) Validate() error {
+	if m.Master == "" {
+		return fmt.Errorf("master is required")
+	}
+	if m.VLAN < 0 || m.VLAN > 4094 {
+		return fmt.Errorf("invalid VLAN ID %d of master %s", m.VLAN, m.Master)
+	}
+	return nil
 }
 
 // IPAMConf represents the IPAM configuration.
 type IPAMConf struct {
 	Name string
 	Type string `json:"type"`
+	// Which store to use, etcd if omitted.
+	Store StoreConf `json:"store"`
 	// etcd client
 	Endpoints string `json:"etcd_endpoints"`
 	// Used for k8s client
@@ -43,8 +114,72 @@ type IPAMConf struct {
 	// Additional network config for pods
 	Routes     []*types.Route `json:"routes,omitempty"`
 	ResolvConf string         `json:"resolvConf,omitempty"`
+	// Max time waiting for the lock of a subnet, such as "30s"
+	LockTimeout  string        `json:"lock_timeout,omitempty"`
+	LockDuration time.Duration `json:"-"`
+	// How long a reservation keeps pending until octopus commits it, 2m by default.
+	// Only octopus commits, so it is ignored for other plugins.
+	LeaseTTL      string        `json:"lease_ttl,omitempty"`
+	LeaseDuration time.Duration `json:"-"`
+	// How long the IPs released are quarantined before allocated again, such as "5m".
+	ReleaseCooldown  string        `json:"release_cooldown,omitempty"`
+	CooldownDuration time.Duration `json:"-"`
+	// The result of ADD, passed in for CHECK.
+	PrevResult *current.Result `json:"-"`
+	// The attachments still in use, passed in for GC.
+	ValidAttachments []Attachment `json:"-"`
+}
+
+// StoreConf represents the store configuration.
+type StoreConf struct {
+	// Type is etcd, file or crd.
+	Type string `json:"type"`
+	// Path of the file for the file store.
+	Path string `json:"path"`
+}
+
+// Types of store.
+const (
+	StoreEtcd = "etcd"
+	StoreFile = "file"
+	// StoreCRD keeps everything in the custom resources of Kubernetes.
+	StoreCRD = "crd"
+)
+
+// Drivers of octopus.
+const (
+	DriverMacvlan = "macvlan"
+	// DriverIPvlan shares the MAC of the master with the pods, which works on the
+	// switches limiting the MACs of a port.
+	DriverIPvlan = "ipvlan"
+	// DriverBridge attaches the pods to a Linux bridge of the master via veth pairs,
+	// for the hosts where macvlan is unavailable.
+	DriverBridge = "bridge"
+)
+
+// BridgeName returns the name of the bridge of master used by DriverBridge, the hash of
+// master is used if the name is too long for an interface.
+func BridgeName(master string) string {
+	if name := "br-" + master; len(name) <= 15 {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(master))
+	return fmt.Sprintf("br-%08x", h.Sum32())
+}
+
+// Attachment is an attachment of the network to a container.
+type Attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
 }
 
+const (
+	defaultLockTimeout = 30 * time.Second
+	defaultLeaseTTL    = 2 * time.Minute
+	defaultStateDir    = "/var/lib/cni/octopus"
+)
+
 // CNIConf represents the top-level network config.
 type CNIConf struct {
 	Name       string    `json:"name"`
@@ -52,6 +187,9 @@ type CNIConf struct {
 	Type       string    `json:"type"`
 	Master     string    `json:"master"`
 	IPAM       *IPAMConf `json:"ipam"`
+
+	RawPrevResult    map[string]interface{} `json:"prevResult,omitempty"`
+	ValidAttachments []Attachment           `json:"cni.dev/valid-attachments,omitempty"`
 }
 
 // LoadOctopusConf loads config from bytes which read from config file for octopus.
@@ -65,6 +203,36 @@ func LoadOctopusConf(bytes []byte) (*OctopusConf, string, error) {
 		return nil, "", fmt.Errorf(`"octopus" field is required. It specifies a list of interface names to virtualize`)
 	}
 
+	for subnet, master := range n.Octopus {
+		if err := master.Validate(); err != nil {
+			return nil, "", fmt.Errorf("invalid master of %s in 'octopus': %v", subnet, err)
+		}
+	}
+	if n.StateDir == "" {
+		n.StateDir = defaultStateDir
+	}
+
+	switch n.Driver {
+	case "":
+		n.Driver = DriverMacvlan
+	case DriverMacvlan, DriverIPvlan, DriverBridge:
+	default:
+		return nil, "", fmt.Errorf("unknown driver %q", n.Driver)
+	}
+
+	if n.DADTimeout != "" {
+		d, err := time.ParseDuration(n.DADTimeout)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid format of 'dad_timeout': %v", err)
+		}
+		n.DADDuration = d
+	}
+
+	prevResult, err := parsePrevResult(n.RawPrevResult)
+	if err != nil {
+		return nil, "", err
+	}
+	n.PrevResult = prevResult
 	return n, n.CNIVersion, nil
 }
 
@@ -79,8 +247,73 @@ func LoadIPAMConf(bytes []byte, envArgs string) (*IPAMConf, string, error) {
 		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
 	}
 
-	if n.IPAM.Endpoints == "" {
-		return nil, "", fmt.Errorf("IPAM config missing 'etcd_endpoints' keys")
+	switch n.IPAM.Store.Type {
+	case "", StoreEtcd:
+		n.IPAM.Store.Type = StoreEtcd
+		if n.IPAM.Endpoints == "" {
+			return nil, "", fmt.Errorf("IPAM config missing 'etcd_endpoints' keys")
+		}
+	case StoreFile:
+		if n.IPAM.Store.Path == "" {
+			return nil, "", fmt.Errorf("IPAM config missing 'path' of the file store")
+		}
+	case StoreCRD:
+		// The API server is found by the kubernetes and policy config.
+	default:
+		return nil, "", fmt.Errorf("unknown type of store %q", n.IPAM.Store.Type)
+	}
+
+	n.IPAM.LockDuration = defaultLockTimeout
+	if n.IPAM.LockTimeout != "" {
+		d, err := time.ParseDuration(n.IPAM.LockTimeout)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid format of 'lock_timeout': %v", err)
+		}
+		n.IPAM.LockDuration = d
 	}
+
+	if n.Type == "octopus" {
+		n.IPAM.LeaseDuration = defaultLeaseTTL
+	}
+	if n.IPAM.LeaseTTL != "" && n.Type == "octopus" {
+		d, err := time.ParseDuration(n.IPAM.LeaseTTL)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid format of 'lease_ttl': %v", err)
+		}
+		n.IPAM.LeaseDuration = d
+	}
+
+	if n.IPAM.ReleaseCooldown != "" {
+		d, err := time.ParseDuration(n.IPAM.ReleaseCooldown)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid format of 'release_cooldown': %v", err)
+		}
+		n.IPAM.CooldownDuration = d
+	}
+
+	prevResult, err := parsePrevResult(n.RawPrevResult)
+	if err != nil {
+		return nil, "", err
+	}
+	n.IPAM.PrevResult = prevResult
+	n.IPAM.ValidAttachments = n.ValidAttachments
+	// The reservations are recorded along with the name of the network, see GC.
+	n.IPAM.Name = n.Name
 	return n.IPAM, n.CNIVersion, nil
 }
+
+// parsePrevResult parses the prevResult in config, nil if not found.
+func parsePrevResult(raw map[string]interface{}) (*current.Result, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load prevResult: %v", err)
+	}
+	r, err := current.NewResult(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load prevResult: %v", err)
+	}
+	return current.NewResultFromResult(r)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+// Package dad detects the IPv4 addresses in use by others with ARP probes of RFC 5227.
+// The probes are sent with the sender IP 0.0.0.0, so they work before the address is
+// configured, and the hosts holding the address reply them, which is not the case for
+// the requests sent from the address itself.
+package dad
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// arpLen is the length of an ARP packet for IPv4 over ethernet.
+	arpLen       = 28
+	opRequest    = 1
+	opReply      = 2
+	hardwareEth  = 1
+	protocolIPv4 = 0x0800
+)
+
+// Probe sends an ARP probe for ip over iface, and returns the hardware address of the
+// host which holds ip, or nil if nobody claims it within timeout. It must be called in
+// the netns of iface.
+func Probe(ip net.IP, iface *net.Interface, timeout time.Duration) (net.HardwareAddr, error) {
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer syscall.Close(sock)
+
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: iface.Index}
+	if err = syscall.Bind(sock, addr); err != nil {
+		return nil, fmt.Errorf("failed to bind packet socket to %s: %v", iface.Name, err)
+	}
+	addr.Halen = 6
+	copy(addr.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err = syscall.Sendto(sock, probe(ip, iface.HardwareAddr), 0, addr); err != nil {
+		return nil, fmt.Errorf("failed to send ARP probe for %s over %s: %v", ip, iface.Name, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err = syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return nil, err
+		}
+		n, _, err := syscall.Recvfrom(sock, buf, 0)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("failed to receive ARP over %s: %v", iface.Name, err)
+		}
+		if mac := conflict(buf[:n], ip, iface.HardwareAddr); mac != nil {
+			return mac, nil
+		}
+	}
+}
+
+// probe returns the ARP probe for ip sent from mac.
+func probe(ip net.IP, mac net.HardwareAddr) []byte {
+	packet := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(packet[0:2], hardwareEth)
+	binary.BigEndian.PutUint16(packet[2:4], protocolIPv4)
+	packet[4], packet[5] = 6, 4
+	binary.BigEndian.PutUint16(packet[6:8], opRequest)
+	copy(packet[8:14], mac)
+	// The sender IP in packet[14:18] and the target mac are left zero.
+	copy(packet[24:28], ip.To4())
+	return packet
+}
+
+// conflict returns the sender mac of packet if it shows ip in use by another host, that
+// is, the sender IP is ip, or it is a probe for ip from another host. Otherwise nil.
+func conflict(packet []byte, ip net.IP, mac net.HardwareAddr) net.HardwareAddr {
+	if len(packet) < arpLen ||
+		binary.BigEndian.Uint16(packet[0:2]) != hardwareEth ||
+		binary.BigEndian.Uint16(packet[2:4]) != protocolIPv4 ||
+		packet[4] != 6 || packet[5] != 4 {
+		return nil
+	}
+	op := binary.BigEndian.Uint16(packet[6:8])
+	if op != opRequest && op != opReply {
+		return nil
+	}
+	sender := net.HardwareAddr(append([]byte{}, packet[8:14]...))
+	if bytes.Equal(sender, mac) {
+		// Sent by ourselves.
+		return nil
+	}
+	senderIP, targetIP := net.IP(packet[14:18]), net.IP(packet[24:28])
+	if senderIP.Equal(ip) || (op == opRequest && senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip)) {
+		return sender
+	}
+	return nil
+}
+
+// htons converts a short from host to network byte order, whatever the byte order of the host is.
+func htons(i uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], i)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package dad
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"unsafe"
+)
+
+func Test_conflict(t *testing.T) {
+	ip := net.ParseIP("10.0.1.2")
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	other, _ := net.ParseMAC("02:00:00:00:00:02")
+
+	ours := probe(ip, mac)
+	if binary.BigEndian.Uint16(ours[6:8]) != opRequest || !net.IP(ours[14:18]).Equal(net.IPv4zero) ||
+		!net.IP(ours[24:28]).Equal(ip.To4()) || !bytes.Equal(ours[8:14], mac) {
+		t.Fatalf("unexpected probe %v", ours)
+	}
+
+	reply := make([]byte, arpLen)
+	copy(reply, ours)
+	binary.BigEndian.PutUint16(reply[6:8], opReply)
+	copy(reply[8:14], other)
+	copy(reply[14:18], ip.To4())
+	copy(reply[18:24], mac)
+
+	unrelated := make([]byte, arpLen)
+	copy(unrelated, reply)
+	copy(unrelated[14:18], net.ParseIP("10.0.1.3").To4())
+
+	cases := []struct {
+		name   string
+		packet []byte
+		want   net.HardwareAddr
+	}{
+		{"our probe", ours, nil},
+		{"probe of another host", probe(ip, other), other},
+		{"reply", reply, other},
+		{"unrelated", unrelated, nil},
+		{"truncated", reply[:20], nil},
+	}
+	for _, c := range cases {
+		if got := conflict(c.packet, ip, mac); !bytes.Equal(got, c.want) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func Test_htons(t *testing.T) {
+	// The kernel reads the protocol as it is in memory, which must be in network byte order.
+	i := htons(0x0806)
+	if b := (*[2]byte)(unsafe.Pointer(&i)); b[0] != 0x08 || b[1] != 0x06 {
+		t.Fatalf("expected 0x0806 in network byte order, got %v", b[:])
+	}
+}
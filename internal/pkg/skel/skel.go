@@ -0,0 +1,314 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+// Package skel adds the verbs introduced after spec 0.3.1 to the skel of cni,
+// since the cni we depend on knows nothing about them.
+package skel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ipam"
+)
+
+const (
+	// checkVersion is the first version of spec which supports CHECK.
+	checkVersion = "0.4.0"
+	// gcVersion is the first version of spec which supports GC and STATUS.
+	gcVersion = "1.1.0"
+)
+
+// ErrPluginNotAvailable is returned by STATUS if the plugin could not serve ADD.
+const ErrPluginNotAvailable uint = 50
+
+// All is the versions of spec supported by anchor and octopus.
+var All = version.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1", checkVersion, "1.0.0", gcVersion)
+
+// CNIFuncs is the functions of the verbs, nil if the verb is not supported.
+type CNIFuncs struct {
+	Add    func(_ *skel.CmdArgs) error
+	Del    func(_ *skel.CmdArgs) error
+	Check  func(_ *skel.CmdArgs) error
+	GC     func(_ *skel.CmdArgs) error
+	Status func(_ *skel.CmdArgs) error
+	// Commit is not a verb of spec but of anchor, octopus calls it on anchor
+	// once the interface is configured, see store.StatePending.
+	Commit func(_ *skel.CmdArgs) error
+	// Conflict is not a verb of spec but of anchor, octopus calls it on anchor once the
+	// IP allocated is found in use by others, see store.StateConflict.
+	Conflict func(_ *skel.CmdArgs) error
+}
+
+const (
+	// commitCommand is the CNI_COMMAND of Commit.
+	commitCommand = "COMMIT"
+	// conflictCommand is the CNI_COMMAND of Conflict.
+	conflictCommand = "CONFLICT"
+)
+
+// ErrVerbNotSupported is returned by ExecCommit and ExecConflict if the plugin knows
+// nothing about the verb, such as the IPAM plugins other than anchor.
+var ErrVerbNotSupported = errors.New("verb not supported by the plugin")
+
+// ConflictArgs is the CNI_ARGS of CONFLICT, in which CONFLICT_IP is the IP in conflict.
+type ConflictArgs struct {
+	types.CommonArgs
+	CONFLICT_IP types.UnmarshallableString
+}
+
+// verbs is the verbs handled here, with the first version of spec supports them
+// and the env variables required by them.
+var verbs = map[string]struct {
+	since    string
+	required []string
+}{
+	"CHECK":  {checkVersion, []string{"CNI_CONTAINERID", "CNI_NETNS", "CNI_IFNAME", "CNI_PATH"}},
+	"GC":     {gcVersion, []string{"CNI_PATH"}},
+	"STATUS": {gcVersion, []string{"CNI_PATH"}},
+	// Any version is fine since it is not a verb of spec.
+	commitCommand:   {"0.1.0", []string{"CNI_CONTAINERID"}},
+	conflictCommand: {"0.1.0", []string{"CNI_CONTAINERID", "CNI_ARGS"}},
+}
+
+// PluginMain is the same as the one in cni, but handles CHECK, GC and STATUS by itself.
+func PluginMain(funcs CNIFuncs, versionInfo version.PluginInfo) {
+	var cmd func(_ *skel.CmdArgs) error
+	verb := os.Getenv("CNI_COMMAND")
+	switch verb {
+	case "CHECK":
+		cmd = funcs.Check
+	case "GC":
+		cmd = funcs.GC
+	case "STATUS":
+		cmd = funcs.Status
+	case commitCommand:
+		cmd = funcs.Commit
+	case conflictCommand:
+		cmd = funcs.Conflict
+	default:
+		skel.PluginMain(funcs.Add, funcs.Del, versionInfo)
+		return
+	}
+	if err := call(verb, cmd, versionInfo); err != nil {
+		e, ok := err.(*types.Error)
+		if !ok {
+			e = &types.Error{Code: 100, Msg: err.Error()}
+		}
+		if err := e.Print(); err != nil {
+			log.Print("Error writing error JSON to stdout: ", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// call calls cmd of verb with the args read from env and stdin.
+func call(verb string, cmd func(_ *skel.CmdArgs) error, versionInfo version.PluginInfo) error {
+	if cmd == nil {
+		return fmt.Errorf("unknown CNI_COMMAND: %v", verb)
+	}
+	missing := false
+	for _, name := range verbs[verb].required {
+		if os.Getenv(name) == "" {
+			fmt.Fprintf(os.Stderr, "%v env variable missing\n", name)
+			missing = true
+		}
+	}
+	if missing {
+		return fmt.Errorf("required env variables missing")
+	}
+	args := &skel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+	}
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	args.StdinData = stdinData
+
+	confVersion, err := (&version.ConfigDecoder{}).Decode(stdinData)
+	if err != nil {
+		return err
+	}
+	if verErr := (&version.Reconciler{}).Check(confVersion, versionInfo); verErr != nil {
+		return &types.Error{
+			Code:    types.ErrIncompatibleCNIVersion,
+			Msg:     "incompatible CNI versions",
+			Details: verErr.Details(),
+		}
+	}
+	if !atLeast(confVersion, verbs[verb].since) {
+		return &types.Error{
+			Code: types.ErrIncompatibleCNIVersion,
+			Msg:  fmt.Sprintf("config version %q does not allow %s", confVersion, verb),
+		}
+	}
+	return cmd(args)
+}
+
+// atLeast returns true if version v is not older than min.
+func atLeast(v, min string) bool {
+	parts, minParts := strings.Split(v, "."), strings.Split(min, ".")
+	for i := range minParts {
+		if i >= len(parts) {
+			return false
+		}
+		p, _ := strconv.Atoi(parts[i])
+		m, _ := strconv.Atoi(minParts[i])
+		if p != m {
+			return p > m
+		}
+	}
+	return true
+}
+
+// PrintResult prints the result in cniVersion. The result of 0.4.0 is the same as 0.3.1
+// except the version, and the IPs of 1.x have no version any more.
+func PrintResult(result types.Result, cniVersion string) error {
+	if !atLeast(cniVersion, checkVersion) {
+		return types.PrintResult(result, cniVersion)
+	}
+	r, err := current.NewResultFromResult(result)
+	if err != nil {
+		return err
+	}
+	r.CNIVersion = cniVersion
+	if !atLeast(cniVersion, "1.0.0") {
+		return r.Print()
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]interface{})
+	if err = json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	if ips, ok := m["ips"].([]interface{}); ok {
+		for _, ipc := range ips {
+			delete(ipc.(map[string]interface{}), "version")
+		}
+	}
+	data, err = json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// ExecAdd executes the IPAM plugin for ADD, and asks for the result in 0.3.1 which
+// could be parsed by cni.
+func ExecAdd(plugin string, netconf []byte) (types.Result, error) {
+	conf := make(map[string]interface{})
+	if err := json.Unmarshal(netconf, &conf); err != nil {
+		return nil, err
+	}
+	if v, ok := conf["cniVersion"].(string); ok && atLeast(v, checkVersion) {
+		conf["cniVersion"] = current.ImplementedSpecVersion
+		var err error
+		if netconf, err = json.Marshal(conf); err != nil {
+			return nil, err
+		}
+	}
+	return ipam.ExecAdd(plugin, netconf)
+}
+
+// ExecCheck executes the IPAM plugin for CHECK.
+func ExecCheck(plugin string, netconf []byte) error {
+	return exec(plugin, netconf)
+}
+
+// ExecGC executes the IPAM plugin for GC.
+func ExecGC(plugin string, netconf []byte) error {
+	return exec(plugin, netconf)
+}
+
+// ExecStatus executes the IPAM plugin for STATUS.
+func ExecStatus(plugin string, netconf []byte) error {
+	return exec(plugin, netconf)
+}
+
+// ExecCommit executes the IPAM plugin for COMMIT.
+func ExecCommit(plugin string, netconf []byte) error {
+	return execVerb(plugin, netconf, verbArgs{command: commitCommand})
+}
+
+// ExecConflict executes the IPAM plugin for CONFLICT, ip is the one in conflict.
+func ExecConflict(plugin string, netconf []byte, ip net.IP) error {
+	return execVerb(plugin, netconf, verbArgs{command: conflictCommand, args: "CONFLICT_IP=" + ip.String()})
+}
+
+// execVerb executes the plugin for the verb of anchor, which returns no result.
+func execVerb(plugin string, netconf []byte, args verbArgs) error {
+	pluginPath, err := invoke.FindInPath(plugin, filepath.SplitList(os.Getenv("CNI_PATH")))
+	if err != nil {
+		return err
+	}
+	err = invoke.ExecPluginWithoutResult(pluginPath, netconf, args)
+	// Both skel of cni and ours reply so to the commands unknown.
+	if e, ok := err.(*types.Error); ok && strings.HasPrefix(e.Msg, "unknown CNI_COMMAND") {
+		return ErrVerbNotSupported
+	}
+	return err
+}
+
+// verbArgs is the args in env, except the command is the verb of anchor, and the
+// args given are appended to CNI_ARGS.
+type verbArgs struct {
+	command string
+	args    string
+}
+
+// AsEnv returns the env with CNI_COMMAND replaced, since the duplicated keys
+// in env are not reliable.
+func (a verbArgs) AsEnv() []string {
+	env := []string{"CNI_COMMAND=" + a.command}
+	cniArgs := a.args
+	for _, e := range os.Environ() {
+		switch {
+		case strings.HasPrefix(e, "CNI_COMMAND="):
+		case strings.HasPrefix(e, "CNI_ARGS=") && a.args != "":
+			if old := strings.TrimPrefix(e, "CNI_ARGS="); old != "" {
+				cniArgs = old + ";" + a.args
+			}
+		default:
+			env = append(env, e)
+		}
+	}
+	if cniArgs != "" {
+		env = append(env, "CNI_ARGS="+cniArgs)
+	}
+	return env
+}
+
+// exec executes the plugin with the command in env, which returns no result.
+func exec(plugin string, netconf []byte) error {
+	pluginPath, err := invoke.FindInPath(plugin, filepath.SplitList(os.Getenv("CNI_PATH")))
+	if err != nil {
+		return err
+	}
+	return invoke.ExecPluginWithoutResult(pluginPath, netconf, invoke.ArgsFromEnv())
+}
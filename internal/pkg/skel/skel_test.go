@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package skel
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func Test_atLeast(t *testing.T) {
+	cases := []struct {
+		v, min string
+		want   bool
+	}{
+		{"0.3.1", checkVersion, false},
+		{"0.4.0", checkVersion, true},
+		{"1.0.0", checkVersion, true},
+		{"1.0.0", gcVersion, false},
+		{"1.1.0", gcVersion, true},
+		{"0.10.0", checkVersion, true},
+		{"1.1", gcVersion, false},
+	}
+	for _, c := range cases {
+		if got := atLeast(c.v, c.min); got != c.want {
+			t.Fatalf("atLeast(%s, %s) expected %v, got %v", c.v, c.min, c.want, got)
+		}
+	}
+}
+
+func Test_verbArgs(t *testing.T) {
+	os.Setenv("CNI_COMMAND", "ADD")
+	os.Setenv("CNI_ARGS", "IgnoreUnknown=1;K8S_POD_NAME=web-0")
+	defer os.Unsetenv("CNI_COMMAND")
+	defer os.Unsetenv("CNI_ARGS")
+
+	env := strings.Join(verbArgs{command: conflictCommand, args: "CONFLICT_IP=10.0.1.2"}.AsEnv(), "\n")
+	for _, want := range []string{"CNI_COMMAND=CONFLICT", "CNI_ARGS=IgnoreUnknown=1;K8S_POD_NAME=web-0;CONFLICT_IP=10.0.1.2"} {
+		if !strings.Contains(env, want+"\n") && !strings.HasSuffix(env, want) {
+			t.Fatalf("expected %s in env, got %s", want, env)
+		}
+	}
+	if strings.Contains(env, "CNI_COMMAND=ADD") {
+		t.Fatalf("expected CNI_COMMAND replaced, got %s", env)
+	}
+
+	conflictArgs := ConflictArgs{}
+	if err := types.LoadArgs("IgnoreUnknown=1;K8S_POD_NAME=web-0;CONFLICT_IP=10.0.1.2", &conflictArgs); err != nil {
+		t.Fatal(err.Error())
+	}
+	if conflictArgs.CONFLICT_IP != "10.0.1.2" {
+		t.Fatalf("expected CONFLICT_IP loaded, got %q", conflictArgs.CONFLICT_IP)
+	}
+}
+
+func Test_execVerb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skel")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// host-local replies so to the verbs of anchor, and anchor replies nothing.
+	plugins := map[string]string{
+		"host-local": `echo '{"code": 100, "msg": "unknown CNI_COMMAND: '$CNI_COMMAND'"}'; exit 1`,
+		"anchor":     `[ "$CNI_COMMAND" = COMMIT ] || [ "$CNI_COMMAND" = CONFLICT ]`,
+		"broken":     `echo '{"code": 11, "msg": "store is unreachable"}'; exit 1`,
+	}
+	for name, script := range plugins {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	os.Setenv("CNI_PATH", dir)
+	defer os.Unsetenv("CNI_PATH")
+
+	netconf := []byte(`{"cniVersion": "0.3.1", "name": "anchor"}`)
+	if err := ExecCommit("host-local", netconf); err != ErrVerbNotSupported {
+		t.Fatalf("expected COMMIT not supported by host-local, got %v", err)
+	}
+	if err := ExecConflict("host-local", netconf, net.ParseIP("10.0.1.2")); err != ErrVerbNotSupported {
+		t.Fatalf("expected CONFLICT not supported by host-local, got %v", err)
+	}
+	if err := ExecCommit("anchor", netconf); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ExecConflict("anchor", netconf, net.ParseIP("10.0.1.2")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ExecCommit("broken", netconf); err == nil || err == ErrVerbNotSupported {
+		t.Fatalf("expected error of the plugin returned, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+// Package vlan creates the 802.1Q VLAN sub-interfaces of octopus on demand, and deletes
+// them after the last container using them is gone. The containers using a sub-interface
+// are kept under the state dir as <sub-interface>/<network>/<container>-<ifname>, since
+// each plugin call is a new process.
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hainesc/anchor/internal/pkg/config"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	lockFile = "lock"
+	// createdFile marks the sub-interfaces created by octopus, the others are never deleted.
+	createdFile = ".created"
+	// maxNameLen is the max length of the interface names, IFNAMSIZ - 1.
+	maxNameLen = 15
+)
+
+// Manager manages the VLAN sub-interfaces and the containers using them.
+type Manager struct {
+	dir string
+}
+
+// NewManager returns a manager keeping the state under dir.
+func NewManager(dir string) *Manager {
+	return &Manager{dir: dir}
+}
+
+// Acquire returns the name of the interface to attach the container to, the VLAN
+// sub-interface is created if missing. The master is returned as is if it has no VLAN ID.
+func (m *Manager) Acquire(master config.Master, network, containerID, ifName string) (string, error) {
+	name := master.Name()
+	if master.VLAN == 0 {
+		return name, nil
+	}
+	if len(name) > maxNameLen {
+		return "", fmt.Errorf("name of VLAN sub-interface %s is longer than %d", name, maxNameLen)
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	created, err := ensureLink(master, name)
+	if err != nil {
+		return "", err
+	}
+	if err = m.add(name, network, ref(containerID, ifName), created); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Release forgets the container, and deletes the sub-interfaces no longer used.
+func (m *Manager) Release(network, containerID, ifName string) error {
+	r := ref(containerID, ifName)
+	return m.release(func(n, ref string) bool { return n == network && ref == r })
+}
+
+// Prune forgets the containers of the network not in valid, just as Release does.
+func (m *Manager) Prune(network string, valid []config.Attachment) error {
+	keep := make(map[string]bool)
+	for _, a := range valid {
+		keep[ref(a.ContainerID, a.IfName)] = true
+	}
+	return m.release(func(n, ref string) bool { return n == network && !keep[ref] })
+}
+
+func (m *Manager) release(match func(network, ref string) bool) error {
+	if _, err := os.Stat(m.dir); os.IsNotExist(err) {
+		// No sub-interface is ever created.
+		return nil
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	unused, err := m.forget(match)
+	if err != nil {
+		return err
+	}
+	for _, name := range unused {
+		link, err := netlink.LinkByName(name)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+		if err = netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// add records the container using the sub-interface, the caller should hold the lock.
+func (m *Manager) add(name, network, ref string, created bool) error {
+	dir := filepath.Join(m.dir, name, network)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if created {
+		if err := ioutil.WriteFile(filepath.Join(m.dir, name, createdFile), nil, 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ref), nil, 0644)
+}
+
+// forget removes the containers matched, and returns the sub-interfaces created by octopus
+// which are no longer used, the caller should hold the lock.
+func (m *Manager) forget(match func(network, ref string) bool) ([]string, error) {
+	links, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	unused := make([]string, 0)
+	for _, link := range links {
+		if !link.IsDir() {
+			continue
+		}
+		linkDir := filepath.Join(m.dir, link.Name())
+		networks, err := ioutil.ReadDir(linkDir)
+		if err != nil {
+			return nil, err
+		}
+		used, created := false, false
+		for _, network := range networks {
+			if !network.IsDir() {
+				created = created || network.Name() == createdFile
+				continue
+			}
+			netDir := filepath.Join(linkDir, network.Name())
+			refs, err := ioutil.ReadDir(netDir)
+			if err != nil {
+				return nil, err
+			}
+			left := 0
+			for _, r := range refs {
+				if !match(network.Name(), r.Name()) {
+					left++
+					continue
+				}
+				if err = os.Remove(filepath.Join(netDir, r.Name())); err != nil {
+					return nil, err
+				}
+			}
+			if left == 0 {
+				if err = os.Remove(netDir); err != nil {
+					return nil, err
+				}
+			}
+			used = used || left > 0
+		}
+		if used {
+			continue
+		}
+		if err = os.RemoveAll(linkDir); err != nil {
+			return nil, err
+		}
+		if created {
+			unused = append(unused, link.Name())
+		}
+	}
+	return unused, nil
+}
+
+// lock locks the state dir against other plugin calls on the node, and returns the unlock.
+func (m *Manager) lock() (func(), error) {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(m.dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", m.dir, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// ensureLink creates the sub-interface if missing and sets it up, it returns true if
+// the sub-interface is created.
+func ensureLink(master config.Master, name string) (bool, error) {
+	if link, err := netlink.LinkByName(name); err == nil {
+		if v, ok := link.(*netlink.Vlan); ok && v.VlanId != master.VLAN {
+			return false, fmt.Errorf("%s exists with VLAN ID %d instead of %d", name, v.VlanId, master.VLAN)
+		}
+		return false, netlink.LinkSetUp(link)
+	}
+	parent, err := netlink.LinkByName(master.Master)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup master %q: %v", master.Master, err)
+	}
+	link := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parent.Attrs().Index,
+		},
+		VlanId: master.VLAN,
+	}
+	if err = netlink.LinkAdd(link); err != nil {
+		return false, fmt.Errorf("failed to create VLAN sub-interface %s: %v", name, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		_ = netlink.LinkDel(link)
+		return false, fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	return true, nil
+}
+
+// ref returns the file name of the container.
+func ref(containerID, ifName string) string {
+	return containerID + "-" + ifName
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package vlan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_forget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vlan")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	m := NewManager(dir)
+
+	for _, a := range []struct {
+		name, network, ref string
+		created            bool
+	}{
+		{"bond0.102", "anchor", ref("a", "eth0"), true},
+		{"bond0.102", "anchor", ref("b", "eth0"), false},
+		{"bond0.102", "other", ref("a", "net1"), false},
+		{"eth0.2", "anchor", ref("c", "eth0"), false},
+	} {
+		if err = m.add(a.name, a.network, a.ref, a.created); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	only := func(network, r string) func(string, string) bool {
+		return func(n, ref string) bool { return n == network && ref == r }
+	}
+	for _, c := range []struct {
+		match  func(string, string) bool
+		unused []string
+	}{
+		{only("anchor", ref("a", "eth0")), []string{}},
+		{only("anchor", ref("b", "eth0")), []string{}},
+		// The sub-interface existed before is never deleted.
+		{only("anchor", ref("c", "eth0")), []string{}},
+		{only("other", ref("a", "net1")), []string{"bond0.102"}},
+	} {
+		unused, err := m.forget(c.match)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(unused, c.unused) {
+			t.Fatalf("expected %v unused, got %v", c.unused, unused)
+		}
+	}
+	for _, name := range []string{"bond0.102", "eth0.2"} {
+		if _, err = os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected the state of %s removed, got %v", name, err)
+		}
+	}
+}
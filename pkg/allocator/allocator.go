@@ -25,3 +25,13 @@ type Allocator interface {
 type Cleaner interface {
 	Clean(id string) error
 }
+
+// Checker is the interface for checker
+type Checker interface {
+	Check(id string, ips []*current.IPConfig) error
+}
+
+// Collector is the interface for garbage collector
+type Collector interface {
+	Collect(valid []string) error
+}
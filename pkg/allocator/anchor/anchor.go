@@ -8,14 +8,18 @@
 package anchor
 
 import (
+	"context"
 	"fmt"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
-	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/hainesc/anchor/pkg/allocator"
 	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/utils"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Allocator is the allocator for anchor.
@@ -26,6 +30,18 @@ type Allocator struct {
 	customized map[string]string
 	subnet     *net.IPNet
 	gateway    net.IP
+	// ranges limits the allocation to a slice of the namespace's pool,
+	// nil means the whole pool could be used.
+	ranges *utils.RangeSet
+	// ip is the static IP requested by the pod, nil if not requested.
+	ip net.IP
+	// sticky binds the IP to the pod, which survives the deletion of the pod.
+	sticky bool
+	// lockTimeout is the max time waiting for the lock of the subnet.
+	lockTimeout time.Duration
+	// lease is how long the reservation keeps pending before reclaimed,
+	// zero means it is committed at once.
+	lease time.Duration
 }
 
 const (
@@ -33,6 +49,10 @@ const (
 	customizeRoutesKey  = "cni.anchor.org/routes"
 	customizeSubnetKey  = "cni.anchor.org/subnet"
 	customizeRangeKey   = "cni.anchor.org/range"
+	customizeIPKey      = "cni.anchor.org/ip"
+	customizeStickyKey  = "cni.anchor.org/sticky"
+	// customizeLeaseKey is set by anchor rather than users, see store.StatePending.
+	customizeLeaseKey = "cni.anchor.org/lease"
 )
 
 // AnchorAllocator implements the Allocator interface
@@ -41,9 +61,12 @@ var _ allocator.Allocator = &Allocator{}
 // NewAllocator news a allocator
 func NewAllocator(store store.Store,
 	pod, namespace string,
-	customized map[string]string) (*Allocator, error) {
+	customized map[string]string,
+	lockTimeout time.Duration) (*Allocator, error) {
 	var subnet *net.IPNet
 	var gw net.IP
+	var ranges *utils.RangeSet
+	var staticIP net.IP
 	var err error // declaration here for avoid := which also create a new var
 	if customized[customizeSubnetKey] != "" {
 		_, subnet, err = net.ParseCIDR(customized[customizeSubnetKey])
@@ -51,20 +74,69 @@ func NewAllocator(store store.Store,
 			return nil, fmt.Errorf("invalid format of subnet in annotations")
 		}
 	}
+	if customized[customizeIPKey] != "" {
+		staticIP = net.ParseIP(customized[customizeIPKey])
+		if staticIP == nil {
+			return nil, fmt.Errorf("invalid format of ip in annotations")
+		}
+		if subnet == nil {
+			subnet = store.RetrieveSubnet(staticIP)
+			if subnet == nil {
+				return nil, fmt.Errorf("failed to retrieve subnet for ip %s", staticIP.String())
+			}
+		}
+		if !subnet.Contains(staticIP) {
+			return nil, fmt.Errorf("ip %s not in network %s", staticIP.String(), subnet.String())
+		}
+	}
 	if customized[customizeRangeKey] != "" {
-		// TODO: Caculate the subnet
-		return nil, fmt.Errorf("customized range not implentmented")
+		r := customized[customizeRangeKey]
+		first := utils.FirstIP(r)
+		if first == nil {
+			return nil, fmt.Errorf("invalid format of range in annotations")
+		}
+		if subnet == nil {
+			// Caculate the subnet via the gateway map.
+			subnet = store.RetrieveSubnet(first)
+			if subnet == nil {
+				return nil, fmt.Errorf("failed to retrieve subnet for range %s", r)
+			}
+		}
+		// Concat omits the parts not in subnet, but the user should know it.
+		for _, part := range strings.Split(r, ",") {
+			if ip := utils.FirstIP(part); ip == nil || !subnet.Contains(ip) {
+				return nil, fmt.Errorf("range %s not in network %s", strings.TrimSpace(part), subnet.String())
+			}
+		}
+		ranges, err = (&utils.RangeSet{}).Concat(r, subnet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sticky := false
+	if customized[customizeStickyKey] != "" {
+		sticky, err = strconv.ParseBool(customized[customizeStickyKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid format of sticky in annotations")
+		}
+	}
+	if subnet == nil {
+		return nil, fmt.Errorf("none of subnet, range and ip found in annotations")
+	}
+	var lease time.Duration
+	if customized[customizeLeaseKey] != "" {
+		lease, err = time.ParseDuration(customized[customizeLeaseKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid format of lease %s", customized[customizeLeaseKey])
+		}
 	}
 
 	if customized[customizeGatewayKey] != "" {
-		gw = net.ParseIP(customized[customizeSubnetKey])
+		gw = net.ParseIP(customized[customizeGatewayKey])
 		if gw == nil {
 			return nil, fmt.Errorf("invalid format of gateway in annotations")
 		}
 	} else {
-		// Maybe no lock here is better.
-		store.Lock()
-		defer store.Unlock()
 		gw = store.RetrieveGateway(subnet)
 		if gw == nil {
 			return nil, fmt.Errorf("failed to retrieve gateway for %s", subnet.String())
@@ -75,15 +147,143 @@ func NewAllocator(store store.Store,
 		return nil, fmt.Errorf("gateway %s not in network %s", gw.String(), subnet.String())
 	}
 	return &Allocator{
-		store:      store,
-		pod:        pod,
-		namespace:  namespace,
-		customized: customized,
-		subnet:     subnet,
-		gateway:    gw,
+		store:       store,
+		pod:         pod,
+		namespace:   namespace,
+		customized:  customized,
+		subnet:      subnet,
+		gateway:     gw,
+		ranges:      ranges,
+		ip:          staticIP,
+		sticky:      sticky,
+		lockTimeout: lockTimeout,
+		lease:       lease,
 	}, nil
 }
 
+// NewAllocators news allocators for the pod, one for each address family found
+// in the annotations, so a dual-stack pod gets an IPv4 and an IPv6 allocator.
+// eg: cni.anchor.org/subnet: 10.0.1.0/24,2001:db8:1::/64
+func NewAllocators(store store.Store,
+	pod, namespace string,
+	customized map[string]string,
+	lockTimeout time.Duration) ([]*Allocator, error) {
+	v4, v6 := splitFamily(customized)
+	if v4 == nil || v6 == nil {
+		// Single stack, nothing to split.
+		alloc, err := NewAllocator(store, pod, namespace, customized, lockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return []*Allocator{alloc}, nil
+	}
+
+	alloc4, err := NewAllocator(store, pod, namespace, v4, lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	alloc6, err := NewAllocator(store, pod, namespace, v6, lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return []*Allocator{alloc4, alloc6}, nil
+}
+
+// AllocateAll allocates an IP by each allocator for the container, along with the routes.
+// The IPs allocated are released if any of them fails, without quarantine since the pod
+// never uses them.
+func AllocateAll(allocs []*Allocator, id string, serviceIPNet string, nodeIPs []string) (*current.Result, error) {
+	result := &current.Result{}
+	for i, alloc := range allocs {
+		// Handle customized network configurations.
+		ret, err := alloc.CustomizeGateway(result)
+		if err == nil {
+			ret, err = alloc.CustomizeRoutes(ret)
+		}
+		if err == nil {
+			ret, err = alloc.CustomizeDNS(ret)
+		}
+		if err == nil {
+			// Add an item of route:
+			//   service-cluster-ip-range -> Node IP
+			ret, err = alloc.AddServiceRoute(ret, serviceIPNet, nodeIPs)
+		}
+		var ipConf *current.IPConfig
+		if err == nil {
+			ipConf, err = alloc.Allocate(id)
+		}
+		if err != nil {
+			if i > 0 {
+				cleaner, _ := NewCleaner(alloc.store, alloc.pod, alloc.namespace, alloc.lockTimeout, 0)
+				cleaner.Clean(id)
+			}
+			return nil, err
+		}
+		result = ret
+		result.IPs = append(result.IPs, ipConf)
+	}
+	return result, nil
+}
+
+// splitFamily splits the customized network config by address family,
+// nil is returned for the family which has none of subnet, range and ip.
+func splitFamily(customized map[string]string) (map[string]string, map[string]string) {
+	isV4 := func(s string) bool {
+		s = strings.TrimSpace(s)
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			return n.IP.To4() != nil
+		}
+		if ip := utils.FirstIP(s); ip != nil {
+			return ip.To4() != nil
+		}
+		// Invalid format, leave it to NewAllocator.
+		return true
+	}
+
+	v4 := make(map[string]string)
+	v6 := make(map[string]string)
+	for k, v := range customized {
+		v4[k], v6[k] = v, v
+	}
+	for _, key := range []string{customizeSubnetKey, customizeGatewayKey, customizeRangeKey, customizeIPKey} {
+		if customized[key] == "" {
+			continue
+		}
+		parts4, parts6 := []string{}, []string{}
+		for _, part := range strings.Split(customized[key], ",") {
+			if isV4(part) {
+				parts4 = append(parts4, part)
+			} else {
+				parts6 = append(parts6, part)
+			}
+		}
+		v4[key], v6[key] = strings.Join(parts4, ","), strings.Join(parts6, ",")
+	}
+	// Routes are separated by semicolon, and the family is decided by the destination.
+	if customized[customizeRoutesKey] != "" {
+		routes4, routes6 := []string{}, []string{}
+		for _, r := range strings.Split(customized[customizeRoutesKey], ";") {
+			if isV4(strings.Split(r, ",")[0]) {
+				routes4 = append(routes4, r)
+			} else {
+				routes6 = append(routes6, r)
+			}
+		}
+		v4[customizeRoutesKey], v6[customizeRoutesKey] = strings.Join(routes4, ";"), strings.Join(routes6, ";")
+	}
+
+	located := func(m map[string]string) bool {
+		return m[customizeSubnetKey] != "" || m[customizeRangeKey] != "" || m[customizeIPKey] != ""
+	}
+	if !located(v4) {
+		v4 = nil
+	}
+	if !located(v6) {
+		v6 = nil
+	}
+	return v4, v6
+}
+
 // CustomizeGateway adds default route for pod if customizeGatewayKey is set.
 func (a *Allocator) CustomizeGateway(ret *current.Result) (*current.Result, error) {
 	// We do nothing here because we has set gateway in func NewAllocator.
@@ -108,12 +308,19 @@ func (a *Allocator) CustomizeGateway(ret *current.Result) (*current.Result, erro
 // The outer delimiter is semicolon(;) and the inner delimiter is comma(,)
 func (a *Allocator) CustomizeRoutes(ret *current.Result) (*current.Result, error) {
 	// Config route for default first
+	dst := net.IPNet{
+		IP:   net.IPv4zero,
+		Mask: net.IPv4Mask(0, 0, 0, 0),
+	}
+	if a.gateway.To4() == nil {
+		dst = net.IPNet{
+			IP:   net.IPv6zero,
+			Mask: net.CIDRMask(0, 8*net.IPv6len),
+		}
+	}
 	ret.Routes = append(ret.Routes, &types.Route{
-		Dst: net.IPNet{
-			IP:   net.IPv4zero,
-			Mask: net.IPv4Mask(0, 0, 0, 0),
-		},
-		GW: a.gateway,
+		Dst: dst,
+		GW:  a.gateway,
 	})
 
 	if customizeRoute := a.customized[customizeRoutesKey]; customizeRoute != "" {
@@ -160,6 +367,11 @@ func (a *Allocator) AddServiceRoute(ret *current.Result,
 		return nil, fmt.Errorf("invalid format of service cluster ip range %s", serviceClusterIPRange)
 	}
 
+	// The route is meaningless if the service and the pod are in different families.
+	if (dst.IP.To4() == nil) != (a.subnet.IP.To4() == nil) {
+		return ret, nil
+	}
+
 	for _, nodeIP := range nodeIPs {
 		if a.subnet.Contains(net.ParseIP(nodeIP)) {
 			ret.Routes = append(ret.Routes, &types.Route{
@@ -175,97 +387,378 @@ func (a *Allocator) AddServiceRoute(ret *current.Result,
 
 // Allocate allocates IP for the pod.
 func (a *Allocator) Allocate(id string) (*current.IPConfig, error) {
-	a.store.Lock()
-	defer a.store.Unlock()
-	ips, err := a.store.RetrieveAllocated(a.namespace, a.subnet)
+	ctx, cancel := context.WithTimeout(context.Background(), a.lockTimeout)
+	defer cancel()
+	if err := a.store.Lock(ctx, a.subnet); err != nil {
+		return nil, fmt.Errorf("failed to lock subnet %s: %v", a.subnet.String(), err)
+	}
+	defer a.store.Unlock(a.subnet)
+	// The IPs of the ADDs which failed halfway are free again.
+	if err := a.store.Reclaim(a.subnet); err != nil {
+		return nil, err
+	}
+	if err := a.checkQuota(id); err != nil {
+		return nil, err
+	}
+	ips, err := a.pool()
 	if err != nil {
 		return nil, err
 	}
-	for _, ipRange := range *ips {
-		ipRange.Gateway = a.gateway
-		if err = ipRange.Canonicalize(); err != nil {
-			return nil, err
+	if a.ranges != nil {
+		// Only the part of the pool within the customized range is usable.
+		ips = ips.Intersect(a.ranges)
+		if len(*ips) == 0 {
+			return nil, fmt.Errorf("range %s has no IP allocated for namespace %s",
+				a.ranges.String(), a.namespace)
 		}
 	}
-	used, err := a.store.RetrieveUsed(a.namespace, a.subnet)
+	bindings, err := a.store.RetrieveBindings(a.namespace)
 	if err != nil {
 		return nil, err
 	}
+	if a.ip != nil {
+		return a.allocateStatic(id, ips, bindings)
+	}
+	if bound := a.boundIP(bindings[a.pod]); a.sticky && bound != nil {
+		if ips.Contains(bound) {
+			return a.reserveExact(id, bound)
+		}
+		// The IP bound is no longer usable by the pod, forget it and allocate a new one.
+		if err = a.store.Unbind(a.namespace, a.pod, bound); err != nil {
+			return nil, err
+		}
+	}
 
-	for _, usedRange := range *used {
-		usedRange.Gateway = a.gateway
-		if err = usedRange.Canonicalize(); err != nil {
+	return a.allocateDynamic(id, ips)
+}
+
+// pool returns the IPs in the subnet usable by the pod. The pods selected by the labeled
+// allocate maps of the namespace use the IPs of them only, and the other pods use the
+// ones allocated to the namespace except the IPs dedicated to the labeled ones.
+func (a *Allocator) pool() (*utils.RangeSet, error) {
+	labeled, err := a.store.RetrieveLabeledPools(a.namespace)
+	if err != nil {
+		return nil, err
+	}
+	selected, dedicated := &utils.RangeSet{}, &utils.RangeSet{}
+	matched := false
+	for _, am := range labeled {
+		if dedicated, err = dedicated.Concat(am.Allocate, a.subnet); err != nil {
 			return nil, err
 		}
+		if am.Selects(a.customized) {
+			matched = true
+			if selected, err = selected.Concat(am.Allocate, a.subnet); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if matched {
+		if len(*selected) == 0 {
+			return nil, fmt.Errorf("no IP in %s allocated for pod %s by label in namespace %s",
+				a.subnet.String(), a.pod, a.namespace)
+		}
+		return selected, nil
+	}
+	ips, err := a.store.RetrieveAllocated(a.namespace, a.subnet)
+	if err != nil {
+		return nil, err
 	}
-	for _, r := range *ips {
-		var iter net.IP
-		for iter = r.RangeStart; !iter.Equal(ip.NextIP(r.RangeEnd)); iter = ip.NextIP(iter) {
+	return ips.Subtract(dedicated), nil
+}
 
-			avail := true
-			for _, usedRange := range *used {
-				var u net.IP
-				for u = usedRange.RangeStart; !u.Equal(ip.NextIP(usedRange.RangeEnd)); u = ip.NextIP(u) {
-					if iter.Equal(u) {
-						avail = false
-						break
-					}
-				}
+// allocateStatic reserves the IP requested by the pod, the caller should hold the lock.
+func (a *Allocator) allocateStatic(id string, ips *utils.RangeSet, bindings map[string][]net.IP) (*current.IPConfig, error) {
+	if a.ip.Equal(a.gateway) {
+		return nil, fmt.Errorf("requested IP %s is the gateway of %s", a.ip.String(), a.subnet.String())
+	}
+	if !ips.Contains(a.ip) {
+		return nil, fmt.Errorf("requested IP %s not allocated for namespace %s", a.ip.String(), a.namespace)
+	}
+	for pod, bound := range bindings {
+		for _, b := range bound {
+			if pod != a.pod && b.Equal(a.ip) {
+				return nil, fmt.Errorf("requested IP %s is bound to pod %s", a.ip.String(), pod)
 			}
-			if avail {
-				// Get subnet and gateway information
-				if err != nil {
-					// TODO: check
-					continue
-				}
-				if iter.Equal(a.gateway) {
-					// TODO: check
-					continue
-				}
-				// TODO:
-
-				controllerName := a.customized["cni.anchor.org/controller"]
-				if controllerName == "" {
-					controllerName = "unknown"
-				}
-				_, err = a.store.Reserve(id, iter, a.pod, a.namespace, controllerName)
-				if err != nil {
-					continue
-				}
-
-				return &current.IPConfig{
-					Version: "4",
-					Address: net.IPNet{IP: iter, Mask: a.subnet.Mask},
-					Gateway: a.gateway,
-				}, nil
+		}
+	}
+
+	ipConf, err := a.reserveExact(id, a.ip)
+	if err != nil {
+		return nil, err
+	}
+	if a.sticky {
+		// The pod is bound to the requested IP from now on.
+		if bound := a.boundIP(bindings[a.pod]); bound != nil && !bound.Equal(a.ip) {
+			if err = a.store.Unbind(a.namespace, a.pod, bound); err != nil {
+				return nil, err
 			}
 		}
+		if err = a.store.Bind(a.namespace, a.pod, a.ip); err != nil {
+			return nil, err
+		}
+	}
+	return ipConf, nil
+}
+
+// boundIP returns the IP in the subnet of the allocator from bound, nil if not found.
+func (a *Allocator) boundIP(bound []net.IP) net.IP {
+	for _, b := range bound {
+		if a.subnet.Contains(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// reserveExact reserves the given IP if it is not held by others, quarantined or in conflict,
+// the caller should hold the lock.
+func (a *Allocator) reserveExact(id string, candidate net.IP) (*current.IPConfig, error) {
+	holder, err := a.store.RetrieveHolder(a.subnet, candidate)
+	if err != nil {
+		return nil, err
+	}
+	// The same container may be added again, it is fine to hand out the IP once more.
+	if holder != "" && holder != id {
+		return nil, fmt.Errorf("IP %s is already held by container %s", candidate.String(), holder)
+	}
+	tombstone, err := a.store.RetrieveTombstone(a.subnet, candidate)
+	if err != nil {
+		return nil, err
+	}
+	if tombstone != nil && tombstone.Conflicted() {
+		return nil, fmt.Errorf("IP %s is in conflict with a host outside of anchor", candidate.String())
+	}
+	if tombstone != nil && tombstone.Quarantined() && !tombstone.Expired(time.Now()) {
+		return nil, fmt.Errorf("IP %s is quarantined until %s", candidate.String(),
+			tombstone.Expires.Format(time.RFC3339))
+	}
+
+	ok, err := a.store.Reserve(id, a.record(candidate))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("failed to reserve IP %s for pod %s", candidate.String(), a.pod)
+	}
+	return a.ipConfig(candidate), nil
+}
+
+// controller returns the name of the controller of the pod.
+func (a *Allocator) controller() string {
+	if controllerName := a.customized["cni.anchor.org/controller"]; controllerName != "" {
+		return controllerName
+	}
+	return "unknown"
+}
+
+// record returns the record of the reservation of ip.
+func (a *Allocator) record(ip net.IP) *store.Record {
+	r := &store.Record{
+		IP:         ip,
+		Subnet:     a.subnet.String(),
+		Pod:        a.pod,
+		Namespace:  a.namespace,
+		Controller: a.controller(),
+		Node:       a.customized["cni.anchor.org/node"],
+		IfName:     a.customized["cni.anchor.org/ifname"],
+		Network:    a.customized["cni.anchor.org/network"],
+		State:      store.StateCommitted,
+	}
+	if a.lease > 0 {
+		r.State = store.StatePending
+		r.Expires = time.Now().Add(a.lease)
+	}
+	return r
+}
+
+// ipConfig returns the IPConfig of the reserved IP.
+func (a *Allocator) ipConfig(reserved net.IP) *current.IPConfig {
+	version := "4"
+	if reserved.To4() == nil {
+		version = "6"
+	}
+	return &current.IPConfig{
+		Version: version,
+		Address: net.IPNet{IP: reserved, Mask: a.subnet.Mask},
+		Gateway: a.gateway,
 	}
-	return nil, fmt.Errorf("can not allcate IP for pod named, %s", a.pod)
 }
 
 // Cleaner is the cleaner for anchor.
 type Cleaner struct {
-	store     store.Store
-	pod       string
-	namespace string
+	store       store.Store
+	pod         string
+	namespace   string
+	lockTimeout time.Duration
+	// cooldown is how long the IPs released are quarantined, zero means not quarantined.
+	cooldown time.Duration
 }
 
 // AnchorCleaner implements the Cleaner interface
 var _ allocator.Cleaner = &Cleaner{}
 
 // NewCleaner news a cleaner for anchor.
-func NewCleaner(store store.Store, pod, namespace string) (*Cleaner, error) {
+func NewCleaner(store store.Store, pod, namespace string, lockTimeout, cooldown time.Duration) (*Cleaner, error) {
 	return &Cleaner{
-		store:     store,
-		pod:       pod,
-		namespace: namespace,
+		store:       store,
+		pod:         pod,
+		namespace:   namespace,
+		lockTimeout: lockTimeout,
+		cooldown:    cooldown,
 	}, nil
 }
 
 // Clean cleans the IP for the pod.
 func (a *Cleaner) Clean(id string) error {
-	a.store.Lock()
-	defer a.store.Unlock()
+	subnets, err := a.store.RetrieveSubnets(id)
+	if err != nil {
+		return err
+	}
+	// A dual-stack pod holds IPs in two subnets, lock them in order to avoid dead lock.
+	sort.Slice(subnets, func(i, j int) bool {
+		return subnets[i].String() < subnets[j].String()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.lockTimeout)
+	defer cancel()
+	for _, subnet := range subnets {
+		if err := a.store.Lock(ctx, subnet); err != nil {
+			return fmt.Errorf("failed to lock subnet %s: %v", subnet.String(), err)
+		}
+		defer a.store.Unlock(subnet)
+	}
+	if a.cooldown > 0 {
+		return a.store.Quarantine(id, time.Now().Add(a.cooldown))
+	}
 	return a.store.Release(id)
 }
+
+// Checker checks whether the IPs are still held by the container.
+type Checker struct {
+	store store.Store
+}
+
+// AnchorChecker implements the Checker interface
+var _ allocator.Checker = &Checker{}
+
+// NewChecker news a checker for anchor.
+func NewChecker(store store.Store) *Checker {
+	return &Checker{
+		store: store,
+	}
+}
+
+// Check returns error if any of the IPs is not held by the container.
+func (c *Checker) Check(id string, ips []*current.IPConfig) error {
+	if len(ips) == 0 {
+		return fmt.Errorf("no IP found in prevResult")
+	}
+	for _, ipc := range ips {
+		subnet := &net.IPNet{
+			IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
+			Mask: ipc.Address.Mask,
+		}
+		holder, err := c.store.RetrieveHolder(subnet, ipc.Address.IP)
+		if err != nil {
+			return err
+		}
+		if holder != id {
+			return fmt.Errorf("IP %s is held by %q instead of container %s",
+				ipc.Address.IP.String(), holder, id)
+		}
+	}
+	return nil
+}
+
+// Collector releases the IPs leaked on a node in a network.
+type Collector struct {
+	store       store.Store
+	node        string
+	network     string
+	lockTimeout time.Duration
+	cooldown    time.Duration
+}
+
+// AnchorCollector implements the Collector interface
+var _ allocator.Collector = &Collector{}
+
+// NewCollector news a collector for the node in the network, the IPs released are
+// quarantined for cooldown.
+func NewCollector(store store.Store, node, network string, lockTimeout, cooldown time.Duration) *Collector {
+	return &Collector{
+		store:       store,
+		node:        node,
+		network:     network,
+		lockTimeout: lockTimeout,
+		cooldown:    cooldown,
+	}
+}
+
+// Collect releases the IPs reserved on the node in the network by the containers not in
+// valid, which are the attachments of this network only. Reservations without node or
+// network, which are written by the early versions, are left untouched since it is unknown
+// whether they belong to this node and network. So are the containers holding IPs of other
+// networks too, since their IPs are released all together.
+func (c *Collector) Collect(valid []string) error {
+	reservations, err := c.store.RetrieveReservations()
+	if err != nil {
+		return err
+	}
+	alive := make(map[string]bool)
+	for _, id := range valid {
+		alive[id] = true
+	}
+	cleaner := &Cleaner{
+		store:       c.store,
+		lockTimeout: c.lockTimeout,
+		cooldown:    c.cooldown,
+	}
+	for id, records := range reservations {
+		if alive[id] || !c.owns(records) {
+			continue
+		}
+		if err = cleaner.Clean(id); err != nil {
+			return fmt.Errorf("failed to release IPs of container %s: %v", id, err)
+		}
+	}
+	return c.reclaim(reservations)
+}
+
+// reclaim reclaims the subnets holding expired pending reservations, which are otherwise
+// reclaimed only when IPs are allocated in the subnets again.
+func (c *Collector) reclaim(reservations map[string][]*store.Record) error {
+	now := time.Now()
+	subnets := make(map[string]*net.IPNet)
+	for _, records := range reservations {
+		for _, r := range records {
+			if subnet := r.SubnetNet(); subnet != nil && r.Pending() && r.Expired(now) {
+				subnets[subnet.String()] = subnet
+			}
+		}
+	}
+	for _, subnet := range subnets {
+		ctx, cancel := context.WithTimeout(context.Background(), c.lockTimeout)
+		err := c.store.Lock(ctx, subnet)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to lock subnet %s: %v", subnet.String(), err)
+		}
+		err = c.store.Reclaim(subnet)
+		c.store.Unlock(subnet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// owns returns true if the reservations are all made on the node in the network.
+func (c *Collector) owns(records []*store.Record) bool {
+	for _, r := range records {
+		if r.Node == "" || r.Node != c.node || r.Network == "" || r.Network != c.network {
+			return false
+		}
+	}
+	return len(records) != 0
+}
@@ -0,0 +1,559 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package anchor
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/store/memory"
+)
+
+// newStore returns a store with an IPv4 and an IPv6 subnet, and a few IPs of both
+// allocated to the default namespace.
+func newStore(t testing.TB) *memory.Memory {
+	s := memory.NewMemory()
+	for _, gm := range []store.GatewayMap{
+		{Subnet: "10.0.1.0/24", Gateway: "10.0.1.1"},
+		{Subnet: "2001:db8::/64", Gateway: "2001:db8::1"},
+	} {
+		if err := s.InsertGatewayMap(gm); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := s.InsertAllocateMap(store.AllocateMap{
+		Namespace: "default",
+		Allocate:  "10.0.1.[1-5],2001:db8::[1-3]",
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	return s
+}
+
+// allocate allocates an IP for the container of pod, and fails the test on error.
+func allocate(t *testing.T, s store.Store, id, pod string, customized map[string]string) net.IP {
+	ip, err := tryAllocate(s, id, pod, customized)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return ip
+}
+
+func tryAllocate(s store.Store, id, pod string, customized map[string]string) (net.IP, error) {
+	alloc, err := NewAllocator(s, pod, "default", customized, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ipConf, err := alloc.Allocate(id)
+	if err != nil {
+		return nil, err
+	}
+	return ipConf.Address.IP, nil
+}
+
+func expectIP(t *testing.T, expected string, ip net.IP) {
+	t.Helper()
+	if !ip.Equal(net.ParseIP(expected)) {
+		t.Fatalf("expected %s, got %s", expected, ip.String())
+	}
+}
+
+func clean(t *testing.T, s store.Store, id string) {
+	t.Helper()
+	cleaner, err := NewCleaner(s, "", "default", time.Second, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = cleaner.Clean(id); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_Allocate(t *testing.T) {
+	s := newStore(t)
+	subnet := map[string]string{customizeSubnetKey: "10.0.1.0/24"}
+	// The gateway is in the pool but never handed out.
+	for i, expected := range []string{"10.0.1.2", "10.0.1.3", "10.0.1.4", "10.0.1.5"} {
+		expectIP(t, expected, allocate(t, s, string(rune('a'+i)), "pod", subnet))
+	}
+	if _, err := tryAllocate(s, "e", "pod", subnet); err == nil {
+		t.Fatal("expected error when the pool is used up")
+	}
+
+	// The same container is added again.
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "pod", map[string]string{
+		customizeIPKey: "10.0.1.2",
+	}))
+}
+
+func Test_AllocateRange(t *testing.T) {
+	s := newStore(t)
+	expectIP(t, "10.0.1.4", allocate(t, s, "a", "pod", map[string]string{
+		customizeRangeKey: "10.0.1.[4-5]",
+	}))
+	expectIP(t, "10.0.1.5", allocate(t, s, "b", "pod", map[string]string{
+		customizeRangeKey: "10.0.1.[4-5]",
+	}))
+	if _, err := tryAllocate(s, "c", "pod", map[string]string{
+		customizeRangeKey: "10.0.1.[4-5]",
+	}); err == nil {
+		t.Fatal("expected error when the range is used up")
+	}
+	if _, err := tryAllocate(s, "c", "pod", map[string]string{
+		customizeRangeKey: "10.0.1.[100-110]",
+	}); err == nil {
+		t.Fatal("expected error when the range is not allocated to the namespace")
+	}
+}
+
+func Test_AllocateLabeled(t *testing.T) {
+	s := newStore(t)
+	if err := s.InsertAllocateMap(store.AllocateMap{
+		Namespace: "default",
+		Label:     "app=payments",
+		Allocate:  "10.0.1.[4-5]",
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	payments := map[string]string{customizeSubnetKey: "10.0.1.0/24", "app": "payments"}
+	expectIP(t, "10.0.1.4", allocate(t, s, "a", "payments", payments))
+	expectIP(t, "10.0.1.5", allocate(t, s, "b", "payments", payments))
+	if _, err := tryAllocate(s, "c", "payments", payments); err == nil {
+		t.Fatal("expected error when the labeled pool is used up")
+	}
+	if _, err := tryAllocate(s, "c", "payments", map[string]string{"app": "payments", customizeSubnetKey: "2001:db8::/64"}); err == nil {
+		t.Fatal("expected error when the labeled pool has no IP in the subnet")
+	}
+
+	// The other pods never use the IPs dedicated to the labeled ones.
+	other := map[string]string{customizeSubnetKey: "10.0.1.0/24", "app": "web"}
+	expectIP(t, "10.0.1.2", allocate(t, s, "c", "web", other))
+	expectIP(t, "10.0.1.3", allocate(t, s, "d", "web", other))
+	clean(t, s, "a")
+	if _, err := tryAllocate(s, "e", "web", other); err == nil {
+		t.Fatal("expected error when the pool except the dedicated IPs is used up")
+	}
+	if _, err := tryAllocate(s, "e", "web", map[string]string{customizeIPKey: "10.0.1.4"}); err == nil {
+		t.Fatal("expected error when the IP requested is dedicated to the labeled pods")
+	}
+}
+
+func Test_AllocateStatic(t *testing.T) {
+	s := newStore(t)
+	expectIP(t, "10.0.1.3", allocate(t, s, "a", "pod", map[string]string{
+		customizeIPKey: "10.0.1.3",
+	}))
+	if _, err := tryAllocate(s, "b", "pod", map[string]string{
+		customizeIPKey: "10.0.1.3",
+	}); err == nil {
+		t.Fatal("expected error when the IP is held by another container")
+	}
+	if _, err := tryAllocate(s, "b", "pod", map[string]string{
+		customizeIPKey: "10.0.1.9",
+	}); err == nil {
+		t.Fatal("expected error when the IP is not allocated to the namespace")
+	}
+	// Dynamic allocation skips the IP held.
+	expectIP(t, "10.0.1.2", allocate(t, s, "b", "pod", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24",
+	}))
+	expectIP(t, "10.0.1.4", allocate(t, s, "c", "pod", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24",
+	}))
+}
+
+func Test_AllocateStaticConflict(t *testing.T) {
+	s := newStore(t)
+	ip := allocate(t, s, "a", "pod", map[string]string{customizeIPKey: "10.0.1.3"})
+	if err := s.Conflict("a", ip); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := tryAllocate(s, "b", "pod", map[string]string{
+		customizeIPKey: "10.0.1.3",
+	}); err == nil {
+		t.Fatal("expected error when the IP requested is in conflict")
+	}
+	if conflict, _ := s.AllConflict(); len(*conflict) != 1 {
+		t.Fatalf("expected the IP kept in conflict, got %v", *conflict)
+	}
+}
+
+func Test_AllocateSticky(t *testing.T) {
+	s := newStore(t)
+	sticky := map[string]string{
+		customizeSubnetKey: "10.0.1.0/24",
+		customizeStickyKey: "true",
+	}
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "web-0", sticky))
+	clean(t, s, "a")
+
+	// The IP is kept for web-0 after its container is gone.
+	expectIP(t, "10.0.1.3", allocate(t, s, "b", "web-1", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24",
+	}))
+	expectIP(t, "10.0.1.2", allocate(t, s, "c", "web-0", sticky))
+	if _, err := tryAllocate(s, "d", "web-1", map[string]string{
+		customizeIPKey: "10.0.1.2",
+	}); err == nil {
+		t.Fatal("expected error when the IP is bound to another pod")
+	}
+
+	// The IP is free again once the binding is deleted.
+	clean(t, s, "c")
+	if err := s.DeleteBindingMap([]store.BindingMap{
+		{IP: "10.0.1.2", Pod: "web-0", Namespace: "default"},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectIP(t, "10.0.1.2", allocate(t, s, "d", "web-2", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24",
+	}))
+}
+
+func Test_AllocateDualStack(t *testing.T) {
+	s := newStore(t)
+	allocs, err := NewAllocators(s, "pod", "default", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24,2001:db8::/64",
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(allocs) != 2 {
+		t.Fatalf("expected 2 allocators, got %d", len(allocs))
+	}
+	for i, expected := range []string{"10.0.1.2", "2001:db8::2"} {
+		ipConf, err := allocs[i].Allocate("a")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expectIP(t, expected, ipConf.Address.IP)
+	}
+
+	subnets, _ := s.RetrieveSubnets("a")
+	if len(subnets) != 2 {
+		t.Fatalf("expected IPs in 2 subnets, got %d", len(subnets))
+	}
+	clean(t, s, "a")
+	if subnets, _ = s.RetrieveSubnets("a"); len(subnets) != 0 {
+		t.Fatalf("expected all IPs released, got %d", len(subnets))
+	}
+}
+
+func Test_AllocateAllFailure(t *testing.T) {
+	s := newStore(t)
+	// The IPv4 IP is allocated first, then the IPv6 route fails.
+	allocs, err := NewAllocators(s, "pod", "default", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24,2001:db8::/64",
+		customizeRoutesKey: "10.0.5.0/24,10.0.1.1;2001:db8:5::/64,2001:db9::1",
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = AllocateAll(allocs, "a", "", nil); err == nil {
+		t.Fatal("expected error for the invalid IPv6 route")
+	}
+	if subnets, _ := s.RetrieveSubnets("a"); len(subnets) != 0 {
+		t.Fatalf("expected the IPv4 IP released, got IPs in %d subnets", len(subnets))
+	}
+	// Released rather than quarantined, so it is handed out again.
+	expectIP(t, "10.0.1.2", allocate(t, s, "b", "pod", map[string]string{customizeSubnetKey: "10.0.1.0/24"}))
+
+	allocs, err = NewAllocators(s, "pod", "default", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24,2001:db8::/64",
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	result, err := AllocateAll(allocs, "c", "", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.IPs) != 2 || len(result.Routes) != 2 {
+		t.Fatalf("expected 2 IPs and 2 default routes, got %v", result)
+	}
+}
+
+func Test_AllocateLockTimeout(t *testing.T) {
+	s := newStore(t)
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	if err := s.Lock(context.Background(), subnet); err != nil {
+		t.Fatal(err.Error())
+	}
+	alloc, err := NewAllocator(s, "pod", "default", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24",
+	}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = alloc.Allocate("a"); err == nil {
+		t.Fatal("expected error when the subnet is locked by others")
+	}
+
+	// Subnets are locked independently.
+	expectIP(t, "2001:db8::2", allocate(t, s, "a", "pod", map[string]string{
+		customizeSubnetKey: "2001:db8::/64",
+	}))
+	s.Unlock(subnet)
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "pod", map[string]string{
+		customizeSubnetKey: "10.0.1.0/24",
+	}))
+}
+
+func Test_Clean(t *testing.T) {
+	s := newStore(t)
+	subnet := map[string]string{customizeSubnetKey: "10.0.1.0/24"}
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "pod", subnet))
+	expectIP(t, "10.0.1.3", allocate(t, s, "b", "pod", subnet))
+	clean(t, s, "a")
+	// Deleted twice.
+	clean(t, s, "a")
+	clean(t, s, "unknown")
+	expectIP(t, "10.0.1.2", allocate(t, s, "c", "pod", subnet))
+}
+
+func Test_CleanCooldown(t *testing.T) {
+	s := newStore(t)
+	subnet := map[string]string{customizeSubnetKey: "10.0.1.0/24"}
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "pod", subnet))
+	cleaner, err := NewCleaner(s, "", "default", time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = cleaner.Clean("a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	// The IP quarantined is skipped, and could not be requested explicitly either.
+	expectIP(t, "10.0.1.3", allocate(t, s, "b", "pod", subnet))
+	if _, err = tryAllocate(s, "c", "pod", map[string]string{customizeIPKey: "10.0.1.2"}); err == nil {
+		t.Fatal("expected error when the IP requested is quarantined")
+	}
+
+	// It is handed out again once the quarantine is over.
+	s = newStore(t)
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "pod", subnet))
+	if err = s.Quarantine("a", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectIP(t, "10.0.1.2", allocate(t, s, "c", "pod", map[string]string{customizeIPKey: "10.0.1.2"}))
+}
+
+func Test_AllocateStrategy(t *testing.T) {
+	subnet := map[string]string{customizeSubnetKey: "10.0.1.0/24"}
+	for _, tc := range []struct {
+		strategy string
+		expected string
+	}{
+		{store.StrategyLowestFirst, "10.0.1.2"},
+		{store.StrategyRoundRobin, "10.0.1.5"},
+		// 10.0.1.5 is never released.
+		{store.StrategyLeastRecentlyReleased, "10.0.1.5"},
+	} {
+		s := newStore(t)
+		if err := s.InsertStrategyMap(store.StrategyMap{Namespace: "default", Strategy: tc.strategy}); err != nil {
+			t.Fatal(err.Error())
+		}
+		expectIP(t, "10.0.1.2", allocate(t, s, "a", "pod", subnet))
+		expectIP(t, "10.0.1.3", allocate(t, s, "b", "pod", subnet))
+		expectIP(t, "10.0.1.4", allocate(t, s, "c", "pod", subnet))
+		clean(t, s, "c")
+		clean(t, s, "a")
+		expectIP(t, tc.expected, allocate(t, s, "d", "pod", subnet))
+	}
+}
+
+func Test_AllocateQuota(t *testing.T) {
+	s := newStore(t)
+	for _, qm := range []store.QuotaMap{
+		{Namespace: "default", Max: 3},
+		{Namespace: "default", Controller: "web", Max: 1},
+		{Namespace: "default", Subnet: "2001:db8::/64", Max: 1},
+	} {
+		if err := s.InsertQuotaMap(qm); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	web := map[string]string{customizeSubnetKey: "10.0.1.0/24", "cni.anchor.org/controller": "web"}
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "web-a", web))
+	_, err := tryAllocate(s, "b", "web-b", web)
+	if e, ok := err.(*QuotaExceededError); !ok || e.Quota.Controller != "web" || e.Used != 1 {
+		t.Fatalf("expected the quota of web exceeded, got %v", err)
+	}
+	// The same container is added again.
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "web-a", map[string]string{
+		customizeIPKey: "10.0.1.2", "cni.anchor.org/controller": "web",
+	}))
+
+	expectIP(t, "2001:db8::2", allocate(t, s, "b", "pod", map[string]string{customizeSubnetKey: "2001:db8::/64"}))
+	if _, err = tryAllocate(s, "c", "pod", map[string]string{customizeSubnetKey: "2001:db8::/64"}); err == nil {
+		t.Fatal("expected the quota of the subnet exceeded")
+	}
+	expectIP(t, "10.0.1.3", allocate(t, s, "c", "pod", map[string]string{customizeSubnetKey: "10.0.1.0/24"}))
+	_, err = tryAllocate(s, "d", "pod", map[string]string{customizeIPKey: "10.0.1.5"})
+	if e, ok := err.(*QuotaExceededError); !ok || e.Quota.Subnet != "" || e.Used != 3 {
+		t.Fatalf("expected the quota of the namespace exceeded, got %v", err)
+	}
+
+	clean(t, s, "c")
+	expectIP(t, "10.0.1.5", allocate(t, s, "d", "pod", map[string]string{customizeIPKey: "10.0.1.5"}))
+}
+
+func Test_AllocateRoundRobin(t *testing.T) {
+	s := newStore(t)
+	if err := s.InsertStrategyMap(store.StrategyMap{Subnet: "10.0.1.0/24", Strategy: store.StrategyRoundRobin}); err != nil {
+		t.Fatal(err.Error())
+	}
+	subnet := map[string]string{customizeSubnetKey: "10.0.1.0/24"}
+	for _, expected := range []string{"10.0.1.2", "10.0.1.3", "10.0.1.4", "10.0.1.5"} {
+		expectIP(t, expected, allocate(t, s, expected, "pod", subnet))
+		clean(t, s, expected)
+	}
+	// Wraps around to the beginning.
+	expectIP(t, "10.0.1.2", allocate(t, s, "a", "pod", subnet))
+}
+
+func Test_AllocateLeastRecentlyReleased(t *testing.T) {
+	s := newStore(t)
+	if err := s.InsertStrategyMap(store.StrategyMap{Namespace: "default", Strategy: store.StrategyLeastRecentlyReleased}); err != nil {
+		t.Fatal(err.Error())
+	}
+	subnet := map[string]string{customizeSubnetKey: "10.0.1.0/24"}
+	for _, id := range []string{"10.0.1.2", "10.0.1.3", "10.0.1.4", "10.0.1.5"} {
+		expectIP(t, id, allocate(t, s, id, "pod", subnet))
+	}
+	for _, id := range []string{"10.0.1.4", "10.0.1.2", "10.0.1.5"} {
+		clean(t, s, id)
+	}
+	expectIP(t, "10.0.1.4", allocate(t, s, "a", "pod", subnet))
+	expectIP(t, "10.0.1.2", allocate(t, s, "b", "pod", subnet))
+}
+
+func Test_AllocateRandom(t *testing.T) {
+	s := newStore(t)
+	if err := s.InsertStrategyMap(store.StrategyMap{Namespace: "default", Strategy: store.StrategyRandom}); err != nil {
+		t.Fatal(err.Error())
+	}
+	subnet := map[string]string{customizeSubnetKey: "10.0.1.0/24"}
+	allocated := make(map[string]bool)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		allocated[allocate(t, s, id, "pod", subnet).String()] = true
+	}
+	// All the IPs in the pool except the gateway.
+	if len(allocated) != 4 || allocated["10.0.1.1"] {
+		t.Fatalf("unexpected IPs allocated %v", allocated)
+	}
+	if _, err := tryAllocate(s, "e", "pod", subnet); err == nil {
+		t.Fatal("expected error when the pool is exhausted")
+	}
+}
+
+func Test_Collect(t *testing.T) {
+	s := newStore(t)
+	if err := s.InsertAllocateMap(store.AllocateMap{
+		Namespace: "default",
+		Allocate:  "10.0.1.[1-9],2001:db8::[1-9]",
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for id, node := range map[string]string{"a": "node1", "b": "node1", "c": "node2", "d": ""} {
+		allocate(t, s, id, "pod", map[string]string{
+			customizeSubnetKey:       "10.0.1.0/24",
+			"cni.anchor.org/node":    node,
+			"cni.anchor.org/network": "net1",
+		})
+	}
+	// Attached to another network on the same node, such as by multus.
+	allocate(t, s, "e", "pod", map[string]string{
+		customizeSubnetKey:       "2001:db8::/64",
+		"cni.anchor.org/node":    "node1",
+		"cni.anchor.org/network": "net2",
+	})
+	// Attached to both networks.
+	for _, network := range []string{"net1", "net2"} {
+		subnet := map[string]string{"net1": "10.0.1.0/24", "net2": "2001:db8::/64"}[network]
+		allocate(t, s, "f", "pod", map[string]string{
+			customizeSubnetKey:       subnet,
+			"cni.anchor.org/node":    "node1",
+			"cni.anchor.org/network": network,
+		})
+	}
+	if err := NewCollector(s, "node1", "net1", time.Second, 0).Collect([]string{"a"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	reservations, _ := s.RetrieveReservations()
+	for id, expected := range map[string]int{"a": 1, "b": 0, "c": 1, "d": 1, "e": 1, "f": 2} {
+		if len(reservations[id]) != expected {
+			t.Fatalf("expected %d IPs of container %s kept, got %d", expected, id, len(reservations[id]))
+		}
+	}
+
+	if err := NewCollector(s, "node1", "net2", time.Second, 0).Collect([]string{"f"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if reservations, _ = s.RetrieveReservations(); len(reservations["e"]) != 0 || len(reservations["a"]) != 1 {
+		t.Fatal("expected IP of container e released only")
+	}
+}
+
+func Test_CollectReclaim(t *testing.T) {
+	s := newStore(t)
+	// Left pending by an ADD which failed halfway on another node.
+	if _, err := s.Reserve("a", &store.Record{
+		IP:      net.ParseIP("10.0.1.2"),
+		Subnet:  "10.0.1.0/24",
+		Node:    "node2",
+		State:   store.StatePending,
+		Expires: time.Now().Add(-time.Second),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := NewCollector(s, "node1", "net1", time.Second, 0).Collect(nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if reservations, _ := s.RetrieveReservations(); len(reservations["a"]) != 0 {
+		t.Fatal("expected expired pending reservation reclaimed by GC")
+	}
+}
+
+// BenchmarkAllocate allocates the last free IP of a /16 subnet, which has 64k IPs.
+func BenchmarkAllocate(b *testing.B) {
+	s := memory.NewMemory()
+	s.InsertGatewayMap(store.GatewayMap{Subnet: "10.1.0.0/16", Gateway: "10.1.0.1"})
+	s.InsertAllocateMap(store.AllocateMap{Namespace: "default", Allocate: "10.1.0.2-10.1.255.254"})
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	alloc, err := NewAllocator(s, "bench", "default", map[string]string{
+		customizeSubnetKey: subnet.String(),
+	}, time.Second)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	last := net.ParseIP("10.1.255.254")
+	for offset := uint64(2); offset < bitmap.PageSize-2; offset++ {
+		if _, err := s.Reserve("others", &store.Record{
+			IP:     bitmap.IPAt(subnet, offset),
+			Subnet: subnet.String(),
+		}); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s.Release("bench")
+		ipConf, err := alloc.Allocate("bench")
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		if !ipConf.Address.IP.Equal(last) {
+			b.Fatalf("expected %s, got %s", last.String(), ipConf.Address.IP.String())
+		}
+	}
+}
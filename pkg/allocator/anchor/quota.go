@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package anchor
+
+import (
+	"fmt"
+	"github.com/hainesc/anchor/pkg/store"
+)
+
+// QuotaExceededError is returned by Allocate if a quota of the namespace is used up.
+type QuotaExceededError struct {
+	Quota store.QuotaMap
+	// Used is the number of IPs counted by the quota, before the allocation.
+	Used int
+}
+
+// Error prints out the error message for QuotaExceededError
+func (e *QuotaExceededError) Error() string {
+	scope := "namespace " + e.Quota.Namespace
+	switch {
+	case e.Quota.Subnet != "":
+		scope += " in subnet " + e.Quota.Subnet
+	case e.Quota.Controller != "":
+		scope = "controller " + e.Quota.Controller + " in " + scope
+	}
+	return fmt.Sprintf("quota of %s exceeded, %d of %d IPs used", scope, e.Used, e.Quota.Max)
+}
+
+// checkQuota returns QuotaExceededError if a quota counting the IP to allocate is used up,
+// the caller should hold the lock. The IPs in other subnets are reserved under their own
+// locks, so the quotas of the namespace and the controller may be exceeded slightly by
+// concurrent allocations in different subnets.
+func (a *Allocator) checkQuota(id string) error {
+	quotas, err := a.store.RetrieveQuotas(a.namespace)
+	if err != nil || len(quotas) == 0 {
+		return err
+	}
+	if a.ip != nil {
+		holder, err := a.store.RetrieveHolder(a.subnet, a.ip)
+		if err != nil {
+			return err
+		}
+		if holder == id {
+			// The same container is added again for the IP it holds.
+			return nil
+		}
+	}
+
+	next := a.record(a.ip)
+	for _, quota := range quotas {
+		if !quota.Counts(next) {
+			continue
+		}
+		used, err := a.store.RetrieveUsed(quota)
+		if err != nil {
+			return err
+		}
+		if used >= quota.Max {
+			return &QuotaExceededError{Quota: quota, Used: used}
+		}
+	}
+	return nil
+}
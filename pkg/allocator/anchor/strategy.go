@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package anchor
+
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/utils"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// segment is a range of offsets in the subnet, both ends included.
+type segment struct {
+	start uint64
+	end   uint64
+}
+
+// allocateDynamic allocates a free IP in ips in the order decided by the strategy of the
+// namespace or the subnet, the caller should hold the lock.
+func (a *Allocator) allocateDynamic(id string, ips *utils.RangeSet) (*current.IPConfig, error) {
+	strategy, err := a.store.RetrieveStrategy(a.namespace, a.subnet)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := a.segments(ips)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("can not allcate IP for pod named, %s", a.pod)
+	}
+
+	start := segments[0].start
+	switch strategy {
+	case "", store.StrategyLowestFirst:
+	case store.StrategyRoundRobin:
+		cursor, err := a.store.RetrieveCursor(a.subnet)
+		if err != nil {
+			return nil, err
+		}
+		if offset, err := bitmap.Offset(a.subnet, cursor); cursor != nil && err == nil {
+			start = offset + 1
+		}
+	case store.StrategyRandom:
+		start = randomOffset(segments)
+	case store.StrategyLeastRecentlyReleased:
+		return a.allocateLeastRecentlyReleased(id, segments)
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", strategy)
+	}
+
+	var ipConf *current.IPConfig
+	err = a.walk(rotate(segments, start), func(candidate net.IP) (bool, error) {
+		ipConf, err = a.tryReserve(id, candidate)
+		return ipConf != nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ipConf == nil {
+		return nil, fmt.Errorf("can not allcate IP for pod named, %s", a.pod)
+	}
+	return ipConf, nil
+}
+
+// allocateLeastRecentlyReleased allocates the free IP never released, or the one released
+// earliest. The walk stops at the first IP never released, so it is short even in a huge
+// subnet since only the IPs ever used are released.
+func (a *Allocator) allocateLeastRecentlyReleased(id string, segments []segment) (*current.IPConfig, error) {
+	released, err := a.store.RetrieveReleased(a.subnet)
+	if err != nil {
+		return nil, err
+	}
+	var ipConf *current.IPConfig
+	candidates := make([]net.IP, 0)
+	err = a.walk(segments, func(candidate net.IP) (bool, error) {
+		if _, ok := released[candidate.String()]; ok {
+			candidates = append(candidates, candidate)
+			return false, nil
+		}
+		ipConf, err = a.tryReserve(id, candidate)
+		return ipConf != nil, err
+	})
+	if err != nil || ipConf != nil {
+		return ipConf, err
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return released[candidates[i].String()].Before(released[candidates[j].String()])
+	})
+	for _, candidate := range candidates {
+		if ipConf, err = a.tryReserve(id, candidate); err != nil || ipConf != nil {
+			return ipConf, err
+		}
+	}
+	return nil, fmt.Errorf("can not allcate IP for pod named, %s", a.pod)
+}
+
+// tryReserve reserves the candidate, nil is returned if it is used by others.
+func (a *Allocator) tryReserve(id string, candidate net.IP) (*current.IPConfig, error) {
+	reserved, err := a.store.Reserve(id, a.record(candidate))
+	if err != nil || !reserved {
+		// Used by others but not in the bitmap yet, try the next one.
+		return nil, err
+	}
+	if a.sticky {
+		if err = a.store.Bind(a.namespace, a.pod, candidate); err != nil {
+			return nil, err
+		}
+	}
+	return a.ipConfig(candidate), nil
+}
+
+// segments returns the offsets of ips in the subnet, sorted.
+func (a *Allocator) segments(ips *utils.RangeSet) ([]segment, error) {
+	segments := make([]segment, 0, len(*ips))
+	for _, r := range *ips {
+		start, err := bitmap.Offset(a.subnet, r.RangeStart)
+		if err != nil {
+			return nil, err
+		}
+		end, err := bitmap.Offset(a.subnet, r.RangeEnd)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment{start: start, end: end})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start < segments[j].start })
+	return segments, nil
+}
+
+// walk calls visit on the free IPs in segments in order except the gateway, until visit
+// returns true or error.
+func (a *Allocator) walk(segments []segment, visit func(candidate net.IP) (bool, error)) error {
+	// Pages of the bitmap retrieved in this walk.
+	pages := make(map[uint64]*bitmap.Bitmap)
+	for _, s := range segments {
+		for offset := s.start; offset <= s.end; {
+			page := offset / bitmap.PageSize
+			bm, ok := pages[page]
+			if !ok {
+				var err error
+				if bm, err = a.store.RetrieveBitmap(a.subnet, page); err != nil {
+					return err
+				}
+				pages[page] = bm
+			}
+			last := s.end
+			if s.end/bitmap.PageSize != page {
+				last = (page+1)*bitmap.PageSize - 1
+			}
+
+			i, found := bm.NextClear(uint32(offset%bitmap.PageSize), uint32(last%bitmap.PageSize))
+			if !found {
+				// Move on to the next page.
+				offset = last + 1
+				continue
+			}
+			offset = page*bitmap.PageSize + uint64(i) + 1
+			candidate := bitmap.IPAt(a.subnet, page*bitmap.PageSize+uint64(i))
+			if candidate.Equal(a.gateway) {
+				continue
+			}
+			if done, err := visit(candidate); err != nil || done {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rotate returns segments from the offset start to the end, followed by the ones
+// from the beginning to start.
+func rotate(segments []segment, start uint64) []segment {
+	after, before := make([]segment, 0), make([]segment, 0)
+	for _, s := range segments {
+		switch {
+		case s.end < start:
+			before = append(before, s)
+		case s.start >= start:
+			after = append(after, s)
+		default:
+			after = append(after, segment{start: start, end: s.end})
+			before = append(before, segment{start: s.start, end: start - 1})
+		}
+	}
+	return append(after, before...)
+}
+
+// random is seeded for each plugin process, otherwise every allocation starts at the same offset.
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// randomOffset returns a random offset in segments.
+func randomOffset(segments []segment) uint64 {
+	total := uint64(0)
+	for _, s := range segments {
+		total += s.end - s.start + 1
+	}
+	n := random.Uint64()
+	if total != 0 {
+		// Zero means the whole of a huge subnet, which is overflowed.
+		n %= total
+	}
+	for _, s := range segments {
+		if size := s.end - s.start + 1; size != 0 && n >= size {
+			n -= size
+			continue
+		}
+		return s.start + n
+	}
+	return segments[0].start
+}
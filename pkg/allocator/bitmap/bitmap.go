@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package bitmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+)
+
+// PageSize is the number of IPs in a page, a page of /16 subnet takes 8KB.
+const PageSize = 1 << 16
+
+const wordSize = 64
+
+// Bitmap is a page of IPs in a subnet, one bit for each IP and set if the IP is used.
+// The IPs of a subnet are split into pages by their offsets from the network address,
+// so the store only has to keep the pages which are really used.
+type Bitmap struct {
+	words []uint64
+}
+
+// New news an empty page.
+func New() *Bitmap {
+	return &Bitmap{
+		words: make([]uint64, PageSize/wordSize),
+	}
+}
+
+// FromBytes restores a page from bytes which returned by Bytes.
+func FromBytes(b []byte) (*Bitmap, error) {
+	if len(b) != PageSize/8 {
+		return nil, fmt.Errorf("invalid length of bitmap %d", len(b))
+	}
+	bm := New()
+	for i := range bm.words {
+		bm.words[i] = binary.LittleEndian.Uint64(b[i*8:])
+	}
+	return bm, nil
+}
+
+// Bytes returns the page in bytes for persistence.
+func (b *Bitmap) Bytes() []byte {
+	ret := make([]byte, PageSize/8)
+	for i, w := range b.words {
+		binary.LittleEndian.PutUint64(ret[i*8:], w)
+	}
+	return ret
+}
+
+// Set marks the i-th IP of the page as used.
+func (b *Bitmap) Set(i uint32) {
+	b.words[i/wordSize] |= 1 << (i % wordSize)
+}
+
+// Clear marks the i-th IP of the page as free.
+func (b *Bitmap) Clear(i uint32) {
+	b.words[i/wordSize] &^= 1 << (i % wordSize)
+}
+
+// Test returns true if the i-th IP of the page is used.
+func (b *Bitmap) Test(i uint32) bool {
+	return b.words[i/wordSize]&(1<<(i%wordSize)) != 0
+}
+
+// NextClear returns the first free IP in [from, to] of the page,
+// false is returned if all of them are used.
+func (b *Bitmap) NextClear(from, to uint32) (uint32, bool) {
+	if to >= PageSize {
+		to = PageSize - 1
+	}
+	for from <= to {
+		w := from / wordSize
+		// Treat the bits before from as used.
+		free := ^b.words[w] &^ (1<<(from%wordSize) - 1)
+		if free != 0 {
+			i := w*wordSize + uint32(bits.TrailingZeros64(free))
+			if i > to {
+				return 0, false
+			}
+			return i, true
+		}
+		from = (w + 1) * wordSize
+	}
+	return 0, false
+}
+
+// Offset returns the offset of ip from the network address of subnet.
+func Offset(subnet *net.IPNet, ip net.IP) (uint64, error) {
+	if !subnet.Contains(ip) {
+		return 0, fmt.Errorf("%s not in network %s", ip.String(), subnet.String())
+	}
+	offset := big.NewInt(0).Sub(ipToInt(ip), ipToInt(subnet.IP))
+	if !offset.IsUint64() {
+		// Subnets larger than /64 are not supported.
+		return 0, fmt.Errorf("%s too far from the network address of %s", ip.String(), subnet.String())
+	}
+	return offset.Uint64(), nil
+}
+
+// IPAt returns the IP at offset from the network address of subnet.
+func IPAt(subnet *net.IPNet, offset uint64) net.IP {
+	i := big.NewInt(0).Add(ipToInt(subnet.IP), big.NewInt(0).SetUint64(offset))
+	b := i.Bytes()
+	ip := make(net.IP, len(subnet.IP.Mask(subnet.Mask)))
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// Locate returns the page and the index in the page of ip.
+func Locate(subnet *net.IPNet, ip net.IP) (uint64, uint32, error) {
+	offset, err := Offset(subnet, ip)
+	if err != nil {
+		return 0, 0, err
+	}
+	return offset / PageSize, uint32(offset % PageSize), nil
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v := ip.To4(); v != nil {
+		return big.NewInt(0).SetBytes(v)
+	}
+	return big.NewInt(0).SetBytes(ip.To16())
+}
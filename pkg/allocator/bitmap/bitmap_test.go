@@ -0,0 +1,90 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package bitmap
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_NextClear(t *testing.T) {
+	bm := New()
+	for i := uint32(0); i < 130; i++ {
+		bm.Set(i)
+	}
+	bm.Clear(70)
+
+	if i, ok := bm.NextClear(0, PageSize-1); !ok || i != 70 {
+		t.Fatalf("expected 70, got %d %v", i, ok)
+	}
+	if i, ok := bm.NextClear(71, PageSize-1); !ok || i != 130 {
+		t.Fatalf("expected 130, got %d %v", i, ok)
+	}
+	if _, ok := bm.NextClear(71, 129); ok {
+		t.Fatal("expected no clear bit in [71, 129]")
+	}
+
+	restored, err := FromBytes(bm.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !restored.Test(69) || restored.Test(70) {
+		t.Fatal("bitmap changed after restored from bytes")
+	}
+}
+
+func Test_Locate(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/8")
+	page, i, err := Locate(subnet, net.ParseIP("10.1.0.5"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if page != 1 || i != 5 {
+		t.Fatalf("expected page 1 index 5, got %d %d", page, i)
+	}
+	if ip := IPAt(subnet, page*PageSize+uint64(i)); !ip.Equal(net.ParseIP("10.1.0.5")) {
+		t.Fatalf("expected 10.1.0.5, got %s", ip.String())
+	}
+
+	_, subnet6, _ := net.ParseCIDR("2001:db8::/64")
+	offset, err := Offset(subnet6, net.ParseIP("2001:db8::1:2"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if offset != 0x10002 {
+		t.Fatalf("expected offset 0x10002, got %x", offset)
+	}
+	if ip := IPAt(subnet6, offset); !ip.Equal(net.ParseIP("2001:db8::1:2")) {
+		t.Fatalf("expected 2001:db8::1:2, got %s", ip.String())
+	}
+}
+
+// BenchmarkNextClear finds the last free IP in a page of 64k IPs.
+func BenchmarkNextClear(b *testing.B) {
+	bm := New()
+	for i := uint32(0); i < PageSize-1; i++ {
+		bm.Set(i)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, ok := bm.NextClear(0, PageSize-1); !ok {
+			b.Fatal("expected a clear bit")
+		}
+	}
+}
+
+// BenchmarkFromBytes restores a page of 64k IPs, which is done once for each allocation.
+func BenchmarkFromBytes(b *testing.B) {
+	raw := New().Bytes()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := FromBytes(raw); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
@@ -18,6 +18,15 @@ import (
 
 // CaptainConf is the config for Caption, Maybe we should rename it to MonkeyConf.
 type CaptainConf struct {
+	// Which store to use, etcd if omitted.
+	Store struct {
+		// Type is etcd, file or crd.
+		Type string `json:"type"`
+		// Path of the file for the file store.
+		Path string `json:"path"`
+		// Kubeconfig for the crd store, the in cluster config is used if omitted.
+		Kubeconfig string `json:"kubeconfig"`
+	} `json:"store"`
 	// etcd client
 	Endpoints string `json:"etcd_endpoints"`
 	// etcd perm files
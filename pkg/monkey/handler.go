@@ -9,46 +9,107 @@ package monkey
 
 import (
 	"encoding/json"
-	"github.com/hainesc/anchor/pkg/store/etcd"
+	"github.com/hainesc/anchor/pkg/store"
 	"log"
+	"net"
 	"net/http"
-	"strings"
+	"time"
 )
 
 // InUseHandler handlers the get request from front end and returns IPs in use.
 // TODO: It should has a member named user_namespace which can filter the result.
 type InUseHandler struct {
-	etcd *etcd.Etcd
+	store store.Monkey
 }
 
 // NewInUseHandler news an InUsedHandler
-func NewInUseHandler(etcd *etcd.Etcd) *InUseHandler {
+func NewInUseHandler(store store.Monkey) *InUseHandler {
 	return &InUseHandler{
-		etcd: etcd,
+		store: store,
 	}
 }
 
 // GatewayHandler handles the request for gateway information
 type GatewayHandler struct {
-	etcd *etcd.Etcd
+	store store.Monkey
 }
 
 // NewGatewayHandler news a GatewayHandler
-func NewGatewayHandler(etcd *etcd.Etcd) *GatewayHandler {
+func NewGatewayHandler(store store.Monkey) *GatewayHandler {
 	return &GatewayHandler{
-		etcd: etcd,
+		store: store,
 	}
 }
 
 // AllocateHandler handles the request for allocate information
 type AllocateHandler struct {
-	etcd *etcd.Etcd
+	store store.Monkey
 }
 
 // NewAllocateHandler news a Allocator handler
-func NewAllocateHandler(etcd *etcd.Etcd) *AllocateHandler {
+func NewAllocateHandler(store store.Monkey) *AllocateHandler {
 	return &AllocateHandler{
-		etcd: etcd,
+		store: store,
+	}
+}
+
+// StickyHandler handles the request for IPs bound to pods
+type StickyHandler struct {
+	store store.Monkey
+}
+
+// NewStickyHandler news a StickyHandler
+func NewStickyHandler(store store.Monkey) *StickyHandler {
+	return &StickyHandler{
+		store: store,
+	}
+}
+
+// StrategyHandler handles the request for allocation strategies of subnets and namespaces
+type StrategyHandler struct {
+	store store.Monkey
+}
+
+// NewStrategyHandler news a StrategyHandler
+func NewStrategyHandler(store store.Monkey) *StrategyHandler {
+	return &StrategyHandler{
+		store: store,
+	}
+}
+
+// QuotaHandler handles the request for quotas of namespaces
+type QuotaHandler struct {
+	store store.Monkey
+}
+
+// NewQuotaHandler news a QuotaHandler
+func NewQuotaHandler(store store.Monkey) *QuotaHandler {
+	return &QuotaHandler{
+		store: store,
+	}
+}
+
+// QuarantineHandler handles the request for IPs quarantined after released
+type QuarantineHandler struct {
+	store store.Monkey
+}
+
+// NewQuarantineHandler news a QuarantineHandler
+func NewQuarantineHandler(store store.Monkey) *QuarantineHandler {
+	return &QuarantineHandler{
+		store: store,
+	}
+}
+
+// ConflictHandler handles the request for IPs found in use by hosts outside of anchor
+type ConflictHandler struct {
+	store store.Monkey
+}
+
+// NewConflictHandler news a ConflictHandler
+func NewConflictHandler(store store.Monkey) *ConflictHandler {
+	return &ConflictHandler{
+		store: store,
 	}
 }
 
@@ -59,7 +120,7 @@ func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Serve the resource.
 		// TODO: just for test.
 		log.Printf("receive a get mothod with parameter: ")
-		gws, _ := h.etcd.AllGatewayMap()
+		gws, _ := h.store.AllGatewayMap()
 		response, _ := json.Marshal(gws)
 		// TODO: if error.
 		w.Write(response)
@@ -67,8 +128,8 @@ func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Create a new record.
 		// curl -X POST -d "{\"subnet\": \"10.2.1.0/24\", \"gw\": \"10.2.1.1\"}" http://localhost:3000/api/v1/gateway
 		log.Printf("receive a post mothod with parameter: ")
-		// gms := make([]etcd.GatewayMap, 0)
-		var gm etcd.GatewayMap
+		// gms := make([]store.GatewayMap, 0)
+		var gm store.GatewayMap
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&gm)
 		if err != nil {
@@ -80,7 +141,7 @@ func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// TODO: check if exists.
 		log.Printf("%s: %s", gm.Subnet, gm.Gateway)
 
-		err = h.etcd.InsertGatewayMap(gm)
+		err = h.store.InsertGatewayMap(gm)
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -92,8 +153,8 @@ func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Remove the record.
 		// curl -X DELETE -d "[{\"subnet\": \"10.2.1.0/24\", \"gw\": \"10.2.1.1\"}]" http://localhost:3000/api/v1/gateway
 		log.Printf("receive a delete mothod with parameter: ")
-		gms := make([]etcd.GatewayMap, 0)
-		// var gms etcd.GatewayMap
+		gms := make([]store.GatewayMap, 0)
+		// var gms store.GatewayMap
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&gms)
 		if err != nil {
@@ -104,7 +165,7 @@ func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Printf("%s: %s", gm.Subnet, gm.Gateway)
 
 		}
-		err = h.etcd.DeleteGatewayMap(gms)
+		err = h.store.DeleteGatewayMap(gms)
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -114,8 +175,8 @@ func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Remove the record.
 		// curl -X DELETE -d "[{\"subnet\": \"10.2.1.0/24\", \"gw\": \"10.2.1.1\"}]" http://localhost:3000/api/v1/gateway
 		log.Printf("receive a delete mothod with parameter: ")
-		gms := make([]etcd.GatewayMap, 0)
-		// var gms etcd.GatewayMap
+		gms := make([]store.GatewayMap, 0)
+		// var gms store.GatewayMap
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&gms)
 		if err != nil {
@@ -126,7 +187,7 @@ func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Printf("%s: %s", gm.Subnet, gm.Gateway)
 
 		}
-		err = h.etcd.DeleteGatewayMap(gms)
+		err = h.store.DeleteGatewayMap(gms)
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -143,15 +204,15 @@ func (h *AllocateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Serve the resource.
 		// TODO: just for test.
 		log.Printf("receive a get mothod with parameter: ")
-		ams, _ := h.etcd.AllAllocate()
+		ams, _ := h.store.AllAllocate()
 		response, _ := json.Marshal(ams)
 		// TODO: if error.
 		w.Write(response)
 	case http.MethodPost:
 		// Create a new record.
 		log.Printf("receive a post mothod with parameter: ")
-		// gms := make([]etcd.GatewayMap, 0)
-		var am etcd.AllocateMap
+		// gms := make([]store.GatewayMap, 0)
+		var am store.AllocateMap
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&am)
 		if err != nil {
@@ -161,9 +222,9 @@ func (h *AllocateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		// TODO: valid the input.
 		// TODO: check if exists.
-		log.Printf("%s: %s", am.Namespace, am.Allocate)
+		log.Printf("%s: %s", am.Key(), am.Allocate)
 
-		err = h.etcd.InsertAllocateMap(am)
+		err = h.store.InsertAllocateMap(am)
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -174,8 +235,8 @@ func (h *AllocateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodDelete:
 		// Remove the record.
 		log.Printf("receive a delete mothod with parameter: ")
-		ams := make([]etcd.AllocateMap, 0)
-		// var gms etcd.GatewayMap
+		ams := make([]store.AllocateMap, 0)
+		// var gms store.GatewayMap
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&ams)
 		if err != nil {
@@ -183,10 +244,10 @@ func (h *AllocateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid parameter.", 505)
 		}
 		for _, am := range ams {
-			log.Printf("%s: %s", am.Namespace, am.Allocate)
+			log.Printf("%s: %s", am.Key(), am.Allocate)
 
 		}
-		err = h.etcd.DeleteAllocateMap(ams)
+		err = h.store.DeleteAllocateMap(ams)
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -195,8 +256,8 @@ func (h *AllocateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPatch:
 		// Remove the record.
 		log.Printf("receive a delete mothod with parameter: ")
-		ams := make([]etcd.AllocateMap, 0)
-		// var gms etcd.GatewayMap
+		ams := make([]store.AllocateMap, 0)
+		// var gms store.GatewayMap
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&ams)
 		if err != nil {
@@ -204,10 +265,10 @@ func (h *AllocateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid parameter.", 505)
 		}
 		for _, am := range ams {
-			log.Printf("%s: %s", am.Namespace, am.Allocate)
+			log.Printf("%s: %s", am.Key(), am.Allocate)
 
 		}
-		err = h.etcd.DeleteAllocateMap(ams)
+		err = h.store.DeleteAllocateMap(ams)
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -217,12 +278,243 @@ func (h *AllocateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ServeHTTP serves http
+func (h *StickyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		bms, err := h.store.AllBinding()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		response, _ := json.Marshal(bms)
+		w.Write(response)
+	// The bindings are created by anchor, so only removing is supported here.
+	// TODO: remove the patch case when angular delete method supports body parameter, see GatewayHandler.
+	case http.MethodDelete, http.MethodPatch:
+		// Remove the record.
+		// curl -X DELETE -d "[{\"ns\": \"default\", \"pod\": \"mysql-0\", \"ip\": \"10.0.1.8\"}]" http://localhost:8964/api/v1/sticky
+		bms := make([]store.BindingMap, 0)
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&bms); err != nil {
+			http.Error(w, "Invalid parameter.", 405)
+			return
+		}
+		for _, bm := range bms {
+			log.Printf("%s/%s: %s", bm.Namespace, bm.Pod, bm.IP)
+		}
+		if err := h.store.DeleteBindingMap(bms); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	default:
+		// Give an error message.
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ServeHTTP serves http
+func (h *StrategyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sms, err := h.store.AllStrategy()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		response, _ := json.Marshal(sms)
+		w.Write(response)
+	case http.MethodPost:
+		// curl -X POST -d "{\"ns\": \"default\", \"strategy\": \"round-robin\"}" http://localhost:8964/api/v1/strategy
+		var sm store.StrategyMap
+		if err := json.NewDecoder(r.Body).Decode(&sm); err != nil {
+			http.Error(w, "Invalid parameter.", 405)
+			return
+		}
+		log.Printf("%s%s: %s", sm.Subnet, sm.Namespace, sm.Strategy)
+		if err := h.store.InsertStrategyMap(sm); err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+	// TODO: remove the patch case when angular delete method supports body parameter, see GatewayHandler.
+	case http.MethodDelete, http.MethodPatch:
+		sms := make([]store.StrategyMap, 0)
+		if err := json.NewDecoder(r.Body).Decode(&sms); err != nil {
+			http.Error(w, "Invalid parameter.", 405)
+			return
+		}
+		if err := h.store.DeleteStrategyMap(sms); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	default:
+		// Give an error message.
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ServeHTTP serves http
+func (h *QuotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		qms, err := h.store.AllQuota()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		records, err := h.store.RetrieveUsedbyNamespace("", true)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		result := []quota{}
+		for _, qm := range *qms {
+			q := quota{QuotaMap: qm}
+			for i := range *records {
+				if qm.Counts(&(*records)[i]) {
+					q.Used++
+				}
+			}
+			result = append(result, q)
+		}
+		response, _ := json.Marshal(result)
+		w.Write(response)
+	case http.MethodPost:
+		// curl -X POST -d "{\"ns\": \"default\", \"ctrl\": \"web\", \"max\": 10}" http://localhost:8964/api/v1/quota
+		var qm store.QuotaMap
+		if err := json.NewDecoder(r.Body).Decode(&qm); err != nil {
+			http.Error(w, "Invalid parameter.", 405)
+			return
+		}
+		log.Printf("%s: %d", qm.Key(), qm.Max)
+		if err := h.store.InsertQuotaMap(qm); err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+	// TODO: remove the patch case when angular delete method supports body parameter, see GatewayHandler.
+	case http.MethodDelete, http.MethodPatch:
+		qms := make([]store.QuotaMap, 0)
+		if err := json.NewDecoder(r.Body).Decode(&qms); err != nil {
+			http.Error(w, "Invalid parameter.", 405)
+			return
+		}
+		if err := h.store.DeleteQuotaMap(qms); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	default:
+		// Give an error message.
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// quota is a quota with the number of IPs counted by it.
+type quota struct {
+	store.QuotaMap
+	Used int `json:"used"`
+}
+
+// ServeHTTP serves http
+func (h *QuarantineHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		// The quarantine is over by itself, so only getting is supported here.
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	tombstones, err := h.store.AllQuarantined()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	result := []quarantined{}
+	for _, t := range *tombstones {
+		result = append(result, quarantined{
+			IP:        t.IP.String(),
+			Subnet:    t.Subnet,
+			Pod:       t.Pod,
+			Namespace: t.Namespace,
+			Released:  t.Updated,
+			Until:     t.Expires,
+		})
+	}
+	response, _ := json.Marshal(result)
+	w.Write(response)
+}
+
+// quarantined is an IP quarantined, with the pod which held it last.
+type quarantined struct {
+	IP        string    `json:"ip"`
+	Subnet    string    `json:"subnet,omitempty"`
+	Pod       string    `json:"pod"`
+	Namespace string    `json:"ns"`
+	Released  time.Time `json:"released"`
+	Until     time.Time `json:"until"`
+}
+
+// ServeHTTP serves http
+func (h *ConflictHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		tombstones, err := h.store.AllConflict()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		result := []conflicted{}
+		for _, t := range *tombstones {
+			result = append(result, conflicted{
+				IP:        t.IP.String(),
+				Subnet:    t.Subnet,
+				Pod:       t.Pod,
+				Namespace: t.Namespace,
+				Found:     t.Updated,
+			})
+		}
+		response, _ := json.Marshal(result)
+		w.Write(response)
+	// TODO: remove the patch case when angular delete method supports body parameter, see GatewayHandler.
+	case http.MethodDelete, http.MethodPatch:
+		// The host in conflict is gone, hand out the IPs again.
+		// curl -X DELETE -d "[{\"ip\": \"10.0.1.2\"}]" http://localhost:8964/api/v1/conflict
+		cs := make([]conflicted, 0)
+		if err := json.NewDecoder(r.Body).Decode(&cs); err != nil {
+			http.Error(w, "Invalid parameter.", 405)
+			return
+		}
+		addresses := make([]net.IP, 0, len(cs))
+		for _, c := range cs {
+			ip := net.ParseIP(c.IP)
+			if ip == nil {
+				http.Error(w, "Invalid parameter.", 405)
+				return
+			}
+			addresses = append(addresses, ip)
+		}
+		if err := h.store.DeleteConflict(addresses); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// conflicted is an IP in conflict, with the pod which got it when the conflict was found.
+type conflicted struct {
+	IP        string    `json:"ip"`
+	Subnet    string    `json:"subnet,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+	Namespace string    `json:"ns,omitempty"`
+	Found     time.Time `json:"found,omitempty"`
+}
+
 // TODO:
 type ips struct {
 	IP         string `json:"ip"`
 	Pod        string `json:"pod"`
 	Namespace  string `json:"ns"`
 	Controller string `json:"ctrl"`
+	Subnet     string `json:"subnet,omitempty"`
+	Node       string `json:"node,omitempty"`
+	// State is pending if the IP is reserved but the ADD not finished yet.
+	State string `json:"state,omitempty"`
 	// App string `json:"app"`
 	// Service string `json:"svc"`
 }
@@ -246,26 +538,29 @@ func (h *InUseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	result := []ips{}
 	// TODO: check header and find whether is admin role.
-	ipsInArray, err := h.etcd.RetrieveUsedbyNamespace("default", true)
+	ipsInArray, err := h.store.RetrieveUsedbyNamespace("default", true)
 	if err != nil {
 		// TODO: if err, we return an empty here.
 		w.Write(empty)
+		return
 	}
 
 	for _, r := range *ipsInArray {
-		parts := strings.Split(r, ",")
 		result = append(result, ips{
-			IP:         parts[0],
-			Pod:        parts[1],
-			Namespace:  parts[2],
-			Controller: parts[4],
+			IP:         r.IP.String(),
+			Pod:        r.Pod,
+			Namespace:  r.Namespace,
+			Controller: r.Controller,
+			Subnet:     r.Subnet,
+			Node:       r.Node,
+			State:      r.State,
 		})
 	}
 	resultInJSON, err := json.Marshal(result)
 	if err != nil {
-		log.Printf("empty, ", err.Error())
+		log.Printf("empty, %s", err.Error())
 		w.Write(empty)
 	}
-	log.Printf("empty, ", string(resultInJSON))
+	log.Printf("empty, %s", string(resultInJSON))
 	w.Write(resultInJSON)
 }
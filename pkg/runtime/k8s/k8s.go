@@ -13,11 +13,24 @@ import (
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 // NewK8sClient creates a k8s client
 func NewK8sClient(kuber Kubernetes, policy Policy) (*kubernetes.Clientset, error) {
+	config, err := NewK8sConfig(kuber, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the clientset
+	return kubernetes.NewForConfig(config)
+}
+
+// NewK8sConfig creates the config of k8s clients, the in cluster config is used
+// if neither kubeconfig nor API root is given.
+func NewK8sConfig(kuber Kubernetes, policy Policy) (*rest.Config, error) {
 	// Some config can be passed in a kubeconfig file
 	kubeconfig := kuber.Kubeconfig
 	// Config can be overridden by config passed in explicitly in the network config.
@@ -52,15 +65,9 @@ func NewK8sClient(kuber Kubernetes, policy Policy) (*kubernetes.Clientset, error
 	}
 
 	// Use the kubernetes client code to load the kubeconfig file and combine it with the overrides.
-	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
 		configOverrides).ClientConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	// Create the clientset
-	return kubernetes.NewForConfig(config)
 }
 
 // GetK8sPodInfo gets the labels and annotations of the pod
@@ -75,9 +82,16 @@ func GetK8sPodInfo(client *kubernetes.Clientset, podName, podNamespace string) (
 // ResourceControllerName gets the name of ResourceController based on given reference.
 func ResourceControllerName(client *kubernetes.Clientset, podName, namespace string) (
 	string, error) {
+	_, name, err := ResourceController(client, podName, namespace)
+	return name, err
+}
+
+// ResourceController gets the kind and name of ResourceController based on given reference.
+func ResourceController(client *kubernetes.Clientset, podName, namespace string) (
+	string, string, error) {
 	pod, err := client.CoreV1().Pods(string(namespace)).Get(podName, v1.GetOptions{})
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	for _, ref := range pod.OwnerReferences {
@@ -85,17 +99,17 @@ func ResourceControllerName(client *kubernetes.Clientset, podName, namespace str
 			if strings.ToLower(ref.Kind) == "replicaset" {
 				rs, err := client.AppsV1beta2().ReplicaSets(namespace).Get(ref.Name, v1.GetOptions{})
 				if err != nil {
-					return "", err
+					return "", "", err
 				}
 				for _, r := range rs.OwnerReferences {
 					if *r.Controller {
-						return r.Name, nil
+						return r.Kind, r.Name, nil
 					}
 				}
-				return ref.Name, nil
+				return ref.Kind, ref.Name, nil
 			}
-			return ref.Name, nil
+			return ref.Kind, ref.Name, nil
 		}
 	}
-	return "", fmt.Errorf("The pod %s has no controller", podName)
+	return "", "", fmt.Errorf("The pod %s has no controller", podName)
 }
@@ -0,0 +1,1041 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+// Package crd implements the store on custom resources of Kubernetes, so that
+// anchor needs no etcd other than the one behind the API server.
+package crd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// maxRetries is the max times to retry an update on conflicts.
+const maxRetries = 16
+
+// CRD is a store keeps everything in custom resources.
+//
+// There is no lock of subnets. Every change of a claim after its creation is an update
+// with the resourceVersion read, which fails on conflicts, so an IP could never be
+// reserved by two containers. Released claims are kept and reused for this reason.
+type CRD struct {
+	client dynamic.Interface
+}
+
+// Store implements the Store interface
+var _ store.Store = &CRD{}
+
+// Monkey implements the Monkey interface
+var _ store.Monkey = &CRD{}
+
+// NewCRD news a store with the client of GroupVersion.
+func NewCRD(client dynamic.Interface) *CRD {
+	return &CRD{client: client}
+}
+
+// NewCRDClient news a store with the config of k8s, see k8s.NewK8sConfig.
+func NewCRDClient(config *rest.Config) (*CRD, error) {
+	c := *config
+	c.APIPath = "/apis"
+	c.GroupVersion = &GroupVersion
+	client, err := dynamic.NewClient(&c)
+	if err != nil {
+		return nil, err
+	}
+	return NewCRD(client), nil
+}
+
+// Lock does nothing but checks ctx, since claims are protected by resourceVersion.
+func (c *CRD) Lock(ctx context.Context, subnet *net.IPNet) error {
+	return ctx.Err()
+}
+
+// Unlock does nothing.
+func (c *CRD) Unlock(subnet *net.IPNet) error {
+	return nil
+}
+
+// Close does nothing.
+func (c *CRD) Close() error {
+	return nil
+}
+
+// Status returns error if the subnets could not be listed.
+func (c *CRD) Status() error {
+	_, err := c.client.Resource(Subnets, "").List(metav1.ListOptions{Limit: 1})
+	return err
+}
+
+// Reserve claims the IP for the container.
+func (c *CRD) Reserve(id string, r *store.Record) (bool, error) {
+	subnet := r.SubnetNet()
+	if subnet == nil {
+		return false, fmt.Errorf("invalid subnet %s of record", r.Subnet)
+	}
+	reserved := false
+	err := c.modifyClaim(subnet, r.IP, func(spec *ClaimSpec) bool {
+		if spec.ContainerID != "" {
+			reserved = spec.ContainerID == id
+			return false
+		}
+		record := *r
+		if record.Created.IsZero() {
+			record.Created = time.Now()
+		}
+		record.Updated = record.Created
+		record.Version = store.RecordVersion
+		spec.ContainerID = id
+		spec.Record = &record
+		spec.Tombstone = nil
+		reserved = true
+		return true
+	})
+	if err != nil || !reserved {
+		return reserved, err
+	}
+	// The cursor is only a hint of the strategies, so the claim is kept even if the
+	// cursor is not kept, such as the subnet is gone.
+	spec := &SubnetSpec{}
+	c.apply(Subnets, objectName(subnet.String()), spec, false, func() {
+		spec.Cursor = r.IP.String()
+	})
+	return true, nil
+}
+
+// Release releases the IPs held by the container, the IPs bound to pods are kept used.
+func (c *CRD) Release(id string) error {
+	claims, err := c.listClaims(containerLabel + "=" + labelValue(id))
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		if claim.ContainerID != id {
+			continue
+		}
+		err = c.modifyClaim(nil, net.ParseIP(claim.IP), func(spec *ClaimSpec) bool {
+			if spec.ContainerID != id {
+				return false
+			}
+			spec.ContainerID = ""
+			spec.Record = nil
+			spec.Released = now()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine releases the IPs held by the container, and keeps them used until the time given.
+func (c *CRD) Quarantine(id string, until time.Time) error {
+	claims, err := c.listClaims(containerLabel + "=" + labelValue(id))
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		if claim.ContainerID != id {
+			continue
+		}
+		err = c.modifyClaim(nil, net.ParseIP(claim.IP), func(spec *ClaimSpec) bool {
+			if spec.ContainerID != id {
+				return false
+			}
+			if spec.Binding == nil && spec.Record != nil {
+				spec.Tombstone = spec.Record.Tombstone(store.StateQuarantined, until)
+			}
+			spec.ContainerID = ""
+			spec.Record = nil
+			spec.Released = now()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Conflict releases the IPs held by the container, and keeps ip used until the mark is removed.
+func (c *CRD) Conflict(id string, ip net.IP) error {
+	claims, err := c.listClaims(containerLabel + "=" + labelValue(id))
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		if claim.ContainerID != id {
+			continue
+		}
+		err = c.modifyClaim(nil, net.ParseIP(claim.IP), func(spec *ClaimSpec) bool {
+			if spec.ContainerID != id {
+				return false
+			}
+			if spec.Record != nil && spec.Record.IP.Equal(ip) {
+				spec.Tombstone = spec.Record.Tombstone(store.StateConflict, time.Time{})
+				spec.Binding = nil
+			}
+			spec.ContainerID = ""
+			spec.Record = nil
+			spec.Released = now()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit commits the pending reservations of the container.
+func (c *CRD) Commit(id string) error {
+	claims, err := c.listClaims(containerLabel + "=" + labelValue(id))
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		if claim.ContainerID != id || claim.Record == nil || !claim.Record.Pending() {
+			continue
+		}
+		err = c.modifyClaim(nil, net.ParseIP(claim.IP), func(spec *ClaimSpec) bool {
+			if spec.ContainerID != id || spec.Record == nil || !spec.Record.Pending() {
+				return false
+			}
+			spec.Record.Commit()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reclaim releases the pending reservations in subnet which are expired,
+// and frees the IPs in subnet whose quarantine is over.
+func (c *CRD) Reclaim(subnet *net.IPNet) error {
+	claims, err := c.listClaims(subnetLabel + "=" + objectName(subnet.String()))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expired := func(spec *ClaimSpec) bool {
+		return (spec.Record != nil && spec.Record.Expired(now)) ||
+			(spec.Tombstone != nil && spec.Tombstone.Expired(now))
+	}
+	for _, claim := range claims {
+		if !expired(claim) {
+			continue
+		}
+		err = c.modifyClaim(nil, net.ParseIP(claim.IP), func(spec *ClaimSpec) bool {
+			// Committed, released or reserved meanwhile.
+			if !expired(spec) {
+				return false
+			}
+			if spec.Record != nil && spec.Record.Expired(now) {
+				spec.ContainerID = ""
+				spec.Record = nil
+				spec.Released = &now
+			}
+			if spec.Tombstone != nil && spec.Tombstone.Expired(now) {
+				spec.Tombstone = nil
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bind binds the IP to the pod.
+func (c *CRD) Bind(namespace string, podName string, ip net.IP) error {
+	subnet := c.RetrieveSubnet(ip)
+	if subnet == nil {
+		return fmt.Errorf("no subnet contains %s found in store", ip.String())
+	}
+	return c.modifyClaim(subnet, ip, func(spec *ClaimSpec) bool {
+		spec.Binding = &Binding{Namespace: namespace, Pod: podName}
+		return true
+	})
+}
+
+// Unbind removes the binding of the IP to the pod.
+func (c *CRD) Unbind(namespace string, podName string, ip net.IP) error {
+	return c.modifyClaim(nil, ip, func(spec *ClaimSpec) bool {
+		if spec.Binding == nil || spec.Binding.Namespace != namespace || spec.Binding.Pod != podName {
+			return false
+		}
+		spec.Binding = nil
+		return true
+	})
+}
+
+// RetrieveGateway retrieves gateway for subnet.
+func (c *CRD) RetrieveGateway(subnet *net.IPNet) net.IP {
+	obj, err := c.client.Resource(Subnets, "").Get(objectName(subnet.String()), metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	spec := &SubnetSpec{}
+	if err = decode(obj, spec); err != nil {
+		return nil
+	}
+	return net.ParseIP(spec.Gateway)
+}
+
+// RetrieveSubnet retrieves the subnet contains ip.
+func (c *CRD) RetrieveSubnet(ip net.IP) *net.IPNet {
+	gms, err := c.AllGatewayMap()
+	if err != nil {
+		return nil
+	}
+	for _, gm := range *gms {
+		_, subnet, err := net.ParseCIDR(gm.Subnet)
+		if err == nil && subnet.Contains(ip) {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// RetrieveAllocated retrieves the IPs in subnet allocated to namespace.
+func (c *CRD) RetrieveAllocated(namespace string, subnet *net.IPNet) (*utils.RangeSet, error) {
+	obj, err := c.client.Resource(Pools, "").Get(namespace, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("no IP allocated for %s found in store", namespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	spec := &PoolSpec{}
+	if err = decode(obj, spec); err != nil {
+		return nil, err
+	}
+	ret := utils.RangeSet{}
+	return ret.Concat(spec.IPs, subnet)
+}
+
+// RetrieveBitmap builds the page of the bitmap of used IPs in subnet from the claims.
+func (c *CRD) RetrieveBitmap(subnet *net.IPNet, page uint64) (*bitmap.Bitmap, error) {
+	claims, err := c.listClaims(subnetLabel + "=" + objectName(subnet.String()))
+	if err != nil {
+		return nil, err
+	}
+	bm := bitmap.New()
+	for _, claim := range claims {
+		if !claim.used() || claim.Subnet != subnet.String() {
+			continue
+		}
+		p, i, err := bitmap.Locate(subnet, net.ParseIP(claim.IP))
+		if err != nil {
+			return nil, err
+		}
+		if p == page {
+			bm.Set(i)
+		}
+	}
+	return bm, nil
+}
+
+// RetrieveHolder retrieves the ID of the container which holds the IP.
+func (c *CRD) RetrieveHolder(subnet *net.IPNet, ip net.IP) (string, error) {
+	obj, err := c.client.Resource(Claims, "").Get(objectName(ip.String()), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	spec := &ClaimSpec{}
+	if err = decode(obj, spec); err != nil {
+		return "", err
+	}
+	if spec.Subnet != subnet.String() {
+		return "", nil
+	}
+	return spec.ContainerID, nil
+}
+
+// RetrieveTombstone retrieves the tombstone of the IP quarantined or in conflict.
+func (c *CRD) RetrieveTombstone(subnet *net.IPNet, ip net.IP) (*store.Record, error) {
+	obj, err := c.client.Resource(Claims, "").Get(objectName(ip.String()), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	spec := &ClaimSpec{}
+	if err = decode(obj, spec); err != nil {
+		return nil, err
+	}
+	if spec.Subnet != subnet.String() {
+		return nil, nil
+	}
+	return spec.Tombstone, nil
+}
+
+// RetrieveBindings retrieves the IPs bound to pods in namespace, keyed by pod name.
+func (c *CRD) RetrieveBindings(namespace string) (map[string][]net.IP, error) {
+	claims, err := c.listClaims(boundLabel + "=" + namespace)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]net.IP)
+	for _, claim := range claims {
+		if claim.Binding != nil && claim.Binding.Namespace == namespace {
+			ret[claim.Binding.Pod] = append(ret[claim.Binding.Pod], net.ParseIP(claim.IP))
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveSubnets retrieves the subnets of the IPs held by the container.
+func (c *CRD) RetrieveSubnets(id string) ([]*net.IPNet, error) {
+	claims, err := c.listClaims(containerLabel + "=" + labelValue(id))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*net.IPNet, 0)
+	for _, claim := range claims {
+		if claim.ContainerID != id {
+			continue
+		}
+		if _, subnet, err := net.ParseCIDR(claim.Subnet); err == nil {
+			ret = append(ret, subnet)
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveReservations retrieves all the reservations.
+func (c *CRD) RetrieveReservations() (map[string][]*store.Record, error) {
+	claims, err := c.listClaims("")
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]*store.Record)
+	for _, claim := range claims {
+		if claim.ContainerID != "" && claim.Record != nil {
+			ret[claim.ContainerID] = append(ret[claim.ContainerID], claim.Record)
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveStrategy retrieves the allocation strategy of the namespace or the subnet.
+func (c *CRD) RetrieveStrategy(namespace string, subnet *net.IPNet) (string, error) {
+	pool := &PoolSpec{}
+	if err := c.get(Pools, namespace, pool); err != nil {
+		return "", err
+	}
+	if pool.Strategy != "" {
+		return pool.Strategy, nil
+	}
+	spec := &SubnetSpec{}
+	err := c.get(Subnets, objectName(subnet.String()), spec)
+	return spec.Strategy, err
+}
+
+// RetrieveQuotas retrieves the quotas of the namespace.
+func (c *CRD) RetrieveQuotas(namespace string) ([]store.QuotaMap, error) {
+	pool := &PoolSpec{}
+	if err := c.get(Pools, namespace, pool); err != nil {
+		return nil, err
+	}
+	return append([]store.QuotaMap{}, pool.Quotas...), nil
+}
+
+// RetrieveUsed retrieves the number of IPs reserved which are counted by the quota. There
+// is no transaction across claims to keep a counter, so the claims of the namespace are
+// selected by label and counted, which are in the subnet only if the quota has one.
+func (c *CRD) RetrieveUsed(qm store.QuotaMap) (int, error) {
+	selector := namespaceLabel + "=" + qm.Namespace
+	if qm.Subnet != "" {
+		selector += "," + subnetLabel + "=" + objectName(qm.Subnet)
+	}
+	claims, err := c.listClaims(selector)
+	if err != nil {
+		return 0, err
+	}
+	used := 0
+	for _, claim := range claims {
+		if claim.ContainerID != "" && claim.Record != nil && qm.Counts(claim.Record) {
+			used++
+		}
+	}
+	return used, nil
+}
+
+// RetrieveLabeledPools retrieves the allocate maps of the namespace with label set.
+func (c *CRD) RetrieveLabeledPools(namespace string) ([]store.AllocateMap, error) {
+	ams, err := c.AllAllocate()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]store.AllocateMap, 0)
+	for _, am := range *ams {
+		if am.Namespace == namespace && am.Label != "" {
+			ret = append(ret, am)
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveCursor retrieves the IP reserved last in subnet.
+func (c *CRD) RetrieveCursor(subnet *net.IPNet) (net.IP, error) {
+	spec := &SubnetSpec{}
+	if err := c.get(Subnets, objectName(subnet.String()), spec); err != nil {
+		return nil, err
+	}
+	return net.ParseIP(spec.Cursor), nil
+}
+
+// RetrieveReleased retrieves when the IPs in subnet were released last.
+func (c *CRD) RetrieveReleased(subnet *net.IPNet) (map[string]time.Time, error) {
+	claims, err := c.listClaims(subnetLabel + "=" + objectName(subnet.String()))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]time.Time)
+	for _, claim := range claims {
+		if claim.Released != nil && claim.Subnet == subnet.String() {
+			ret[claim.IP] = *claim.Released
+		}
+	}
+	return ret, nil
+}
+
+// AllGatewayMap gets all gateway map in the store
+func (c *CRD) AllGatewayMap() (*[]store.GatewayMap, error) {
+	objs, err := c.list(Subnets, "")
+	if err != nil {
+		return nil, err
+	}
+	gms := make([]store.GatewayMap, 0)
+	for i := range objs {
+		spec := &SubnetSpec{}
+		if err = decode(&objs[i], spec); err != nil {
+			return nil, err
+		}
+		gms = append(gms, store.GatewayMap{
+			Subnet:  spec.Subnet,
+			Gateway: spec.Gateway,
+		})
+	}
+	sort.Slice(gms, func(i, j int) bool { return gms[i].Subnet < gms[j].Subnet })
+	return &gms, nil
+}
+
+// InsertGatewayMap inserts a gateway map
+func (c *CRD) InsertGatewayMap(gm store.GatewayMap) error {
+	_, subnet, err := net.ParseCIDR(gm.Subnet)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(gm.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %s", gm.Gateway)
+	}
+	spec := &SubnetSpec{}
+	return c.apply(Subnets, objectName(subnet.String()), spec, true, func() {
+		spec.Subnet = subnet.String()
+		spec.Gateway = gm.Gateway
+	})
+}
+
+// DeleteGatewayMap deletes gateway maps
+func (c *CRD) DeleteGatewayMap(gms []store.GatewayMap) error {
+	for _, gm := range gms {
+		_, subnet, err := net.ParseCIDR(gm.Subnet)
+		if err != nil {
+			return err
+		}
+		if err = c.delete(Subnets, objectName(subnet.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetrieveUsedbyNamespace retrieves the reservations of namespace, or all of them for admin.
+func (c *CRD) RetrieveUsedbyNamespace(namespace string, adminRole bool) (*[]store.Record, error) {
+	claims, err := c.listClaims("")
+	if err != nil {
+		return nil, err
+	}
+	records := make([]store.Record, 0)
+	for _, claim := range claims {
+		if claim.ContainerID == "" || claim.Record == nil {
+			continue
+		}
+		if adminRole || claim.Record.Namespace == namespace {
+			records = append(records, *claim.Record)
+		}
+	}
+	return &records, nil
+}
+
+// AllQuarantined gets the tombstones of the IPs quarantined.
+func (c *CRD) AllQuarantined() (*[]store.Record, error) {
+	return c.allTombstone(store.StateQuarantined)
+}
+
+// AllConflict gets the tombstones of the IPs in conflict.
+func (c *CRD) AllConflict() (*[]store.Record, error) {
+	return c.allTombstone(store.StateConflict)
+}
+
+// allTombstone returns the tombstones in the state given.
+func (c *CRD) allTombstone(state string) (*[]store.Record, error) {
+	claims, err := c.listClaims("")
+	if err != nil {
+		return nil, err
+	}
+	records := make([]store.Record, 0)
+	for _, claim := range claims {
+		if claim.Tombstone != nil && claim.Tombstone.State == state {
+			records = append(records, *claim.Tombstone)
+		}
+	}
+	return &records, nil
+}
+
+// DeleteConflict removes the conflict marks of the IPs.
+func (c *CRD) DeleteConflict(ips []net.IP) error {
+	for _, ip := range ips {
+		err := c.modifyClaim(nil, ip, func(spec *ClaimSpec) bool {
+			if spec.Tombstone == nil || !spec.Tombstone.Conflicted() {
+				return false
+			}
+			spec.Tombstone = nil
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllAllocate gets all allocate map
+func (c *CRD) AllAllocate() (*[]store.AllocateMap, error) {
+	objs, err := c.list(Pools, "")
+	if err != nil {
+		return nil, err
+	}
+	ams := make([]store.AllocateMap, 0)
+	for i := range objs {
+		spec := &PoolSpec{}
+		if err = decode(&objs[i], spec); err != nil {
+			return nil, err
+		}
+		ams = append(ams, store.AllocateMap{
+			Allocate:  spec.IPs,
+			Namespace: spec.Namespace,
+			Label:     spec.Label,
+		})
+	}
+	sort.Slice(ams, func(i, j int) bool { return ams[i].Key() < ams[j].Key() })
+	return &ams, nil
+}
+
+// InsertAllocateMap inserts a allocate map
+func (c *CRD) InsertAllocateMap(am store.AllocateMap) error {
+	if err := am.Validate(); err != nil {
+		return err
+	}
+	spec := &PoolSpec{}
+	return c.apply(Pools, poolName(&am), spec, true, func() {
+		spec.Namespace = am.Namespace
+		spec.Label = am.Label
+		spec.IPs = am.Allocate
+	})
+}
+
+// DeleteAllocateMap deletes allocate maps
+func (c *CRD) DeleteAllocateMap(ams []store.AllocateMap) error {
+	for _, am := range ams {
+		if err := c.delete(Pools, poolName(&am)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllStrategy gets all strategy map
+func (c *CRD) AllStrategy() (*[]store.StrategyMap, error) {
+	sms := make([]store.StrategyMap, 0)
+	subnets, err := c.list(Subnets, "")
+	if err != nil {
+		return nil, err
+	}
+	for i := range subnets {
+		spec := &SubnetSpec{}
+		if err = decode(&subnets[i], spec); err != nil {
+			return nil, err
+		}
+		if spec.Strategy != "" {
+			sms = append(sms, store.StrategyMap{Subnet: spec.Subnet, Strategy: spec.Strategy})
+		}
+	}
+	pools, err := c.list(Pools, "")
+	if err != nil {
+		return nil, err
+	}
+	for i := range pools {
+		spec := &PoolSpec{}
+		if err = decode(&pools[i], spec); err != nil {
+			return nil, err
+		}
+		if spec.Strategy != "" {
+			sms = append(sms, store.StrategyMap{Namespace: spec.Namespace, Strategy: spec.Strategy})
+		}
+	}
+	sort.Slice(sms, func(i, j int) bool { return sms[i].Key() < sms[j].Key() })
+	return &sms, nil
+}
+
+// InsertStrategyMap sets the strategy of the AnchorSubnet or the AnchorPool.
+func (c *CRD) InsertStrategyMap(sm store.StrategyMap) error {
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	found := false
+	if sm.Subnet != "" {
+		spec := &SubnetSpec{}
+		err := c.apply(Subnets, objectName(sm.Subnet), spec, false, func() {
+			spec.Strategy, found = sm.Strategy, true
+		})
+		if err == nil && !found {
+			return fmt.Errorf("no gateway of %s found in store", sm.Subnet)
+		}
+		return err
+	}
+	spec := &PoolSpec{}
+	err := c.apply(Pools, sm.Namespace, spec, false, func() {
+		spec.Strategy, found = sm.Strategy, true
+	})
+	if err == nil && !found {
+		return fmt.Errorf("no IP allocated for %s found in store", sm.Namespace)
+	}
+	return err
+}
+
+// DeleteStrategyMap clears the strategy of the AnchorSubnets or the AnchorPools.
+func (c *CRD) DeleteStrategyMap(sms []store.StrategyMap) error {
+	for _, sm := range sms {
+		var err error
+		if sm.Subnet != "" {
+			spec := &SubnetSpec{}
+			err = c.apply(Subnets, objectName(sm.Subnet), spec, false, func() { spec.Strategy = "" })
+		} else {
+			spec := &PoolSpec{}
+			err = c.apply(Pools, sm.Namespace, spec, false, func() { spec.Strategy = "" })
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllQuota gets all quota map
+func (c *CRD) AllQuota() (*[]store.QuotaMap, error) {
+	qms := make([]store.QuotaMap, 0)
+	pools, err := c.list(Pools, "")
+	if err != nil {
+		return nil, err
+	}
+	for i := range pools {
+		spec := &PoolSpec{}
+		if err = decode(&pools[i], spec); err != nil {
+			return nil, err
+		}
+		qms = append(qms, spec.Quotas...)
+	}
+	sort.Slice(qms, func(i, j int) bool { return qms[i].Key() < qms[j].Key() })
+	return &qms, nil
+}
+
+// InsertQuotaMap adds the quota to the AnchorPool, or replaces the one with the same key.
+func (c *CRD) InsertQuotaMap(qm store.QuotaMap) error {
+	if err := qm.Validate(); err != nil {
+		return err
+	}
+	found := false
+	spec := &PoolSpec{}
+	err := c.apply(Pools, qm.Namespace, spec, false, func() {
+		spec.Quotas, found = append(withoutQuota(spec.Quotas, qm.Key()), qm), true
+	})
+	if err == nil && !found {
+		return fmt.Errorf("no IP allocated for %s found in store", qm.Namespace)
+	}
+	return err
+}
+
+// DeleteQuotaMap removes the quotas from the AnchorPools.
+func (c *CRD) DeleteQuotaMap(qms []store.QuotaMap) error {
+	for _, qm := range qms {
+		spec := &PoolSpec{}
+		err := c.apply(Pools, qm.Namespace, spec, false, func() {
+			spec.Quotas = withoutQuota(spec.Quotas, qm.Key())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withoutQuota returns the quotas except the one of key.
+func withoutQuota(qms []store.QuotaMap, key string) []store.QuotaMap {
+	ret := make([]store.QuotaMap, 0, len(qms))
+	for _, qm := range qms {
+		if qm.Key() != key {
+			ret = append(ret, qm)
+		}
+	}
+	return ret
+}
+
+// AllBinding gets all binding map
+func (c *CRD) AllBinding() (*[]store.BindingMap, error) {
+	claims, err := c.listClaims(boundLabel)
+	if err != nil {
+		return nil, err
+	}
+	bms := make([]store.BindingMap, 0)
+	for _, claim := range claims {
+		if claim.Binding == nil {
+			continue
+		}
+		bms = append(bms, store.BindingMap{
+			IP:        claim.IP,
+			Pod:       claim.Binding.Pod,
+			Namespace: claim.Binding.Namespace,
+		})
+	}
+	sort.Slice(bms, func(i, j int) bool { return bms[i].IP < bms[j].IP })
+	return &bms, nil
+}
+
+// DeleteBindingMap deletes binding maps, then the IPs could be used by other pods.
+func (c *CRD) DeleteBindingMap(bms []store.BindingMap) error {
+	for _, bm := range bms {
+		ip := net.ParseIP(bm.IP)
+		if ip == nil {
+			return fmt.Errorf("invalid IP %s", bm.IP)
+		}
+		if err := c.Unbind(bm.Namespace, bm.Pod, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modifyClaim reads the claim of ip, modifies and writes it back, and starts over on conflicts.
+// modify returns false if nothing changed. The claim is created in subnet if not found,
+// and nothing is done if subnet is nil.
+func (c *CRD) modifyClaim(subnet *net.IPNet, ip net.IP, modify func(spec *ClaimSpec) bool) error {
+	claims := c.client.Resource(Claims, "")
+	name := objectName(ip.String())
+	for i := 0; i < maxRetries; i++ {
+		obj, err := claims.Get(name, metav1.GetOptions{})
+		spec := &ClaimSpec{}
+		switch {
+		case apierrors.IsNotFound(err):
+			if subnet == nil {
+				return nil
+			}
+			spec.IP, spec.Subnet = ip.String(), subnet.String()
+			if !modify(spec) {
+				return nil
+			}
+			if obj, err = newObject(Claims, name, spec); err != nil {
+				return err
+			}
+			obj.SetLabels(spec.labels())
+			_, err = claims.Create(obj)
+			if apierrors.IsAlreadyExists(err) {
+				// Created by others, start over.
+				continue
+			}
+			return err
+		case err != nil:
+			return err
+		}
+
+		if err = decode(obj, spec); err != nil {
+			return err
+		}
+		if !modify(spec) {
+			return nil
+		}
+		if err = encode(obj, spec); err != nil {
+			return err
+		}
+		obj.SetLabels(spec.labels())
+		// The resourceVersion read is sent back, the update fails if the claim is changed by others.
+		_, err = claims.Update(obj)
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("too many conflicts on claim of %s", ip.String())
+}
+
+// apply reads the object into spec, modifies and writes it back, and starts over on conflicts.
+// The object is created with the spec modified if not found and create is true, otherwise
+// nothing is done.
+func (c *CRD) apply(resource *metav1.APIResource, name string, spec interface{}, create bool, modify func()) error {
+	client := c.client.Resource(resource, "")
+	for i := 0; i < maxRetries; i++ {
+		// Start from the zero value, so nothing is left by the last try.
+		reflect.ValueOf(spec).Elem().Set(reflect.Zero(reflect.TypeOf(spec).Elem()))
+		obj, err := client.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if !create {
+				return nil
+			}
+			modify()
+			if obj, err = newObject(resource, name, spec); err != nil {
+				return err
+			}
+			if _, err = client.Create(obj); apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if err = decode(obj, spec); err != nil {
+			return err
+		}
+		modify()
+		if err = encode(obj, spec); err != nil {
+			return err
+		}
+		if _, err = client.Update(obj); apierrors.IsConflict(err) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("too many conflicts on %s %s", resource.Kind, name)
+}
+
+// get gets the object into spec, which is left untouched if the object is not found.
+func (c *CRD) get(resource *metav1.APIResource, name string, spec interface{}) error {
+	obj, err := c.client.Resource(resource, "").Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return decode(obj, spec)
+}
+
+// delete deletes the object, it is not an error if the object is not found.
+func (c *CRD) delete(resource *metav1.APIResource, name string) error {
+	err := c.client.Resource(resource, "").Delete(name, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// list lists the objects of resource selected by the label selector.
+func (c *CRD) list(resource *metav1.APIResource, selector string) ([]unstructured.Unstructured, error) {
+	obj, err := c.client.Resource(resource, "").List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list of %s", resource.Kind)
+	}
+	return list.Items, nil
+}
+
+// listClaims lists the specs of claims selected by the label selector.
+func (c *CRD) listClaims(selector string) ([]*ClaimSpec, error) {
+	objs, err := c.list(Claims, selector)
+	if err != nil {
+		return nil, err
+	}
+	claims := make([]*ClaimSpec, 0, len(objs))
+	for i := range objs {
+		spec := &ClaimSpec{}
+		if err = decode(&objs[i], spec); err != nil {
+			return nil, err
+		}
+		claims = append(claims, spec)
+	}
+	return claims, nil
+}
+
+// newObject news an object of resource with the spec.
+func newObject(resource *metav1.APIResource, name string, spec interface{}) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{Object: make(map[string]interface{})}
+	obj.SetAPIVersion(GroupVersion.String())
+	obj.SetKind(resource.Kind)
+	obj.SetName(name)
+	if err := encode(obj, spec); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// encode sets the spec of the object.
+func encode(obj *unstructured.Unstructured, spec interface{}) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	content := make(map[string]interface{})
+	if err = json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	obj.Object["spec"] = content
+	return nil
+}
+
+// decode gets the spec of the object.
+func decode(obj *unstructured.Unstructured, spec interface{}) error {
+	data, err := json.Marshal(obj.Object["spec"])
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, spec); err != nil {
+		return fmt.Errorf("invalid spec of %s %s: %v", obj.GetKind(), obj.GetName(), err)
+	}
+	return nil
+}
+
+// now returns the current time for the fields of specs.
+func now() *time.Time {
+	t := time.Now()
+	return &t
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package crd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/store/storetest"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// apiServer keeps objects for the fake client, and checks resourceVersion on updates
+// as the API server does.
+type apiServer struct {
+	version int
+	objects map[string]map[string]*unstructured.Unstructured
+}
+
+func (s *apiServer) react(action k8stesting.Action) (bool, runtime.Object, error) {
+	resource := action.GetResource().GroupResource()
+	objects, ok := s.objects[resource.Resource]
+	if !ok {
+		objects = make(map[string]*unstructured.Unstructured)
+		s.objects[resource.Resource] = objects
+	}
+
+	switch action.GetVerb() {
+	case "get":
+		name := action.(k8stesting.GetAction).GetName()
+		obj, ok := objects[name]
+		if !ok {
+			return true, nil, apierrors.NewNotFound(resource, name)
+		}
+		return true, obj.DeepCopy(), nil
+	case "list":
+		list := &unstructured.UnstructuredList{}
+		for _, obj := range objects {
+			list.Items = append(list.Items, *obj.DeepCopy())
+		}
+		return true, list, nil
+	case "create":
+		obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		if _, ok := objects[obj.GetName()]; ok {
+			return true, nil, apierrors.NewAlreadyExists(resource, obj.GetName())
+		}
+		s.version++
+		obj.SetResourceVersion(strconv.Itoa(s.version))
+		obj.SetUID(types.UID(obj.GetName()))
+		objects[obj.GetName()] = obj
+		return true, obj.DeepCopy(), nil
+	case "update":
+		obj := action.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		old, ok := objects[obj.GetName()]
+		if !ok {
+			return true, nil, apierrors.NewNotFound(resource, obj.GetName())
+		}
+		if old.GetResourceVersion() != obj.GetResourceVersion() {
+			return true, nil, apierrors.NewConflict(resource, obj.GetName(), fmt.Errorf("object has been modified"))
+		}
+		s.version++
+		obj.SetResourceVersion(strconv.Itoa(s.version))
+		objects[obj.GetName()] = obj
+		return true, obj.DeepCopy(), nil
+	case "delete":
+		name := action.(k8stesting.DeleteAction).GetName()
+		if _, ok := objects[name]; !ok {
+			return true, nil, apierrors.NewNotFound(resource, name)
+		}
+		delete(objects, name)
+		return true, nil, nil
+	}
+	return false, nil, nil
+}
+
+// newFakeClient returns a fake client backed by an empty apiServer.
+func newFakeClient() *fake.FakeClient {
+	server := &apiServer{objects: make(map[string]map[string]*unstructured.Unstructured)}
+	client := &fake.FakeClient{GroupVersion: GroupVersion, Fake: &k8stesting.Fake{}}
+	client.AddReactor("*", "*", server.react)
+	return client
+}
+
+// newFakeCRD returns a store backed by a fake client, with the subnet 10.0.1.0/24.
+func newFakeCRD(t *testing.T) *CRD {
+	c := NewCRD(newFakeClient())
+	if err := c.InsertGatewayMap(store.GatewayMap{Subnet: "10.0.1.0/24", Gateway: "10.0.1.1"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	return c
+}
+
+func record(ip string) *store.Record {
+	return &store.Record{
+		IP:        net.ParseIP(ip),
+		Subnet:    "10.0.1.0/24",
+		Pod:       "pod",
+		Namespace: "default",
+	}
+}
+
+func Test_Reserve(t *testing.T) {
+	c := newFakeCRD(t)
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+
+	for _, tc := range []struct {
+		id       string
+		ip       string
+		reserved bool
+	}{
+		{"a", "10.0.1.2", true},
+		{"a", "10.0.1.2", true},
+		{"b", "10.0.1.2", false},
+		{"b", "10.0.1.3", true},
+	} {
+		reserved, err := c.Reserve(tc.id, record(tc.ip))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if reserved != tc.reserved {
+			t.Fatalf("expected reserved of %s by %s to be %v", tc.ip, tc.id, tc.reserved)
+		}
+	}
+	if holder, _ := c.RetrieveHolder(subnet, net.ParseIP("10.0.1.2")); holder != "a" {
+		t.Fatalf("expected 10.0.1.2 held by a, got %q", holder)
+	}
+
+	if err := c.Release("a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	bm, err := c.RetrieveBitmap(subnet, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bm.Test(2) || !bm.Test(3) {
+		t.Fatal("expected only 10.0.1.3 used after release")
+	}
+	// The claim released is reused.
+	if reserved, _ := c.Reserve("c", record("10.0.1.2")); !reserved {
+		t.Fatal("expected 10.0.1.2 reserved after release")
+	}
+	reservations, _ := c.RetrieveReservations()
+	if len(reservations) != 2 || len(reservations["b"]) != 1 || len(reservations["c"]) != 1 {
+		t.Fatalf("unexpected reservations %v", reservations)
+	}
+}
+
+func Test_ReserveCursorFailed(t *testing.T) {
+	client := newFakeClient()
+	c := NewCRD(client)
+	if err := c.InsertGatewayMap(store.GatewayMap{Subnet: "10.0.1.0/24", Gateway: "10.0.1.1"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	client.PrependReactor("update", Subnets.Name, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("unavailable")
+	})
+
+	// The claim is kept though the cursor is not.
+	reserved, err := c.Reserve("a", record("10.0.1.2"))
+	if err != nil || !reserved {
+		t.Fatalf("expected 10.0.1.2 reserved, got %v, %v", reserved, err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	if holder, _ := c.RetrieveHolder(subnet, net.ParseIP("10.0.1.2")); holder != "a" {
+		t.Fatalf("expected 10.0.1.2 held by a, got %q", holder)
+	}
+}
+
+func Test_ReserveConcurrently(t *testing.T) {
+	c := newFakeCRD(t)
+	var wg sync.WaitGroup
+	var guard sync.Mutex
+	winners := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			reserved, err := c.Reserve(id, record("10.0.1.2"))
+			if err != nil {
+				t.Error(err.Error())
+			}
+			if reserved {
+				guard.Lock()
+				winners++
+				guard.Unlock()
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("expected the IP reserved by exactly one container, got %d", winners)
+	}
+}
+
+func Test_Bind(t *testing.T) {
+	c := newFakeCRD(t)
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	ip := net.ParseIP("10.0.1.2")
+	if _, err := c.Reserve("a", record("10.0.1.2")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.Bind("default", "web-0", ip); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.Release("a"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The IP bound is kept used after release.
+	bm, _ := c.RetrieveBitmap(subnet, 0)
+	if _, i, _ := bitmap.Locate(subnet, ip); !bm.Test(i) {
+		t.Fatal("expected the IP bound kept used")
+	}
+	bindings, _ := c.RetrieveBindings("default")
+	if len(bindings["web-0"]) != 1 || !bindings["web-0"][0].Equal(ip) {
+		t.Fatalf("unexpected bindings %v", bindings)
+	}
+
+	if err := c.DeleteBindingMap([]store.BindingMap{{IP: "10.0.1.2", Pod: "web-0", Namespace: "default"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bm, _ = c.RetrieveBitmap(subnet, 0); bm.Test(2) {
+		t.Fatal("expected the IP free after unbound")
+	}
+}
+
+func Test_Conformance(t *testing.T) {
+	storetest.Suite{
+		New: func(t *testing.T) storetest.Backend { return NewCRD(newFakeClient()) },
+	}.Run(t)
+}
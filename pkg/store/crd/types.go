@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package crd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/hainesc/anchor/pkg/store"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupVersion is the group and version of the custom resources of anchor,
+// see deployment/crd.yaml for the definitions.
+var GroupVersion = schema.GroupVersion{Group: "cni.anchor.org", Version: "v1alpha1"}
+
+// The custom resources, all of them are cluster scoped.
+var (
+	// Subnets is the resource of AnchorSubnet, one per subnet with its gateway.
+	Subnets = &metav1.APIResource{Name: "anchorsubnets", Kind: "AnchorSubnet"}
+	// Pools is the resource of AnchorPool, one per namespace with the IPs allocated to it.
+	Pools = &metav1.APIResource{Name: "anchorpools", Kind: "AnchorPool"}
+	// Claims is the resource of AnchorIPClaim, one per IP ever reserved or bound.
+	Claims = &metav1.APIResource{Name: "anchoripclaims", Kind: "AnchorIPClaim"}
+	// NodeNetworks is the resource of AnchorNodeNetwork, the network of nodes read by
+	// anchor-agent rather than the store, see agent.NodeNetworkSpec.
+	NodeNetworks = &metav1.APIResource{Name: "anchornodenetworks", Kind: "AnchorNodeNetwork"}
+)
+
+// Labels of claims, used to select claims without listing them all.
+const (
+	subnetLabel    = "cni.anchor.org/subnet"
+	containerLabel = "cni.anchor.org/container"
+	boundLabel     = "cni.anchor.org/bound"
+	// namespaceLabel is the namespace of the pod holding the IP, which selects the claims
+	// counted by the quotas of the namespace.
+	namespaceLabel = "cni.anchor.org/namespace"
+)
+
+// SubnetSpec is the spec of AnchorSubnet.
+type SubnetSpec struct {
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway"`
+	// Strategy is the allocation strategy of the subnet, see store.Strategies.
+	Strategy string `json:"strategy,omitempty"`
+	// Cursor is the IP reserved last in the subnet.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// PoolSpec is the spec of AnchorPool.
+type PoolSpec struct {
+	Namespace string `json:"namespace"`
+	// Label is the label selector of the pods using the pool, see store.AllocateMap.
+	Label string `json:"label,omitempty"`
+	// IPs is in the same format as the allocate map, such as 10.0.1.[2-9],10.0.1.20
+	IPs string `json:"ips"`
+	// Strategy is the allocation strategy of the namespace, see store.Strategies.
+	Strategy string `json:"strategy,omitempty"`
+	// Quotas are the quotas of the namespace, at most one for each store.QuotaMap.Key.
+	Quotas []store.QuotaMap `json:"quotas,omitempty"`
+}
+
+// ClaimSpec is the spec of AnchorIPClaim. The claim is free if it is neither held by
+// a container, bound to a pod nor quarantined, and it is kept for the next reservation.
+type ClaimSpec struct {
+	IP     string `json:"ip"`
+	Subnet string `json:"subnet"`
+	// ContainerID is the container which holds the IP, empty if not held.
+	ContainerID string        `json:"containerID,omitempty"`
+	Record      *store.Record `json:"record,omitempty"`
+	// Binding is the pod which the IP is bound to, nil if not bound.
+	Binding *Binding `json:"binding,omitempty"`
+	// Tombstone is the last reservation of the IP quarantined or in conflict, nil if neither.
+	Tombstone *store.Record `json:"tombstone,omitempty"`
+	// Released is when the IP was released last.
+	Released *time.Time `json:"released,omitempty"`
+}
+
+// Binding binds an IP to a pod.
+type Binding struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+}
+
+// used returns true if the IP of the claim could not be allocated.
+func (c *ClaimSpec) used() bool {
+	return c.ContainerID != "" || c.Binding != nil || c.Tombstone != nil
+}
+
+// labels returns the labels of the claim.
+func (c *ClaimSpec) labels() map[string]string {
+	labels := map[string]string{subnetLabel: objectName(c.Subnet)}
+	if c.ContainerID != "" {
+		labels[containerLabel] = labelValue(c.ContainerID)
+		if c.Record != nil {
+			labels[namespaceLabel] = c.Record.Namespace
+		}
+	}
+	if c.Binding != nil {
+		labels[boundLabel] = c.Binding.Namespace
+	}
+	return labels
+}
+
+// objectName converts subnet or IP to the name of object, which must not contain ':' or '/'.
+func objectName(s string) string {
+	return strings.NewReplacer(":", "-", "/", "-").Replace(s)
+}
+
+// poolName returns the name of the AnchorPool of the allocate map. The pool without
+// label is named after the namespace, and the hash of the label is appended otherwise,
+// since the label selector is not a valid name.
+func poolName(am *store.AllocateMap) string {
+	if am.Label == "" {
+		return am.Namespace
+	}
+	h := fnv.New32a()
+	h.Write([]byte(am.Label))
+	return fmt.Sprintf("%s-%08x", am.Namespace, h.Sum32())
+}
+
+// labelValue truncates s to the max length of label values, the value is used
+// to select objects, which should be checked again after selected.
+func labelValue(s string) string {
+	if len(s) > 63 {
+		return s[:63]
+	}
+	return s
+}
@@ -10,13 +10,18 @@ package etcd
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
 	"github.com/hainesc/anchor/pkg/store"
 	"github.com/hainesc/anchor/pkg/utils"
 )
@@ -25,18 +30,52 @@ const (
 	ipsPrefix     = "/anchor/cn/"
 	gatewayPrefix = "/anchor/gw/"
 	userPrefix    = "/anchor/ns/"
-	lockKey       = "/anchor/lock"
+	stickyPrefix  = "/anchor/st/"
+	bitmapPrefix  = "/anchor/bm/"
+	indexPrefix   = "/anchor/ip/"
+	lockPrefix    = "/anchor/lock/"
+	// Keys of pending reservations, the values are the IDs of the containers. They are
+	// attached to the leases along with the index, so the IPs are free once the leases expire.
+	pendingPrefix = "/anchor/pd/"
+	// Keys of the pending reservations to reclaim, in format of reclaimPrefix/subnet/ip/id.
+	// They are not attached to the leases, so Reclaim finds what the leases expired leave.
+	reclaimPrefix = "/anchor/rc/"
+	// Keys of the tombstones of IPs quarantined or in conflict, see store.StateQuarantined.
+	quarantinePrefix = "/anchor/qt/"
+	// Keys of the allocation strategies of subnets and namespaces.
+	strategyPrefix = "/anchor/sg/"
+	// Keys of the IPs reserved last in subnets.
+	cursorPrefix = "/anchor/cs/"
+	// Keys of when the IPs were released last.
+	releasedPrefix = "/anchor/rl/"
+	// Keys of the quotas of namespaces, see store.QuotaMap.Key. The values are in JSON.
+	quotaPrefix = "/anchor/qa/"
+	// Keys of the IPs counted by quotas, in format of usedPrefix/quota#subnet/ip, see
+	// usedKeys. The IPs are counted by the keys, which are kept along with the index.
+	usedPrefix = "/anchor/us/"
+	// Key of the version of the records which all reservations are migrated to, see Migrate.
+	migratedKey = "/anchor/migrated"
 )
 
 // Etcd is a simple etcd-backed store
 type Etcd struct {
-	mutex *concurrency.Mutex
-	kv    clientv3.KV
+	session *concurrency.Session
+	kv      clientv3.KV
+	// mutexes held by this client, keyed by subnet.
+	mutexes map[string]*concurrency.Mutex
+	guard   sync.Mutex
+	// indexed is set once the IPs held by the reservations of the early versions are
+	// indexed, see indexLegacy.
+	indexed   bool
+	indexLock sync.Mutex
 }
 
 // Store implements the Store interface
 var _ store.Store = &Etcd{}
 
+// Monkey implements the Monkey interface
+var _ store.Monkey = &Etcd{}
+
 // NewEtcdClient news a etcd client
 func NewEtcdClient(network string, endPoints []string, tlsConfig *tls.Config) (*Etcd, error) {
 	// We don't check the config here since clientv3 will do.
@@ -48,15 +87,7 @@ func NewEtcdClient(network string, endPoints []string, tlsConfig *tls.Config) (*
 	if err != nil {
 		return nil, err
 	}
-
-	session, err := concurrency.NewSession(cli)
-	if err != nil {
-		return nil, err
-	}
-
-	mutex := concurrency.NewMutex(session, lockKey)
-	kv := clientv3.NewKV(cli)
-	return &Etcd{mutex, kv}, nil
+	return newEtcd(cli)
 }
 
 // NewEtcdClientWithoutSSl news a etcd client without ssl
@@ -69,45 +100,95 @@ func NewEtcdClientWithoutSSl(network string, endPoints []string) (*Etcd, error)
 	if err != nil {
 		return nil, err
 	}
+	return newEtcd(cli)
+}
 
+func newEtcd(cli *clientv3.Client) (*Etcd, error) {
+	// Locks are attached to the lease of the session,
+	// so they are released when the plugin exits abnormally and the lease expires.
 	session, err := concurrency.NewSession(cli)
 	if err != nil {
+		cli.Close()
 		return nil, err
 	}
 
-	mutex := concurrency.NewMutex(session, lockKey)
-	kv := clientv3.NewKV(cli)
-	return &Etcd{mutex, kv}, nil
+	return &Etcd{
+		session: session,
+		kv:      clientv3.NewKV(cli),
+		mutexes: make(map[string]*concurrency.Mutex),
+	}, nil
 }
 
-// Lock locks the store
-func (e *Etcd) Lock() error {
-	return e.mutex.Lock(context.TODO())
+// Lock locks the subnet, it gives up when ctx is done.
+func (e *Etcd) Lock(ctx context.Context, subnet *net.IPNet) error {
+	m := concurrency.NewMutex(e.session, lockPrefix+subnet.String())
+	if err := m.Lock(ctx); err != nil {
+		return err
+	}
+	e.guard.Lock()
+	defer e.guard.Unlock()
+	e.mutexes[subnet.String()] = m
+	return nil
 }
 
-// Unlock unlocks the store
-func (e *Etcd) Unlock() error {
-	return e.mutex.Unlock(context.TODO())
+// Unlock unlocks the subnet
+func (e *Etcd) Unlock(subnet *net.IPNet) error {
+	e.guard.Lock()
+	m := e.mutexes[subnet.String()]
+	delete(e.mutexes, subnet.String())
+	e.guard.Unlock()
+	if m == nil {
+		return fmt.Errorf("subnet %s is not locked", subnet.String())
+	}
+	return m.Unlock(context.TODO())
 }
 
-// Close closes the store
+// Close closes the store, locks not unlocked are released.
 func (e *Etcd) Close() error {
-	return nil
-	// return s.Unlock()
+	cli := e.session.Client()
+	e.session.Close()
+	return cli.Close()
+}
+
+// Status returns error if etcd is unreachable.
+func (e *Etcd) Status() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := e.kv.Get(ctx, gatewayPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	return err
 }
 
 // RetrieveGateway retrieves gateway for subnet.
 func (e *Etcd) RetrieveGateway(subnet *net.IPNet) net.IP {
-	resp, err := e.kv.Get(context.TODO(), gatewayPrefix + subnet.String())
+	resp, err := e.kv.Get(context.TODO(), gatewayPrefix+subnet.String())
 	if err != nil || len(resp.Kvs) == 0 {
 		return nil
 	}
 	return net.ParseIP(string(resp.Kvs[0].Value))
 }
 
+// RetrieveSubnet retrieves the subnet which contains ip from the gateway map.
+func (e *Etcd) RetrieveSubnet(ip net.IP) *net.IPNet {
+	resp, err := e.kv.Get(context.TODO(), gatewayPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil
+	}
+	for _, item := range resp.Kvs {
+		_, subnet, err := net.ParseCIDR(strings.TrimPrefix(string(item.Key), gatewayPrefix))
+		if err != nil {
+			// ivalid format, just omit.
+			continue
+		}
+		if subnet.Contains(ip) {
+			return subnet
+		}
+	}
+	return nil
+}
+
 // RetrieveAllocated retrieves allocated IPs in subnet for namespace.
 func (e *Etcd) RetrieveAllocated(namespace string, subnet *net.IPNet) (*utils.RangeSet, error) {
-	resp, err := e.kv.Get(context.TODO(), userPrefix + namespace)
+	resp, err := e.kv.Get(context.TODO(), userPrefix+namespace)
 	if err != nil {
 		return nil, err
 	}
@@ -120,71 +201,883 @@ func (e *Etcd) RetrieveAllocated(namespace string, subnet *net.IPNet) (*utils.Ra
 
 }
 
-// RetrieveUsed retrieves used IP in subnet for namespace.
-func (e *Etcd) RetrieveUsed(namespace string, subnet *net.IPNet) (*utils.RangeSet, error) {
+// RetrieveBitmap retrieves the page of the bitmap of used IPs in subnet.
+func (e *Etcd) RetrieveBitmap(subnet *net.IPNet, page uint64) (*bitmap.Bitmap, error) {
+	bm, _, err := e.retrievePage(subnet, page)
+	return bm, err
+}
+
+// retrievePage retrieves the page of the bitmap and its revision.
+// The page is built from the reservations and the bindings if it is never written,
+// which happens on the first use of the page or the upgrade from early versions.
+func (e *Etcd) retrievePage(subnet *net.IPNet, page uint64) (*bitmap.Bitmap, int64, error) {
+	key := bitmapKey(subnet, page)
+	for {
+		resp, err := e.kv.Get(context.TODO(), key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(resp.Kvs) != 0 {
+			bm, err := bitmap.FromBytes(resp.Kvs[0].Value)
+			return bm, resp.Kvs[0].ModRevision, err
+		}
+
+		bm, err := e.buildPage(subnet, page)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Someone else may build it at the same time, so write it only if still missing,
+		// and read it again for the revision.
+		if _, err = e.kv.Txn(context.TODO()).If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+		).Then(
+			clientv3.OpPut(key, string(bm.Bytes())),
+		).Commit(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// buildPage builds the page of the bitmap from the reservations and the bindings.
+func (e *Etcd) buildPage(subnet *net.IPNet, page uint64) (*bitmap.Bitmap, error) {
+	bm := bitmap.New()
+	used := make([]net.IP, 0)
 	resp, err := e.kv.Get(context.TODO(), ipsPrefix, clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
 	}
-	// TODO: which return type is best? []string or RangeSet?
-	// ret := make([]net.IP, 0)
-	s := make([]string, 0)
 	for _, item := range resp.Kvs {
-		row := strings.Split(string(item.Value), ",")
-		if row[2] == namespace {
-			// ret = append(ret, net.ParseIP(row[0]))
-			s = append(s, row[0])
+		if r, err := store.ParseRecord(item.Value); err == nil {
+			used = append(used, r.IP)
 		}
 	}
-	ret := utils.RangeSet{}
-	// TODO:
-	return ret.Concat(strings.Join(s, ","), subnet)
+	// IPs bound to pods are used even if the pods are gone.
+	resp, err = e.kv.Get(context.TODO(), stickyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range resp.Kvs {
+		used = append(used, net.ParseIP(string(item.Value)))
+	}
+	// So are IPs quarantined.
+	resp, err = e.kv.Get(context.TODO(), quarantinePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range resp.Kvs {
+		if t, err := store.ParseRecord(item.Value); err == nil {
+			used = append(used, t.IP)
+		}
+	}
+	for _, ip := range used {
+		if ip == nil {
+			// ivalid format, just omit.
+			continue
+		}
+		if p, i, err := bitmap.Locate(subnet, ip); err == nil && p == page {
+			bm.Set(i)
+		}
+	}
+	return bm, nil
+}
+
+// commitPage commits ops in a transaction together with the page of ip updated by update.
+// The transaction is retried if the page is changed by others meanwhile, and false is
+// returned if any of cmps is not satisfied.
+func (e *Etcd) commitPage(subnet *net.IPNet, ip net.IP, update func(bm *bitmap.Bitmap, i uint32),
+	cmps []clientv3.Cmp, ops ...clientv3.Op) (bool, error) {
+	page, i, err := bitmap.Locate(subnet, ip)
+	if err != nil {
+		return false, err
+	}
+	key := bitmapKey(subnet, page)
+	for {
+		bm, rev, err := e.retrievePage(subnet, page)
+		if err != nil {
+			return false, err
+		}
+		update(bm, i)
+		resp, err := e.kv.Txn(context.TODO()).If(
+			append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", rev))...,
+		).Then(
+			append(ops, clientv3.OpPut(key, string(bm.Bytes())))...,
+		).Else(
+			clientv3.OpGet(key),
+		).Commit()
+		if err != nil {
+			return false, err
+		}
+		if resp.Succeeded {
+			return true, nil
+		}
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) != 0 && kvs[0].ModRevision == rev {
+			// The page is not changed, so it is one of cmps that failed.
+			return false, nil
+		}
+	}
+}
+
+// bitmapKey returns the key of the page of bitmap.
+func bitmapKey(subnet *net.IPNet, page uint64) string {
+	return bitmapPrefix + subnet.String() + "/" + strconv.FormatUint(page, 10)
+}
+
+// indexKey returns the key which maps the IP to the container holding it.
+func indexKey(subnet *net.IPNet, ip net.IP) string {
+	return indexPrefix + subnet.String() + "/" + ip.String()
+}
+
+// usedKeys returns the keys of the IP reserved by r, one for each quota which could
+// count it. Namespaces, subnets and controllers never contain '#', which separates the
+// key of the quota from the IP, so the key of the namespace is not a prefix of the others.
+func usedKeys(subnet *net.IPNet, r *store.Record) []string {
+	// The records of the early versions have no subnet.
+	counted := *r
+	counted.Subnet = subnet.String()
+	keys := store.QuotaKeys(&counted)
+	for i, key := range keys {
+		keys[i] = usedPrefix + key + "#" + subnet.String() + "/" + r.IP.String()
+	}
+	return keys
+}
+
+// RetrieveHolder retrieves the ID of the container which holds the IP.
+func (e *Etcd) RetrieveHolder(subnet *net.IPNet, ip net.IP) (string, error) {
+	if err := e.indexLegacy(); err != nil {
+		return "", err
+	}
+	resp, err := e.kv.Get(context.TODO(), indexKey(subnet, ip))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) != 0 {
+		return string(resp.Kvs[0].Value), nil
+	}
+	return "", nil
 }
 
-// Reserve writes the result to the store.
-func (e *Etcd) Reserve(id string, ip net.IP, podName string, podNamespace string, controllerName string) (bool, error) {
-	// TODO: lock
-	if _, err := e.kv.Put(context.TODO(), ipsPrefix + id,
-		ip.String() + "," + podName + "," + podNamespace + "," + controllerName); err != nil {
-		return false, nil
+// RetrieveTombstone retrieves the tombstone of the IP quarantined or in conflict.
+func (e *Etcd) RetrieveTombstone(subnet *net.IPNet, ip net.IP) (*store.Record, error) {
+	resp, err := e.kv.Get(context.TODO(), quarantineKey(subnet, ip))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
 	}
+	return store.ParseRecord(resp.Kvs[0].Value)
+}
 
-	return true, nil
+// containerID returns the ID of the container from the key of a reservation.
+func containerID(key string) string {
+	return strings.SplitN(strings.TrimPrefix(key, ipsPrefix), "/", 2)[0]
 }
 
-// Release releases the IP which allocated to the container identified by id.
+// Reserve writes the record to the store, and marks the IP as used in the bitmap.
+// It succeeds only if the IP is not held by another container, which is guaranteed
+// by a transaction on the index of the IP, so it is safe even without the lock.
+func (e *Etcd) Reserve(id string, r *store.Record) (bool, error) {
+	subnet, ip := r.SubnetNet(), r.IP
+	if subnet == nil {
+		return false, fmt.Errorf("invalid subnet %s of record", r.Subnet)
+	}
+	if err := e.indexLegacy(); err != nil {
+		return false, err
+	}
+	if r.Created.IsZero() {
+		r.Created = time.Now()
+	}
+	r.Updated = r.Created
+	value, err := r.Marshal()
+	if err != nil {
+		return false, err
+	}
+
+	key := indexKey(subnet, ip)
+	var lease *clientv3.LeaseGrantResponse
+	var opts []clientv3.OpOption
+	if r.Pending() {
+		// The index is deleted once the lease expires, so the IP could be reserved again at
+		// once. The rest is reclaimed by Reclaim, which is called by the next allocation in
+		// the subnet, or by GC.
+		ttl := int64(time.Until(r.Expires)/time.Second) + 1
+		if lease, err = e.session.Client().Grant(context.TODO(), ttl); err != nil {
+			return false, err
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+	// A container may hold an IPv4 and an IPv6 address, so the IP is a part of the key.
+	ops := []clientv3.Op{
+		clientv3.OpPut(key, id, opts...),
+		clientv3.OpPut(ipsPrefix+id+"/"+ip.String(), string(value)),
+		clientv3.OpDelete(quarantineKey(subnet, ip)),
+		clientv3.OpPut(cursorPrefix+subnet.String(), ip.String()),
+	}
+	for _, used := range usedKeys(subnet, r) {
+		ops = append(ops, clientv3.OpPut(used, id))
+	}
+	if lease != nil {
+		ops = append(ops,
+			clientv3.OpPut(pendingKey(subnet, ip), id, opts...),
+			clientv3.OpPut(reclaimKey(subnet, ip, id), ""))
+	}
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(key), "=", 0)}
+	reserved, err := e.commitPage(subnet, ip, (*bitmap.Bitmap).Set, cmps, ops...)
+	if err == nil && !reserved {
+		var stale bool
+		if stale, err = e.deleteStaleIndex(subnet, ip); stale {
+			reserved, err = e.commitPage(subnet, ip, (*bitmap.Bitmap).Set, cmps, ops...)
+		}
+	}
+	if lease != nil && !reserved {
+		e.session.Client().Revoke(context.TODO(), lease.ID)
+	}
+	if err != nil || reserved {
+		return reserved, err
+	}
+
+	// The same container may be added again.
+	holder, err := e.RetrieveHolder(subnet, ip)
+	if err != nil {
+		return false, err
+	}
+	return holder == id, nil
+}
+
+// deleteStaleIndex deletes the index of the IP if the reservation is gone, which happens
+// when the reservation of the early versions indexed by indexLegacy is released by the
+// anchors not upgraded yet. It returns true if the index is deleted.
+func (e *Etcd) deleteStaleIndex(subnet *net.IPNet, ip net.IP) (bool, error) {
+	index := indexKey(subnet, ip)
+	resp, err := e.kv.Get(context.TODO(), index)
+	if err != nil || len(resp.Kvs) == 0 {
+		return false, err
+	}
+	holder := string(resp.Kvs[0].Value)
+	kvs, err := e.reservations(holder)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range kvs {
+		if r, err := store.ParseRecord(item.Value); err != nil || r.IP.Equal(ip) {
+			return false, nil
+		}
+	}
+	txn, err := e.kv.Txn(context.TODO()).If(
+		clientv3.Compare(clientv3.ModRevision(index), "=", resp.Kvs[0].ModRevision),
+	).Then(
+		clientv3.OpDelete(index),
+	).Commit()
+	if err != nil {
+		return false, err
+	}
+	return txn.Succeeded, nil
+}
+
+// Release releases the IP which allocated to the container identified by id,
+// and marks the IP as free in the bitmap unless it is bound to the pod.
 func (e *Etcd) Release(id string) error {
-	_, err := e.kv.Delete(context.TODO(), ipsPrefix + id)
+	return e.releaseAll(id, noTombstone)
+}
+
+// noTombstone is the bury of Release, which keeps nothing used.
+func noTombstone(r *store.Record, bound bool) *store.Record {
+	return nil
+}
+
+// Quarantine releases the IPs held by the container, and keeps them used until the time given.
+func (e *Etcd) Quarantine(id string, until time.Time) error {
+	return e.releaseAll(id, func(r *store.Record, bound bool) *store.Record {
+		if bound {
+			return nil
+		}
+		return r.Tombstone(store.StateQuarantined, until)
+	})
+}
+
+// Conflict releases the IPs held by the container, and keeps ip used until the mark is removed.
+func (e *Etcd) Conflict(id string, ip net.IP) error {
+	return e.releaseAll(id, func(r *store.Record, bound bool) *store.Record {
+		if !r.IP.Equal(ip) {
+			return nil
+		}
+		return r.Tombstone(store.StateConflict, time.Time{})
+	})
+}
+
+// releaseAll releases the IPs held by the container, bury returns the tombstone of the
+// IP released, which is kept used, or nil.
+func (e *Etcd) releaseAll(id string, bury func(r *store.Record, bound bool) *store.Record) error {
+	kvs, err := e.reservations(id)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range kvs {
+		r, err := store.ParseRecord(item.Value)
+		if err != nil {
+			// ivalid format, just delete it.
+			if _, err = e.kv.Delete(context.TODO(), string(item.Key)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = e.release(id, string(item.Key), r, bury); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reservations returns the reservations of the container. Keys are in format of
+// ipsPrefix/id/ip, and ipsPrefix/id for the early versions, the IDs sharing the same
+// prefix must not be matched.
+func (e *Etcd) reservations(id string) ([]*mvccpb.KeyValue, error) {
+	resp, err := e.kv.Get(context.TODO(), ipsPrefix+id+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := e.kv.Get(context.TODO(), ipsPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	return append(resp.Kvs, legacy.Kvs...), nil
+}
+
+// release releases the reservation of key, whose value is r, and puts the tombstone
+// returned by bury if any, which deletes the binding of the IP too.
+func (e *Etcd) release(id string, key string, r *store.Record, bury func(r *store.Record, bound bool) *store.Record) error {
+	ip := r.IP
+	subnet := e.subnetOf(r)
+	if subnet == nil {
+		// The subnet is gone, just delete it.
+		_, err := e.kv.Delete(context.TODO(), key)
+		return err
+	}
+
+	sticky := stickyPrefix + r.Namespace + "/" + r.Pod + "/" + ip.String()
+	bound, err := e.kv.Get(context.TODO(), sticky)
+	if err != nil {
+		return err
+	}
+	var tombstone []byte
+	if t := bury(r, len(bound.Kvs) != 0); t != nil {
+		if tombstone, err = t.Marshal(); err != nil {
+			return err
+		}
+	}
+	index := indexKey(subnet, ip)
+	for {
+		resp, err := e.kv.Get(context.TODO(), index)
+		if err != nil {
+			return err
+		}
+
+		// Only the holder of the IP, or the reservation without index written by the
+		// early versions, could release the IP.
+		var held clientv3.Cmp
+		switch {
+		case len(resp.Kvs) == 0:
+			held = clientv3.Compare(clientv3.CreateRevision(index), "=", 0)
+		case string(resp.Kvs[0].Value) == id:
+			held = clientv3.Compare(clientv3.Value(index), "=", id)
+		default:
+			// The lease of the reservation expired, and the IP is reserved by another.
+			return e.deleteStale(id, key, subnet, r)
+		}
+
+		ops := []clientv3.Op{
+			clientv3.OpDelete(key),
+			clientv3.OpDelete(index),
+			clientv3.OpDelete(pendingKey(subnet, ip)),
+			clientv3.OpDelete(reclaimKey(subnet, ip, id)),
+			clientv3.OpPut(releasedKey(subnet, ip), time.Now().Format(time.RFC3339Nano)),
+		}
+		for _, used := range usedKeys(subnet, r) {
+			ops = append(ops, clientv3.OpDelete(used))
+		}
+		var released bool
+		switch {
+		case tombstone != nil:
+			// IPs quarantined or in conflict are kept used in the bitmap.
+			ops = append(ops, clientv3.OpPut(quarantineKey(subnet, ip), string(tombstone)), clientv3.OpDelete(sticky))
+			released, err = e.commitPage(subnet, ip, (*bitmap.Bitmap).Set, []clientv3.Cmp{held}, ops...)
+			if err != nil {
+				return err
+			}
+		case len(bound.Kvs) != 0:
+			// IPs bound to the pod are kept used in the bitmap.
+			txn, err := e.kv.Txn(context.TODO()).If(held).Then(ops...).Commit()
+			if err != nil {
+				return err
+			}
+			released = txn.Succeeded
+		default:
+			released, err = e.commitPage(subnet, ip, (*bitmap.Bitmap).Clear, []clientv3.Cmp{held}, ops...)
+			if err != nil {
+				return err
+			}
+		}
+		if released {
+			return nil
+		}
+		// The index is changed meanwhile, try again.
+	}
+}
+
+// deleteStale deletes the reservation of key, whose value is r, which no longer holds the
+// IP, and the keys of it not overwritten by the holder.
+func (e *Etcd) deleteStale(id string, key string, subnet *net.IPNet, r *store.Record) error {
+	if _, err := e.kv.Txn(context.TODO()).Then(
+		clientv3.OpDelete(key),
+		clientv3.OpDelete(reclaimKey(subnet, r.IP, id)),
+	).Commit(); err != nil {
+		return err
+	}
+	for _, k := range usedKeys(subnet, r) {
+		if _, err := e.kv.Txn(context.TODO()).If(
+			clientv3.Compare(clientv3.Value(k), "=", id),
+		).Then(
+			clientv3.OpDelete(k),
+		).Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit commits the pending reservations of the container, and revokes their leases.
+func (e *Etcd) Commit(id string) error {
+	resp, err := e.kv.Get(context.TODO(), ipsPrefix+id+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, item := range resp.Kvs {
+		r, err := store.ParseRecord(item.Value)
+		if err != nil || !r.Pending() {
+			continue
+		}
+		subnet := e.subnetOf(r)
+		if subnet == nil {
+			continue
+		}
+		r.Commit()
+		value, err := r.Marshal()
+		if err != nil {
+			return err
+		}
+		index := indexKey(subnet, r.IP)
+		held, err := e.kv.Get(context.TODO(), index)
+		if err != nil {
+			return err
+		}
+		// Committed only if the lease is not expired meanwhile. The index is put again
+		// without the lease, so it survives the revoke.
+		txn, err := e.kv.Txn(context.TODO()).If(
+			clientv3.Compare(clientv3.Value(index), "=", id),
+		).Then(
+			clientv3.OpPut(string(item.Key), string(value)),
+			clientv3.OpPut(index, id),
+			clientv3.OpDelete(pendingKey(subnet, r.IP)),
+			clientv3.OpDelete(reclaimKey(subnet, r.IP, id)),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if !txn.Succeeded {
+			return fmt.Errorf("reservation of %s is reclaimed before committed", r.IP.String())
+		}
+		if len(held.Kvs) != 0 && held.Kvs[0].Lease != 0 {
+			e.session.Client().Revoke(context.TODO(), clientv3.LeaseID(held.Kvs[0].Lease))
+		}
+	}
+	return nil
+}
+
+// Reclaim releases the pending reservations in subnet whose leases are expired, which
+// have deleted their pending keys and indexes.
+func (e *Etcd) Reclaim(subnet *net.IPNet) error {
+	resp, err := e.kv.Get(context.TODO(), reclaimPrefix+subnet.String()+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, item := range resp.Kvs {
+		parts := strings.SplitN(strings.TrimPrefix(string(item.Key), reclaimPrefix+subnet.String()+"/"), "/", 2)
+		ip := net.ParseIP(parts[0])
+		if ip == nil || len(parts) != 2 {
+			continue
+		}
+		id := parts[1]
+		pending, err := e.kv.Get(context.TODO(), pendingKey(subnet, ip))
+		if err != nil {
+			return err
+		}
+		if len(pending.Kvs) != 0 && string(pending.Kvs[0].Value) == id {
+			// The lease is not expired yet.
+			continue
+		}
+
+		key := ipsPrefix + id + "/" + ip.String()
+		reservation, err := e.kv.Get(context.TODO(), key)
+		if err != nil {
+			return err
+		}
+		var r *store.Record
+		if len(reservation.Kvs) != 0 {
+			r, _ = store.ParseRecord(reservation.Kvs[0].Value)
+		}
+		if r == nil || !r.Pending() {
+			// Released or committed already.
+			if _, err = e.kv.Delete(context.TODO(), string(item.Key)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = e.release(id, key, r, noTombstone); err != nil {
+			return err
+		}
+	}
+	return e.reclaimQuarantined(subnet)
+}
+
+// reclaimQuarantined frees the IPs in subnet whose quarantine is over.
+func (e *Etcd) reclaimQuarantined(subnet *net.IPNet) error {
+	resp, err := e.kv.Get(context.TODO(), quarantinePrefix+subnet.String()+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, item := range resp.Kvs {
+		t, err := store.ParseRecord(item.Value)
+		if err != nil {
+			// ivalid format, just delete it.
+			if _, err = e.kv.Delete(context.TODO(), string(item.Key)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !t.Expired(now) {
+			continue
+		}
+		if err = e.clearTombstone(subnet, t.IP, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearTombstone deletes the tombstone of the IP, which is item, and marks the IP as free.
+// Nothing is done if the IP is reserved meanwhile, which lifts the quarantine or the conflict.
+func (e *Etcd) clearTombstone(subnet *net.IPNet, ip net.IP, item *mvccpb.KeyValue) error {
+	_, err := e.commitPage(subnet, ip, (*bitmap.Bitmap).Clear,
+		[]clientv3.Cmp{
+			clientv3.Compare(clientv3.CreateRevision(indexKey(subnet, ip)), "=", 0),
+			clientv3.Compare(clientv3.ModRevision(string(item.Key)), "=", item.ModRevision),
+		},
+		clientv3.OpDelete(string(item.Key)))
+	return err
+}
+
+// releasedKey returns the key of when the IP was released last.
+func releasedKey(subnet *net.IPNet, ip net.IP) string {
+	return releasedPrefix + subnet.String() + "/" + ip.String()
+}
+
+// RetrieveStrategy retrieves the allocation strategy of the namespace or the subnet.
+func (e *Etcd) RetrieveStrategy(namespace string, subnet *net.IPNet) (string, error) {
+	for _, key := range []string{namespace, subnet.String()} {
+		resp, err := e.kv.Get(context.TODO(), strategyPrefix+key)
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Kvs) != 0 {
+			return string(resp.Kvs[0].Value), nil
+		}
+	}
+	return "", nil
+}
+
+// RetrieveQuotas retrieves the quotas of the namespace.
+func (e *Etcd) RetrieveQuotas(namespace string) ([]store.QuotaMap, error) {
+	qms, err := e.allQuota(quotaPrefix + namespace)
+	if err != nil {
+		return nil, err
+	}
+	// Other namespaces may start with the namespace.
+	ret := make([]store.QuotaMap, 0)
+	for _, qm := range qms {
+		if qm.Namespace == namespace {
+			ret = append(ret, qm)
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveUsed retrieves the number of IPs reserved which are counted by the quota,
+// which is counted by etcd without reading the keys.
+func (e *Etcd) RetrieveUsed(qm store.QuotaMap) (int, error) {
+	resp, err := e.kv.Get(context.TODO(), usedPrefix+qm.Key()+"#", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.Count), nil
+}
+
+// RetrieveLabeledPools retrieves the allocate maps of the namespace with label set.
+func (e *Etcd) RetrieveLabeledPools(namespace string) ([]store.AllocateMap, error) {
+	resp, err := e.kv.Get(context.TODO(), userPrefix+namespace+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	ams := make([]store.AllocateMap, 0)
+	for _, item := range resp.Kvs {
+		ams = append(ams, store.ParseAllocateKey(strings.TrimPrefix(string(item.Key), userPrefix), string(item.Value)))
+	}
+	return ams, nil
+}
+
+// RetrieveCursor retrieves the IP reserved last in subnet.
+func (e *Etcd) RetrieveCursor(subnet *net.IPNet) (net.IP, error) {
+	resp, err := e.kv.Get(context.TODO(), cursorPrefix+subnet.String())
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	return net.ParseIP(string(resp.Kvs[0].Value)), nil
+}
+
+// RetrieveReleased retrieves when the IPs in subnet were released last.
+func (e *Etcd) RetrieveReleased(subnet *net.IPNet) (map[string]time.Time, error) {
+	prefix := releasedPrefix + subnet.String() + "/"
+	resp, err := e.kv.Get(context.TODO(), prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]time.Time)
+	for _, item := range resp.Kvs {
+		if released, err := time.Parse(time.RFC3339Nano, string(item.Value)); err == nil {
+			ret[strings.TrimPrefix(string(item.Key), prefix)] = released
+		}
+	}
+	return ret, nil
+}
+
+// quarantineKey returns the key of the tombstone of the IP.
+func quarantineKey(subnet *net.IPNet, ip net.IP) string {
+	return quarantinePrefix + subnet.String() + "/" + ip.String()
+}
+
+// pendingKey returns the key of the pending reservation of the IP.
+func pendingKey(subnet *net.IPNet, ip net.IP) string {
+	return pendingPrefix + subnet.String() + "/" + ip.String()
+}
+
+// reclaimKey returns the key of the pending reservation of the IP by the container to reclaim.
+func reclaimKey(subnet *net.IPNet, ip net.IP, id string) string {
+	return reclaimPrefix + subnet.String() + "/" + ip.String() + "/" + id
+}
+
+// RetrieveReservations retrieves all the reservations, reservations in invalid format are skipped.
+func (e *Etcd) RetrieveReservations() (map[string][]*store.Record, error) {
+	resp, err := e.kv.Get(context.TODO(), ipsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]*store.Record)
+	for _, item := range resp.Kvs {
+		r, err := store.ParseRecord(item.Value)
+		if err != nil {
+			continue
+		}
+		id := containerID(string(item.Key))
+		ret[id] = append(ret[id], r)
+	}
+	return ret, nil
+}
+
+// RetrieveSubnets retrieves the subnets of the IPs held by the container.
+func (e *Etcd) RetrieveSubnets(id string) ([]*net.IPNet, error) {
+	kvs, err := e.reservations(id)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*net.IPNet, 0)
+	for _, item := range kvs {
+		r, err := store.ParseRecord(item.Value)
+		if err != nil {
+			continue
+		}
+		if subnet := e.subnetOf(r); subnet != nil {
+			ret = append(ret, subnet)
+		}
+	}
+	return ret, nil
+}
+
+// subnetOf returns the subnet of the reservation, nil if not found.
+func (e *Etcd) subnetOf(r *store.Record) *net.IPNet {
+	if subnet := r.SubnetNet(); subnet != nil {
+		return subnet
+	}
+	// Written by the early versions, which has no subnet.
+	return e.RetrieveSubnet(r.IP)
+}
+
+// Bind binds the IP to the pod.
+func (e *Etcd) Bind(namespace string, podName string, ip net.IP) error {
+	_, err := e.kv.Put(context.TODO(), stickyPrefix+namespace+"/"+podName+"/"+ip.String(), ip.String())
 	return err
 }
 
-// GatewayMap is the map of subnet and gateway, used by monkey
-type GatewayMap struct {
-	Subnet  string `json:"subnet"`
-	Gateway string `json:"gw"`
+// Unbind removes the binding of the IP to the pod,
+// and marks the IP as free in the bitmap unless it is held by a container.
+func (e *Etcd) Unbind(namespace string, podName string, ip net.IP) error {
+	key := stickyPrefix + namespace + "/" + podName + "/" + ip.String()
+	if subnet := e.RetrieveSubnet(ip); subnet != nil {
+		holder, err := e.RetrieveHolder(subnet, ip)
+		if err != nil {
+			return err
+		}
+		if holder == "" {
+			unbound, err := e.commitPage(subnet, ip, (*bitmap.Bitmap).Clear,
+				[]clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(indexKey(subnet, ip)), "=", 0)},
+				clientv3.OpDelete(key))
+			if err != nil || unbound {
+				return err
+			}
+			// Held by a container meanwhile, so keep it used in the bitmap.
+		}
+	}
+	_, err := e.kv.Delete(context.TODO(), key)
+	return err
 }
 
-// AllocateMap is the map of dedicated IPs and the namespace, used by monkey
-type AllocateMap struct {
-	Allocate  string `json:"ips"`
-	Namespace string `json:"ns"`
-	// TODO: Add label to support explicate which IPs to use for a given pods.
-	// Label     string `json:"label"`
+// RetrieveBindings retrieves the IPs bound to pods in namespace, keyed by pod name.
+func (e *Etcd) RetrieveBindings(namespace string) (map[string][]net.IP, error) {
+	resp, err := e.kv.Get(context.TODO(), stickyPrefix+namespace+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]net.IP)
+	for _, item := range resp.Kvs {
+		ip := net.ParseIP(string(item.Value))
+		if ip == nil {
+			// ivalid format, just omit.
+			continue
+		}
+		// Keys are in format of stickyPrefix/namespace/pod/ip
+		pod := strings.SplitN(strings.TrimPrefix(string(item.Key), stickyPrefix+namespace+"/"), "/", 2)[0]
+		ret[pod] = append(ret[pod], ip)
+	}
+	return ret, nil
 }
 
-// InUsedMap is the map of ContainerID and its IP, used by monkey
-type InUsedMap struct {
-	ContainerID string `json:"id"`
-	IP          net.IP `json:"ip"`
-	Pod         string `json:"pod"`
-	Namespace   string `json:"ns"`
-	App         string `json:"app,omitempty"`
-	Service     string `json:"svc,omitempty"`
+// Migrate rewrites the reservations written by the early versions in the schema of
+// store.RecordVersion, and indexes their IPs. It is safe to run while anchor is working,
+// since a reservation changed by others during the migration is left untouched.
+// It returns the number of reservations migrated.
+func (e *Etcd) Migrate() (int, error) {
+	resp, err := e.kv.Get(context.TODO(), ipsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, item := range resp.Kvs {
+		r, err := store.ParseRecord(item.Value)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate %s: %v", string(item.Key), err)
+		}
+		if r.Version == store.RecordVersion {
+			continue
+		}
+		subnet := e.subnetOf(r)
+		if subnet == nil {
+			return migrated, fmt.Errorf("failed to migrate %s: no subnet contains %s",
+				string(item.Key), r.IP.String())
+		}
+		r.Subnet = subnet.String()
+		r.Updated = time.Now()
+		value, err := r.Marshal()
+		if err != nil {
+			return migrated, err
+		}
+
+		key := string(item.Key)
+		resp, err := e.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", item.ModRevision)).
+			Then(clientv3.OpPut(key, string(value))).
+			Commit()
+		if err != nil {
+			return migrated, err
+		}
+		if !resp.Succeeded {
+			// Changed by others, which must be in the new schema.
+			continue
+		}
+		if err = e.index(key, subnet, r); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	// The reservations written by the early versions from now on are indexed by nobody.
+	_, err = e.kv.Put(context.TODO(), migratedKey, strconv.Itoa(store.RecordVersion))
+	return migrated, err
+}
+
+// index indexes and counts the IP of the reservation of key, whose value is r, unless
+// it is done.
+func (e *Etcd) index(key string, subnet *net.IPNet, r *store.Record) error {
+	index := indexKey(subnet, r.IP)
+	ops := []clientv3.Op{clientv3.OpPut(index, containerID(key))}
+	for _, used := range usedKeys(subnet, r) {
+		ops = append(ops, clientv3.OpPut(used, containerID(key)))
+	}
+	_, err := e.kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(index), "=", 0)).
+		Then(ops...).
+		Commit()
+	return err
+}
+
+// indexLegacy indexes the IPs held by the reservations of the early versions, which are
+// written without index, so they are not handed out again. It is done once by each client
+// until the reservations are migrated, see Migrate. The records are not rewritten, since
+// the anchors not upgraded yet could not read the new schema.
+func (e *Etcd) indexLegacy() error {
+	e.indexLock.Lock()
+	defer e.indexLock.Unlock()
+	if e.indexed {
+		return nil
+	}
+	resp, err := e.kv.Get(context.TODO(), migratedKey)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) != 0 && string(resp.Kvs[0].Value) == strconv.Itoa(store.RecordVersion) {
+		e.indexed = true
+		return nil
+	}
+
+	if resp, err = e.kv.Get(context.TODO(), ipsPrefix, clientv3.WithPrefix()); err != nil {
+		return err
+	}
+	for _, item := range resp.Kvs {
+		r, err := store.ParseRecord(item.Value)
+		if err != nil || r.Version == store.RecordVersion {
+			continue
+		}
+		if subnet := e.subnetOf(r); subnet != nil {
+			if err = e.index(string(item.Key), subnet, r); err != nil {
+				return err
+			}
+		}
+	}
+	e.indexed = true
+	return nil
 }
 
 // AllGatewayMap gets all gateway map in the store
-func (e *Etcd) AllGatewayMap() (*[]GatewayMap, error) {
-	gms := make([]GatewayMap, 0)
+func (e *Etcd) AllGatewayMap() (*[]store.GatewayMap, error) {
+	gms := make([]store.GatewayMap, 0)
 	resp, err := e.kv.Get(context.TODO(), gatewayPrefix, clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
@@ -204,7 +1097,7 @@ func (e *Etcd) AllGatewayMap() (*[]GatewayMap, error) {
 			// ivalid format, just omit.
 			continue
 		}
-		gms = append(gms, GatewayMap{
+		gms = append(gms, store.GatewayMap{
 			// Subnet:  *subnet,
 			// Gateway: gateway,
 			Subnet:  subnet,
@@ -215,7 +1108,7 @@ func (e *Etcd) AllGatewayMap() (*[]GatewayMap, error) {
 }
 
 // InsertGatewayMap inserts a gateway map
-func (e *Etcd) InsertGatewayMap(gm GatewayMap) error {
+func (e *Etcd) InsertGatewayMap(gm store.GatewayMap) error {
 	if _, err := e.kv.Put(context.TODO(), gatewayPrefix+gm.Subnet, gm.Gateway); err != nil {
 
 		return err
@@ -224,7 +1117,7 @@ func (e *Etcd) InsertGatewayMap(gm GatewayMap) error {
 }
 
 // DeleteGatewayMap deletes a gateway map
-func (e *Etcd) DeleteGatewayMap(gms []GatewayMap) error {
+func (e *Etcd) DeleteGatewayMap(gms []store.GatewayMap) error {
 	for _, gm := range gms {
 		// if _, err := e.kv.Delete(context.TODO(), gm.Subnet.String()); err != nil {
 		if _, err := e.kv.Delete(context.TODO(), gatewayPrefix+gm.Subnet); err != nil {
@@ -232,37 +1125,84 @@ func (e *Etcd) DeleteGatewayMap(gms []GatewayMap) error {
 			// If we omit one error, maybe all errors are omitted.
 			return err
 		}
+		if _, err := e.kv.Delete(context.TODO(), strategyPrefix+gm.Subnet); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// RetrieveUsedbyNamespace retrieves used IP in subnet for namespace.
-func (e *Etcd) RetrieveUsedbyNamespace(namespace string, adminRole bool) (*[]string, error) {
+// RetrieveUsedbyNamespace retrieves the reservations of namespace, or all of them for admin.
+// Reservations in invalid format are skipped.
+func (e *Etcd) RetrieveUsedbyNamespace(namespace string, adminRole bool) (*[]store.Record, error) {
 	resp, err := e.kv.Get(context.TODO(), ipsPrefix, clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
 	}
-	// TODO: which return type is best? []string or RangeSet?
-	// ret := make([]net.IP, 0)
-	s := make([]string, 0)
-	if adminRole {
-		for _, item := range resp.Kvs {
-			s = append(s, string(item.Value))
-		}
-	} else {
-		for _, item := range resp.Kvs {
-			row := strings.Split(string(item.Value), ",")
-			if row[2] == namespace {
-				s = append(s, string(item.Value))
+	records := make([]store.Record, 0)
+	for _, item := range resp.Kvs {
+		r, err := store.ParseRecord(item.Value)
+		if err != nil {
+			continue
+		}
+		if adminRole || r.Namespace == namespace {
+			records = append(records, *r)
+		}
+	}
+	return &records, nil
+}
+
+// AllQuarantined gets the tombstones of the IPs quarantined.
+func (e *Etcd) AllQuarantined() (*[]store.Record, error) {
+	return e.allTombstone(store.StateQuarantined)
+}
+
+// AllConflict gets the tombstones of the IPs in conflict.
+func (e *Etcd) AllConflict() (*[]store.Record, error) {
+	return e.allTombstone(store.StateConflict)
+}
+
+// allTombstone returns the tombstones in the state given.
+func (e *Etcd) allTombstone(state string) (*[]store.Record, error) {
+	resp, err := e.kv.Get(context.TODO(), quarantinePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	records := make([]store.Record, 0)
+	for _, item := range resp.Kvs {
+		if t, err := store.ParseRecord(item.Value); err == nil && t.State == state {
+			records = append(records, *t)
+		}
+	}
+	return &records, nil
+}
+
+// DeleteConflict removes the conflict marks of the IPs, and marks them as free.
+func (e *Etcd) DeleteConflict(ips []net.IP) error {
+	resp, err := e.kv.Get(context.TODO(), quarantinePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, item := range resp.Kvs {
+		t, err := store.ParseRecord(item.Value)
+		if err != nil || !t.Conflicted() || t.SubnetNet() == nil {
+			continue
+		}
+		for _, ip := range ips {
+			if !t.IP.Equal(ip) {
+				continue
+			}
+			if err = e.clearTombstone(t.SubnetNet(), t.IP, item); err != nil {
+				return err
 			}
 		}
 	}
-	return &s, nil
+	return nil
 }
 
 // AllAllocate gets all allocate map
-func (e *Etcd) AllAllocate() (*[]AllocateMap, error) {
-	ams := make([]AllocateMap, 0)
+func (e *Etcd) AllAllocate() (*[]store.AllocateMap, error) {
+	ams := make([]store.AllocateMap, 0)
 	resp, err := e.kv.Get(context.TODO(), userPrefix, clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
@@ -270,22 +1210,20 @@ func (e *Etcd) AllAllocate() (*[]AllocateMap, error) {
 
 	// s := make([]string, 0)
 	for _, item := range resp.Kvs {
-		ns := strings.TrimPrefix(string(item.Key), userPrefix)
+		key := strings.TrimPrefix(string(item.Key), userPrefix)
 		allocate := string(item.Value)
-		ams = append(ams, AllocateMap{
-			// Subnet:  *subnet,
-			// Gateway: gateway,
-			Allocate:  allocate,
-			Namespace: ns,
-		})
+		ams = append(ams, store.ParseAllocateKey(key, allocate))
 	}
 	return &ams, nil
 
 }
 
 // InsertAllocateMap inserts a allocate map
-func (e *Etcd) InsertAllocateMap(am AllocateMap) error {
-	if _, err := e.kv.Put(context.TODO(), userPrefix+am.Namespace, am.Allocate); err != nil {
+func (e *Etcd) InsertAllocateMap(am store.AllocateMap) error {
+	if err := am.Validate(); err != nil {
+		return err
+	}
+	if _, err := e.kv.Put(context.TODO(), userPrefix+am.Key(), am.Allocate); err != nil {
 
 		return err
 	}
@@ -293,14 +1231,192 @@ func (e *Etcd) InsertAllocateMap(am AllocateMap) error {
 }
 
 // DeleteAllocateMap deletes a allocate map
-func (e *Etcd) DeleteAllocateMap(ams []AllocateMap) error {
+func (e *Etcd) DeleteAllocateMap(ams []store.AllocateMap) error {
 	for _, am := range ams {
 		// if _, err := e.kv.Delete(context.TODO(), gm.Subnet.String()); err != nil {
-		if _, err := e.kv.Delete(context.TODO(), userPrefix+am.Namespace); err != nil {
+		if _, err := e.kv.Delete(context.TODO(), userPrefix+am.Key()); err != nil {
 			// TODO: error when delete one item, should we just stop and return error?
 			// If we omit one error, maybe all errors are omitted.
 			return err
 		}
+		if am.Label != "" {
+			continue
+		}
+		if _, err := e.kv.Delete(context.TODO(), strategyPrefix+am.Namespace); err != nil {
+			return err
+		}
+		if _, err := e.kv.Delete(context.TODO(), quotaPrefix+am.Namespace); err != nil {
+			return err
+		}
+		if _, err := e.kv.Delete(context.TODO(), quotaPrefix+am.Namespace+"/", clientv3.WithPrefix()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// AllStrategy gets all strategy map
+func (e *Etcd) AllStrategy() (*[]store.StrategyMap, error) {
+	resp, err := e.kv.Get(context.TODO(), strategyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	sms := make([]store.StrategyMap, 0)
+	for _, item := range resp.Kvs {
+		key := strings.TrimPrefix(string(item.Key), strategyPrefix)
+		sm := store.StrategyMap{Namespace: key, Strategy: string(item.Value)}
+		// Namespaces never contain "/".
+		if strings.Contains(key, "/") {
+			sm = store.StrategyMap{Subnet: key, Strategy: string(item.Value)}
+		}
+		sms = append(sms, sm)
+	}
+	return &sms, nil
+}
+
+// InsertStrategyMap inserts a strategy map
+func (e *Etcd) InsertStrategyMap(sm store.StrategyMap) error {
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	// The strategy is kept only if its subnet or namespace is still there.
+	owner, missing := userPrefix+sm.Namespace, fmt.Errorf("no IP allocated for %s found in store", sm.Namespace)
+	if sm.Subnet != "" {
+		owner, missing = gatewayPrefix+sm.Subnet, fmt.Errorf("no gateway of %s found in store", sm.Subnet)
+	}
+	txn, err := e.kv.Txn(context.TODO()).If(
+		clientv3.Compare(clientv3.CreateRevision(owner), ">", 0),
+	).Then(
+		clientv3.OpPut(strategyPrefix+sm.Key(), sm.Strategy),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return missing
+	}
+	return nil
+}
+
+// DeleteStrategyMap deletes strategy maps
+func (e *Etcd) DeleteStrategyMap(sms []store.StrategyMap) error {
+	for _, sm := range sms {
+		if _, err := e.kv.Delete(context.TODO(), strategyPrefix+sm.Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllQuota gets all quota map
+func (e *Etcd) AllQuota() (*[]store.QuotaMap, error) {
+	qms, err := e.allQuota(quotaPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &qms, nil
+}
+
+// allQuota returns the quotas whose keys start with prefix, the invalid ones are omitted.
+func (e *Etcd) allQuota(prefix string) ([]store.QuotaMap, error) {
+	resp, err := e.kv.Get(context.TODO(), prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	qms := make([]store.QuotaMap, 0)
+	for _, item := range resp.Kvs {
+		qm := store.QuotaMap{}
+		if err = json.Unmarshal(item.Value, &qm); err == nil {
+			qms = append(qms, qm)
+		}
+	}
+	return qms, nil
+}
+
+// InsertQuotaMap inserts a quota map
+func (e *Etcd) InsertQuotaMap(qm store.QuotaMap) error {
+	if err := qm.Validate(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(qm)
+	if err != nil {
+		return err
+	}
+	// The quota is kept only if its namespace is still there.
+	txn, err := e.kv.Txn(context.TODO()).If(
+		clientv3.Compare(clientv3.CreateRevision(userPrefix+qm.Namespace), ">", 0),
+	).Then(
+		clientv3.OpPut(quotaPrefix+qm.Key(), string(value)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return fmt.Errorf("no IP allocated for %s found in store", qm.Namespace)
+	}
+	return nil
+}
+
+// DeleteQuotaMap deletes quota maps
+func (e *Etcd) DeleteQuotaMap(qms []store.QuotaMap) error {
+	for _, qm := range qms {
+		if _, err := e.kv.Delete(context.TODO(), quotaPrefix+qm.Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllBinding gets all binding map
+func (e *Etcd) AllBinding() (*[]store.BindingMap, error) {
+	bms := make([]store.BindingMap, 0)
+	resp, err := e.kv.Get(context.TODO(), stickyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range resp.Kvs {
+		parts := strings.SplitN(strings.TrimPrefix(string(item.Key), stickyPrefix), "/", 3)
+		if len(parts) != 3 {
+			// ivalid format, just omit.
+			continue
+		}
+		bms = append(bms, store.BindingMap{
+			IP:        string(item.Value),
+			Pod:       parts[1],
+			Namespace: parts[0],
+		})
+	}
+	return &bms, nil
+}
+
+// DeleteBindingMap deletes binding maps, then the IPs could be used by other pods.
+func (e *Etcd) DeleteBindingMap(bms []store.BindingMap) error {
+	for _, bm := range bms {
+		if err := e.unbindWithLock(bm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Etcd) unbindWithLock(bm store.BindingMap) error {
+	ip := net.ParseIP(bm.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid IP %s", bm.IP)
+	}
+	subnet := e.RetrieveSubnet(ip)
+	if subnet == nil {
+		// The subnet is gone, nothing to update except the binding.
+		_, err := e.kv.Delete(context.TODO(), stickyPrefix+bm.Namespace+"/"+bm.Pod+"/"+ip.String())
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	if err := e.Lock(ctx, subnet); err != nil {
+		return err
+	}
+	defer e.Unlock(subnet)
+	return e.Unbind(bm.Namespace, bm.Pod, ip)
+}
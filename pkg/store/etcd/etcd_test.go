@@ -0,0 +1,52 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package etcd
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/hainesc/anchor/pkg/store/storetest"
+)
+
+// endpointsEnv is the env variable of the etcd endpoints to test against, such as
+// http://127.0.0.1:2379. Everything under /anchor/ is deleted by the tests, so never
+// point it to the etcd in use. The tests are skipped if it is not set.
+const endpointsEnv = "ANCHOR_TEST_ETCD_ENDPOINTS"
+
+func newEtcdForTest(t *testing.T) *Etcd {
+	endpoints := os.Getenv(endpointsEnv)
+	if endpoints == "" {
+		t.Skipf("%s is not set", endpointsEnv)
+	}
+	e, err := NewEtcdClientWithoutSSl("test", strings.Split(endpoints, ","))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return e
+}
+
+func Test_Conformance(t *testing.T) {
+	storetest.Suite{
+		New: func(t *testing.T) storetest.Backend {
+			e := newEtcdForTest(t)
+			if _, err := e.kv.Delete(context.TODO(), "/anchor/", clientv3.WithPrefix()); err != nil {
+				e.Close()
+				t.Fatal(err.Error())
+			}
+			return e
+		},
+		// Each client has its own session, so its locks exclude the others.
+		Reopen: func(t *testing.T, s storetest.Backend) storetest.Backend {
+			return newEtcdForTest(t)
+		},
+	}.Run(t)
+}
@@ -0,0 +1,1007 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/utils"
+)
+
+var (
+	gatewayBucket = []byte("gw")
+	userBucket    = []byte("ns")
+	ipsBucket     = []byte("cn")
+	indexBucket   = []byte("ip")
+	stickyBucket  = []byte("st")
+	bitmapBucket  = []byte("bm")
+	// the IDs of containers whose reservations are pending, keyed by subnet/IP.
+	pendingBucket = []byte("pd")
+	// tombstones of IPs quarantined or in conflict, keyed by subnet/IP.
+	tombstoneBucket = []byte("qt")
+	// strategies keyed by subnet or namespace.
+	strategyBucket = []byte("sg")
+	// the IPs reserved last, keyed by subnet.
+	cursorBucket = []byte("cs")
+	// when the IPs were released last, keyed by subnet/IP.
+	releasedBucket = []byte("rl")
+	// quotas in JSON, keyed by store.QuotaMap.Key.
+	quotaBucket = []byte("qa")
+	// the numbers of IPs counted by quotas, keyed by store.QuotaMap.Key.
+	usedBucket = []byte("us")
+	buckets    = [][]byte{gatewayBucket, userBucket, ipsBucket, indexBucket, stickyBucket, bitmapBucket,
+		pendingBucket, tombstoneBucket, strategyBucket, cursorBucket, releasedBucket, quotaBucket, usedBucket}
+)
+
+// lockRetryInterval is the interval between two tries of the lock of a subnet.
+const lockRetryInterval = 10 * time.Millisecond
+
+// File is a store backed by a local bbolt file, for the nodes without etcd.
+//
+// The file is opened for each call and closed once done, so concurrent plugins on the
+// same node and monkey take turns via the flock of bbolt. The locks of subnets are flocks
+// of files next to it, which are held across calls.
+type File struct {
+	path    string
+	timeout time.Duration
+	// locks held by this store, keyed by subnet.
+	locks map[string]*os.File
+	guard sync.Mutex
+}
+
+// Store implements the Store interface
+var _ store.Store = &File{}
+
+// Monkey implements the Monkey interface
+var _ store.Monkey = &File{}
+
+// NewFile news a store backed by the file at path, which is created if not exists.
+// It waits at most timeout for the file once opened.
+func NewFile(path string, timeout time.Duration) (*File, error) {
+	f := &File{
+		path:    path,
+		timeout: timeout,
+		locks:   make(map[string]*os.File),
+	}
+	err := f.update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// update opens the file and calls fn in a read-write transaction.
+func (f *File) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(f.path, 0600, &bolt.Options{Timeout: f.timeout})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", f.path, err)
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// view opens the file and calls fn in a read-only transaction.
+func (f *File) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(f.path, 0600, &bolt.Options{Timeout: f.timeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", f.path, err)
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// Lock locks the subnet, it gives up and returns error when ctx is done.
+func (f *File) Lock(ctx context.Context, subnet *net.IPNet) error {
+	// Subnets contain "/" and ":", which are not friendly to file names.
+	name := f.path + "." + strings.NewReplacer("/", "_", ":", "_").Replace(subnet.String()) + ".lock"
+	lock, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	for {
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			lock.Close()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			lock.Close()
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	f.locks[subnet.String()] = lock
+	return nil
+}
+
+// Unlock unlocks the subnet.
+func (f *File) Unlock(subnet *net.IPNet) error {
+	f.guard.Lock()
+	lock, ok := f.locks[subnet.String()]
+	delete(f.locks, subnet.String())
+	f.guard.Unlock()
+	if !ok {
+		return fmt.Errorf("subnet %s is not locked", subnet.String())
+	}
+	// Closing the file releases the flock.
+	return lock.Close()
+}
+
+// Close releases the locks still held.
+func (f *File) Close() error {
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	for subnet, lock := range f.locks {
+		lock.Close()
+		delete(f.locks, subnet)
+	}
+	return nil
+}
+
+// Status returns error if the file could not be opened.
+func (f *File) Status() error {
+	return f.view(func(tx *bolt.Tx) error { return nil })
+}
+
+// Reserve writes the record to the store, and marks the IP as used in the bitmap.
+func (f *File) Reserve(id string, r *store.Record) (bool, error) {
+	subnet := r.SubnetNet()
+	if subnet == nil {
+		return false, fmt.Errorf("invalid subnet %s of record", r.Subnet)
+	}
+	if r.Created.IsZero() {
+		r.Created = time.Now()
+	}
+	r.Updated = r.Created
+	value, err := r.Marshal()
+	if err != nil {
+		return false, err
+	}
+
+	reserved := false
+	err = f.update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(indexBucket)
+		if holder := index.Get(indexKey(subnet, r.IP)); holder != nil {
+			reserved = string(holder) == id
+			return nil
+		}
+		if err := updatePage(tx, subnet, r.IP, (*bitmap.Bitmap).Set); err != nil {
+			return err
+		}
+		if err := index.Put(indexKey(subnet, r.IP), []byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(tombstoneBucket).Delete(indexKey(subnet, r.IP)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(cursorBucket).Put([]byte(subnet.String()), []byte(r.IP.String())); err != nil {
+			return err
+		}
+		if err := count(tx, r, 1); err != nil {
+			return err
+		}
+		if r.Pending() {
+			if err := tx.Bucket(pendingBucket).Put(indexKey(subnet, r.IP), []byte(id)); err != nil {
+				return err
+			}
+		}
+		reserved = true
+		return tx.Bucket(ipsBucket).Put([]byte(id+"/"+r.IP.String()), value)
+	})
+	return reserved, err
+}
+
+// Release releases the IPs held by the container, the IPs bound to pods are kept used.
+func (f *File) Release(id string) error {
+	return f.update(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(ipsBucket), id+"/") {
+			if err := release(tx, kv); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Quarantine releases the IPs held by the container, and keeps them used until the time given.
+func (f *File) Quarantine(id string, until time.Time) error {
+	return f.update(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(ipsBucket), id+"/") {
+			if err := release(tx, kv); err != nil {
+				return err
+			}
+			r, err := store.ParseRecord(kv.value)
+			if err != nil || r.SubnetNet() == nil {
+				continue
+			}
+			if tx.Bucket(stickyBucket).Get(bindingKey(r.Namespace, r.Pod, r.IP)) != nil {
+				continue
+			}
+			value, err := r.Tombstone(store.StateQuarantined, until).Marshal()
+			if err != nil {
+				return err
+			}
+			if err = tx.Bucket(tombstoneBucket).Put(indexKey(r.SubnetNet(), r.IP), value); err != nil {
+				return err
+			}
+			if err = updatePage(tx, r.SubnetNet(), r.IP, (*bitmap.Bitmap).Set); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Conflict releases the IPs held by the container, and keeps ip used until the mark is removed.
+func (f *File) Conflict(id string, ip net.IP) error {
+	return f.update(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(ipsBucket), id+"/") {
+			if err := release(tx, kv); err != nil {
+				return err
+			}
+			r, err := store.ParseRecord(kv.value)
+			if err != nil || r.SubnetNet() == nil || !r.IP.Equal(ip) {
+				continue
+			}
+			if err = tx.Bucket(stickyBucket).Delete(bindingKey(r.Namespace, r.Pod, r.IP)); err != nil {
+				return err
+			}
+			value, err := r.Tombstone(store.StateConflict, time.Time{}).Marshal()
+			if err != nil {
+				return err
+			}
+			if err = tx.Bucket(tombstoneBucket).Put(indexKey(r.SubnetNet(), r.IP), value); err != nil {
+				return err
+			}
+			if err = updatePage(tx, r.SubnetNet(), r.IP, (*bitmap.Bitmap).Set); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// release deletes the reservation, and marks the IP as free unless it is bound to the pod.
+func release(tx *bolt.Tx, reservation kv) error {
+	if err := tx.Bucket(ipsBucket).Delete(reservation.key); err != nil {
+		return err
+	}
+	r, err := store.ParseRecord(reservation.value)
+	if err != nil {
+		return nil
+	}
+	subnet := r.SubnetNet()
+	if subnet == nil {
+		return nil
+	}
+	if err = tx.Bucket(indexBucket).Delete(indexKey(subnet, r.IP)); err != nil {
+		return err
+	}
+	if err = tx.Bucket(pendingBucket).Delete(indexKey(subnet, r.IP)); err != nil {
+		return err
+	}
+	if err = count(tx, r, -1); err != nil {
+		return err
+	}
+	released := []byte(time.Now().Format(time.RFC3339Nano))
+	if err = tx.Bucket(releasedBucket).Put(indexKey(subnet, r.IP), released); err != nil {
+		return err
+	}
+	if tx.Bucket(stickyBucket).Get(bindingKey(r.Namespace, r.Pod, r.IP)) != nil {
+		return nil
+	}
+	return updatePage(tx, subnet, r.IP, (*bitmap.Bitmap).Clear)
+}
+
+// count adds delta to the numbers of IPs used by the quotas which count r.
+func count(tx *bolt.Tx, r *store.Record, delta int) error {
+	used := tx.Bucket(usedBucket)
+	for _, key := range store.QuotaKeys(r) {
+		n, _ := strconv.Atoi(string(used.Get([]byte(key))))
+		if n += delta; n <= 0 {
+			if err := used.Delete([]byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := used.Put([]byte(key), []byte(strconv.Itoa(n))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit commits the pending reservations of the container.
+func (f *File) Commit(id string) error {
+	return f.update(func(tx *bolt.Tx) error {
+		ips := tx.Bucket(ipsBucket)
+		for _, kv := range scan(ips, id+"/") {
+			r, err := store.ParseRecord(kv.value)
+			if err != nil || !r.Pending() {
+				continue
+			}
+			r.Commit()
+			value, err := r.Marshal()
+			if err != nil {
+				return err
+			}
+			if err = ips.Put(kv.key, value); err != nil {
+				return err
+			}
+			if err = tx.Bucket(pendingBucket).Delete(indexKey(r.SubnetNet(), r.IP)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reclaim releases the pending reservations in subnet which are expired,
+// and frees the IPs in subnet whose quarantine is over.
+func (f *File) Reclaim(subnet *net.IPNet) error {
+	now := time.Now()
+	return f.update(func(tx *bolt.Tx) error {
+		ips := tx.Bucket(ipsBucket)
+		for _, p := range scan(tx.Bucket(pendingBucket), subnet.String()+"/") {
+			ip := strings.TrimPrefix(string(p.key), subnet.String()+"/")
+			key := []byte(string(p.value) + "/" + ip)
+			value := copyBytes(ips.Get(key))
+			if value == nil {
+				if err := tx.Bucket(pendingBucket).Delete(p.key); err != nil {
+					return err
+				}
+				continue
+			}
+			r, err := store.ParseRecord(value)
+			if err != nil || !r.Expired(now) {
+				continue
+			}
+			if err = release(tx, kv{key: key, value: value}); err != nil {
+				return err
+			}
+		}
+		tombstones := tx.Bucket(tombstoneBucket)
+		for _, kv := range scan(tombstones, subnet.String()+"/") {
+			t, err := store.ParseRecord(kv.value)
+			if err == nil && !t.Expired(now) {
+				continue
+			}
+			if err = tombstones.Delete(kv.key); err != nil {
+				return err
+			}
+			if t != nil {
+				if err = updatePage(tx, subnet, t.IP, (*bitmap.Bitmap).Clear); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Bind binds the IP to the pod.
+func (f *File) Bind(namespace string, podName string, ip net.IP) error {
+	return f.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stickyBucket).Put(bindingKey(namespace, podName, ip), []byte(ip.String()))
+	})
+}
+
+// Unbind removes the binding of the IP to the pod,
+// and marks the IP as free in the bitmap unless it is held by a container.
+func (f *File) Unbind(namespace string, podName string, ip net.IP) error {
+	return f.update(func(tx *bolt.Tx) error {
+		sticky := tx.Bucket(stickyBucket)
+		if sticky.Get(bindingKey(namespace, podName, ip)) == nil {
+			return nil
+		}
+		if err := sticky.Delete(bindingKey(namespace, podName, ip)); err != nil {
+			return err
+		}
+		subnet := retrieveSubnet(tx, ip)
+		if subnet == nil || tx.Bucket(indexBucket).Get(indexKey(subnet, ip)) != nil {
+			return nil
+		}
+		return updatePage(tx, subnet, ip, (*bitmap.Bitmap).Clear)
+	})
+}
+
+// RetrieveGateway retrieves gateway for subnet.
+func (f *File) RetrieveGateway(subnet *net.IPNet) net.IP {
+	var gw net.IP
+	f.view(func(tx *bolt.Tx) error {
+		gw = net.ParseIP(string(tx.Bucket(gatewayBucket).Get([]byte(subnet.String()))))
+		return nil
+	})
+	return gw
+}
+
+// RetrieveSubnet retrieves the subnet contains ip.
+func (f *File) RetrieveSubnet(ip net.IP) *net.IPNet {
+	var subnet *net.IPNet
+	f.view(func(tx *bolt.Tx) error {
+		subnet = retrieveSubnet(tx, ip)
+		return nil
+	})
+	return subnet
+}
+
+func retrieveSubnet(tx *bolt.Tx, ip net.IP) *net.IPNet {
+	for _, kv := range scan(tx.Bucket(gatewayBucket), "") {
+		_, subnet, err := net.ParseCIDR(string(kv.key))
+		if err == nil && subnet.Contains(ip) {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// RetrieveAllocated retrieves the IPs in subnet allocated to namespace.
+func (f *File) RetrieveAllocated(namespace string, subnet *net.IPNet) (*utils.RangeSet, error) {
+	var pool []byte
+	if err := f.view(func(tx *bolt.Tx) error {
+		pool = copyBytes(tx.Bucket(userBucket).Get([]byte(namespace)))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if pool == nil {
+		return nil, fmt.Errorf("no IP allocated for %s found in %s", namespace, f.path)
+	}
+	ret := utils.RangeSet{}
+	return ret.Concat(string(pool), subnet)
+}
+
+// RetrieveBitmap retrieves the page of the bitmap of used IPs in subnet.
+func (f *File) RetrieveBitmap(subnet *net.IPNet, page uint64) (*bitmap.Bitmap, error) {
+	var raw []byte
+	if err := f.view(func(tx *bolt.Tx) error {
+		raw = copyBytes(tx.Bucket(bitmapBucket).Get(pageKey(subnet, page)))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return bitmap.New(), nil
+	}
+	return bitmap.FromBytes(raw)
+}
+
+// RetrieveHolder retrieves the ID of the container which holds the IP.
+func (f *File) RetrieveHolder(subnet *net.IPNet, ip net.IP) (string, error) {
+	var holder string
+	err := f.view(func(tx *bolt.Tx) error {
+		holder = string(tx.Bucket(indexBucket).Get(indexKey(subnet, ip)))
+		return nil
+	})
+	return holder, err
+}
+
+// RetrieveTombstone retrieves the tombstone of the IP quarantined or in conflict.
+func (f *File) RetrieveTombstone(subnet *net.IPNet, ip net.IP) (*store.Record, error) {
+	var value []byte
+	if err := f.view(func(tx *bolt.Tx) error {
+		value = copyBytes(tx.Bucket(tombstoneBucket).Get(indexKey(subnet, ip)))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return store.ParseRecord(value)
+}
+
+// RetrieveBindings retrieves the IPs bound to pods in namespace, keyed by pod name.
+func (f *File) RetrieveBindings(namespace string) (map[string][]net.IP, error) {
+	ret := make(map[string][]net.IP)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(stickyBucket), namespace+"/") {
+			// Keys are in format of namespace/pod/ip
+			pod := strings.SplitN(strings.TrimPrefix(string(kv.key), namespace+"/"), "/", 2)[0]
+			if ip := net.ParseIP(string(kv.value)); ip != nil {
+				ret[pod] = append(ret[pod], ip)
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// RetrieveSubnets retrieves the subnets of the IPs held by the container.
+func (f *File) RetrieveSubnets(id string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(ipsBucket), id+"/") {
+			if r, err := store.ParseRecord(kv.value); err == nil && r.SubnetNet() != nil {
+				ret = append(ret, r.SubnetNet())
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// RetrieveReservations retrieves all the reservations.
+func (f *File) RetrieveReservations() (map[string][]*store.Record, error) {
+	ret := make(map[string][]*store.Record)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(ipsBucket), "") {
+			if r, err := store.ParseRecord(kv.value); err == nil {
+				id := strings.SplitN(string(kv.key), "/", 2)[0]
+				ret[id] = append(ret[id], r)
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// RetrieveStrategy retrieves the allocation strategy of the namespace or the subnet.
+func (f *File) RetrieveStrategy(namespace string, subnet *net.IPNet) (string, error) {
+	var strategy []byte
+	err := f.view(func(tx *bolt.Tx) error {
+		strategies := tx.Bucket(strategyBucket)
+		if strategy = copyBytes(strategies.Get([]byte(namespace))); strategy == nil {
+			strategy = copyBytes(strategies.Get([]byte(subnet.String())))
+		}
+		return nil
+	})
+	return string(strategy), err
+}
+
+// RetrieveQuotas retrieves the quotas of the namespace.
+func (f *File) RetrieveQuotas(namespace string) ([]store.QuotaMap, error) {
+	qms, err := f.allQuota()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]store.QuotaMap, 0)
+	for _, qm := range qms {
+		if qm.Namespace == namespace {
+			ret = append(ret, qm)
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveUsed retrieves the number of IPs reserved which are counted by the quota.
+func (f *File) RetrieveUsed(qm store.QuotaMap) (int, error) {
+	var used []byte
+	if err := f.view(func(tx *bolt.Tx) error {
+		used = copyBytes(tx.Bucket(usedBucket).Get([]byte(qm.Key())))
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if used == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(used))
+}
+
+// RetrieveLabeledPools retrieves the allocate maps of the namespace with label set.
+func (f *File) RetrieveLabeledPools(namespace string) ([]store.AllocateMap, error) {
+	ams := make([]store.AllocateMap, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(userBucket), namespace+"/") {
+			ams = append(ams, store.ParseAllocateKey(string(kv.key), string(kv.value)))
+		}
+		return nil
+	})
+	return ams, err
+}
+
+// RetrieveCursor retrieves the IP reserved last in subnet.
+func (f *File) RetrieveCursor(subnet *net.IPNet) (net.IP, error) {
+	var cursor net.IP
+	err := f.view(func(tx *bolt.Tx) error {
+		cursor = net.ParseIP(string(tx.Bucket(cursorBucket).Get([]byte(subnet.String()))))
+		return nil
+	})
+	return cursor, err
+}
+
+// RetrieveReleased retrieves when the IPs in subnet were released last.
+func (f *File) RetrieveReleased(subnet *net.IPNet) (map[string]time.Time, error) {
+	ret := make(map[string]time.Time)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(releasedBucket), subnet.String()+"/") {
+			if released, err := time.Parse(time.RFC3339Nano, string(kv.value)); err == nil {
+				ret[strings.TrimPrefix(string(kv.key), subnet.String()+"/")] = released
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// AllGatewayMap gets all gateway map in the store
+func (f *File) AllGatewayMap() (*[]store.GatewayMap, error) {
+	gms := make([]store.GatewayMap, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(gatewayBucket), "") {
+			gms = append(gms, store.GatewayMap{
+				Subnet:  string(kv.key),
+				Gateway: string(kv.value),
+			})
+		}
+		return nil
+	})
+	return &gms, err
+}
+
+// InsertGatewayMap inserts a gateway map
+func (f *File) InsertGatewayMap(gm store.GatewayMap) error {
+	if _, _, err := net.ParseCIDR(gm.Subnet); err != nil {
+		return err
+	}
+	if net.ParseIP(gm.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %s", gm.Gateway)
+	}
+	return f.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(gatewayBucket).Put([]byte(gm.Subnet), []byte(gm.Gateway))
+	})
+}
+
+// DeleteGatewayMap deletes gateway maps
+func (f *File) DeleteGatewayMap(gms []store.GatewayMap) error {
+	return f.update(func(tx *bolt.Tx) error {
+		for _, gm := range gms {
+			if err := tx.Bucket(gatewayBucket).Delete([]byte(gm.Subnet)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(strategyBucket).Delete([]byte(gm.Subnet)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RetrieveUsedbyNamespace retrieves the reservations of namespace, or all of them for admin.
+func (f *File) RetrieveUsedbyNamespace(namespace string, adminRole bool) (*[]store.Record, error) {
+	records := make([]store.Record, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(ipsBucket), "") {
+			r, err := store.ParseRecord(kv.value)
+			if err != nil {
+				continue
+			}
+			if adminRole || r.Namespace == namespace {
+				records = append(records, *r)
+			}
+		}
+		return nil
+	})
+	return &records, err
+}
+
+// AllQuarantined gets the tombstones of the IPs quarantined.
+func (f *File) AllQuarantined() (*[]store.Record, error) {
+	return f.allTombstone(store.StateQuarantined)
+}
+
+// AllConflict gets the tombstones of the IPs in conflict.
+func (f *File) AllConflict() (*[]store.Record, error) {
+	return f.allTombstone(store.StateConflict)
+}
+
+// allTombstone returns the tombstones in the state given.
+func (f *File) allTombstone(state string) (*[]store.Record, error) {
+	records := make([]store.Record, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(tombstoneBucket), "") {
+			if t, err := store.ParseRecord(kv.value); err == nil && t.State == state {
+				records = append(records, *t)
+			}
+		}
+		return nil
+	})
+	return &records, err
+}
+
+// DeleteConflict removes the conflict marks of the IPs, and marks them as free.
+func (f *File) DeleteConflict(ips []net.IP) error {
+	return f.update(func(tx *bolt.Tx) error {
+		tombstones := tx.Bucket(tombstoneBucket)
+		for _, kv := range scan(tombstones, "") {
+			t, err := store.ParseRecord(kv.value)
+			if err != nil || !t.Conflicted() || t.SubnetNet() == nil {
+				continue
+			}
+			for _, ip := range ips {
+				if !t.IP.Equal(ip) {
+					continue
+				}
+				if err = tombstones.Delete(kv.key); err != nil {
+					return err
+				}
+				if err = updatePage(tx, t.SubnetNet(), t.IP, (*bitmap.Bitmap).Clear); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// AllAllocate gets all allocate map
+func (f *File) AllAllocate() (*[]store.AllocateMap, error) {
+	ams := make([]store.AllocateMap, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(userBucket), "") {
+			ams = append(ams, store.ParseAllocateKey(string(kv.key), string(kv.value)))
+		}
+		return nil
+	})
+	return &ams, err
+}
+
+// InsertAllocateMap inserts a allocate map
+func (f *File) InsertAllocateMap(am store.AllocateMap) error {
+	if err := am.Validate(); err != nil {
+		return err
+	}
+	return f.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(userBucket).Put([]byte(am.Key()), []byte(am.Allocate))
+	})
+}
+
+// DeleteAllocateMap deletes allocate maps
+func (f *File) DeleteAllocateMap(ams []store.AllocateMap) error {
+	return f.update(func(tx *bolt.Tx) error {
+		for _, am := range ams {
+			if err := tx.Bucket(userBucket).Delete([]byte(am.Key())); err != nil {
+				return err
+			}
+			if am.Label != "" {
+				continue
+			}
+			if err := tx.Bucket(strategyBucket).Delete([]byte(am.Namespace)); err != nil {
+				return err
+			}
+			quotas := tx.Bucket(quotaBucket)
+			for _, kv := range scan(quotas, "") {
+				qm := store.QuotaMap{}
+				if json.Unmarshal(kv.value, &qm) == nil && qm.Namespace != am.Namespace {
+					continue
+				}
+				if err := quotas.Delete(kv.key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// AllStrategy gets all strategy map
+func (f *File) AllStrategy() (*[]store.StrategyMap, error) {
+	sms := make([]store.StrategyMap, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(strategyBucket), "") {
+			sm := store.StrategyMap{Namespace: string(kv.key), Strategy: string(kv.value)}
+			// Namespaces never contain "/".
+			if strings.Contains(string(kv.key), "/") {
+				sm = store.StrategyMap{Subnet: string(kv.key), Strategy: string(kv.value)}
+			}
+			sms = append(sms, sm)
+		}
+		return nil
+	})
+	return &sms, err
+}
+
+// InsertStrategyMap inserts a strategy map
+func (f *File) InsertStrategyMap(sm store.StrategyMap) error {
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	return f.update(func(tx *bolt.Tx) error {
+		if sm.Subnet != "" && tx.Bucket(gatewayBucket).Get([]byte(sm.Subnet)) == nil {
+			return fmt.Errorf("no gateway of %s found in %s", sm.Subnet, f.path)
+		}
+		if sm.Namespace != "" && tx.Bucket(userBucket).Get([]byte(sm.Namespace)) == nil {
+			return fmt.Errorf("no IP allocated for %s found in %s", sm.Namespace, f.path)
+		}
+		return tx.Bucket(strategyBucket).Put([]byte(sm.Key()), []byte(sm.Strategy))
+	})
+}
+
+// DeleteStrategyMap deletes strategy maps
+func (f *File) DeleteStrategyMap(sms []store.StrategyMap) error {
+	return f.update(func(tx *bolt.Tx) error {
+		for _, sm := range sms {
+			if err := tx.Bucket(strategyBucket).Delete([]byte(sm.Key())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AllQuota gets all quota map
+func (f *File) AllQuota() (*[]store.QuotaMap, error) {
+	qms, err := f.allQuota()
+	return &qms, err
+}
+
+// allQuota returns the quotas, the invalid ones are omitted.
+func (f *File) allQuota() ([]store.QuotaMap, error) {
+	qms := make([]store.QuotaMap, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(quotaBucket), "") {
+			qm := store.QuotaMap{}
+			if err := json.Unmarshal(kv.value, &qm); err == nil {
+				qms = append(qms, qm)
+			}
+		}
+		return nil
+	})
+	return qms, err
+}
+
+// InsertQuotaMap inserts a quota map
+func (f *File) InsertQuotaMap(qm store.QuotaMap) error {
+	if err := qm.Validate(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(qm)
+	if err != nil {
+		return err
+	}
+	return f.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(userBucket).Get([]byte(qm.Namespace)) == nil {
+			return fmt.Errorf("no IP allocated for %s found in %s", qm.Namespace, f.path)
+		}
+		return tx.Bucket(quotaBucket).Put([]byte(qm.Key()), value)
+	})
+}
+
+// DeleteQuotaMap deletes quota maps
+func (f *File) DeleteQuotaMap(qms []store.QuotaMap) error {
+	return f.update(func(tx *bolt.Tx) error {
+		for _, qm := range qms {
+			if err := tx.Bucket(quotaBucket).Delete([]byte(qm.Key())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AllBinding gets all binding map
+func (f *File) AllBinding() (*[]store.BindingMap, error) {
+	bms := make([]store.BindingMap, 0)
+	err := f.view(func(tx *bolt.Tx) error {
+		for _, kv := range scan(tx.Bucket(stickyBucket), "") {
+			parts := strings.SplitN(string(kv.key), "/", 3)
+			if len(parts) != 3 {
+				// ivalid format, just omit.
+				continue
+			}
+			bms = append(bms, store.BindingMap{
+				IP:        string(kv.value),
+				Pod:       parts[1],
+				Namespace: parts[0],
+			})
+		}
+		return nil
+	})
+	return &bms, err
+}
+
+// DeleteBindingMap deletes binding maps, then the IPs could be used by other pods.
+func (f *File) DeleteBindingMap(bms []store.BindingMap) error {
+	for _, bm := range bms {
+		ip := net.ParseIP(bm.IP)
+		if ip == nil {
+			return fmt.Errorf("invalid IP %s", bm.IP)
+		}
+		if err := f.unbindWithLock(bm.Namespace, bm.Pod, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) unbindWithLock(namespace, pod string, ip net.IP) error {
+	subnet := f.RetrieveSubnet(ip)
+	if subnet == nil {
+		// The subnet is gone, nothing to update except the binding.
+		return f.update(func(tx *bolt.Tx) error {
+			return tx.Bucket(stickyBucket).Delete(bindingKey(namespace, pod, ip))
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	if err := f.Lock(ctx, subnet); err != nil {
+		return err
+	}
+	defer f.Unlock(subnet)
+	return f.Unbind(namespace, pod, ip)
+}
+
+// updatePage updates the bit of ip in the page within tx.
+func updatePage(tx *bolt.Tx, subnet *net.IPNet, ip net.IP, update func(*bitmap.Bitmap, uint32)) error {
+	page, i, err := bitmap.Locate(subnet, ip)
+	if err != nil {
+		return err
+	}
+	pages := tx.Bucket(bitmapBucket)
+	bm := bitmap.New()
+	if raw := pages.Get(pageKey(subnet, page)); raw != nil {
+		if bm, err = bitmap.FromBytes(raw); err != nil {
+			return err
+		}
+	}
+	update(bm, i)
+	return pages.Put(pageKey(subnet, page), bm.Bytes())
+}
+
+type kv struct {
+	key   []byte
+	value []byte
+}
+
+// scan returns copies of the items in bucket whose keys start with prefix,
+// which are still valid after the transaction.
+func scan(bucket *bolt.Bucket, prefix string) []kv {
+	ret := make([]kv, 0)
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+		ret = append(ret, kv{key: copyBytes(k), value: copyBytes(v)})
+	}
+	return ret
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func indexKey(subnet *net.IPNet, ip net.IP) []byte {
+	return []byte(subnet.String() + "/" + ip.String())
+}
+
+func pageKey(subnet *net.IPNet, page uint64) []byte {
+	return []byte(fmt.Sprintf("%s/%d", subnet.String(), page))
+}
+
+func bindingKey(namespace, pod string, ip net.IP) []byte {
+	return []byte(namespace + "/" + pod + "/" + ip.String())
+}
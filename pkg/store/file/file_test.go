@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/store/storetest"
+)
+
+func newFile(t *testing.T) (*File, func()) {
+	dir, err := ioutil.TempDir("", "anchor")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f, err := NewFile(filepath.Join(dir, "anchor.db"), time.Second)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err.Error())
+	}
+	return f, func() {
+		f.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Lock(t *testing.T) {
+	f, cleanup := newFile(t)
+	defer cleanup()
+	// Another plugin on the same node.
+	other, err := NewFile(f.path, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Close()
+
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	if err = f.Lock(context.Background(), subnet); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = other.Lock(ctx, subnet); err == nil {
+		t.Fatal("expected error when the subnet is locked")
+	}
+	if err = f.Unlock(subnet); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = other.Lock(context.Background(), subnet); err != nil {
+		t.Fatal(err.Error())
+	}
+	other.Unlock(subnet)
+}
+
+func Test_Reserve(t *testing.T) {
+	f, cleanup := newFile(t)
+	defer cleanup()
+	f.InsertGatewayMap(store.GatewayMap{Subnet: "10.0.1.0/24", Gateway: "10.0.1.1"})
+	f.InsertAllocateMap(store.AllocateMap{Namespace: "default", Allocate: "10.0.1.[2-10]"})
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	ip := net.ParseIP("10.0.1.5")
+
+	if s := f.RetrieveSubnet(ip); s == nil || s.String() != subnet.String() {
+		t.Fatalf("expected subnet %s, got %v", subnet.String(), s)
+	}
+	if gw := f.RetrieveGateway(subnet); !gw.Equal(net.ParseIP("10.0.1.1")) {
+		t.Fatalf("expected gateway 10.0.1.1, got %v", gw)
+	}
+	if ok, err := f.Reserve("a", &store.Record{IP: ip, Subnet: subnet.String()}); err != nil || !ok {
+		t.Fatalf("expected reserved, got %v %v", ok, err)
+	}
+	if ok, _ := f.Reserve("b", &store.Record{IP: ip, Subnet: subnet.String()}); ok {
+		t.Fatal("expected failure when the IP is held by another container")
+	}
+	if holder, _ := f.RetrieveHolder(subnet, ip); holder != "a" {
+		t.Fatalf("expected holder a, got %s", holder)
+	}
+	if bm, _ := f.RetrieveBitmap(subnet, 0); !bm.Test(5) {
+		t.Fatal("expected the IP used in the bitmap")
+	}
+
+	if err := f.Release("a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bm, _ := f.RetrieveBitmap(subnet, 0); bm.Test(5) {
+		t.Fatal("expected the IP free in the bitmap")
+	}
+	if reservations, _ := f.RetrieveReservations(); len(reservations) != 0 {
+		t.Fatalf("expected no reservation, got %d", len(reservations))
+	}
+}
+
+func Test_Conformance(t *testing.T) {
+	storetest.Suite{
+		New: func(t *testing.T) storetest.Backend {
+			f, cleanup := newFile(t)
+			// The file is removed after the test, and closing twice is harmless.
+			t.Cleanup(cleanup)
+			return f
+		},
+		Reopen: func(t *testing.T, s storetest.Backend) storetest.Backend {
+			f, err := NewFile(s.(*File).path, time.Second)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			return f
+		},
+	}.Run(t)
+}
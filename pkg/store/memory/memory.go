@@ -0,0 +1,792 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/utils"
+)
+
+// Memory is a store keeps everything in memory, which is lost when the process exits.
+// It is useful for tests and single-node experiments without etcd.
+type Memory struct {
+	// guard protects the data below, while locks are held across calls.
+	guard sync.Mutex
+	// locks of subnets, a subnet is locked if its channel is full.
+	locks map[string]chan struct{}
+	// gateways keyed by subnet.
+	gateways map[string]string
+	// pools keyed by store.AllocateMap.Key.
+	pools map[string]string
+	// reservations keyed by container ID and IP.
+	reservations map[string]map[string]*store.Record
+	// holders keyed by subnet/IP, the value is the container ID.
+	holders map[string]string
+	// bindings keyed by namespace/pod/IP.
+	bindings map[string]net.IP
+	// pending keyed by subnet and IP, the value is the ID of the container which reserved
+	// the IP but not committed yet.
+	pending map[string]map[string]string
+	// tombstones of IPs quarantined or in conflict, keyed by subnet and IP.
+	tombstones map[string]map[string]*store.Record
+	// strategies keyed by subnet or namespace, which never contains "/".
+	strategies map[string]string
+	// cursors keyed by subnet, the value is the IP reserved last.
+	cursors map[string]net.IP
+	// released keyed by subnet/IP, the value is when the IP was released last.
+	released map[string]time.Time
+	// quotas keyed by store.QuotaMap.Key.
+	quotas map[string]store.QuotaMap
+	// used keyed by store.QuotaMap.Key, the value is the number of IPs counted by the quota.
+	used map[string]int
+	// pages keyed by subnet/page.
+	pages map[string]*bitmap.Bitmap
+}
+
+// Store implements the Store interface
+var _ store.Store = &Memory{}
+
+// Monkey implements the Monkey interface
+var _ store.Monkey = &Memory{}
+
+// NewMemory news an empty memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		locks:        make(map[string]chan struct{}),
+		gateways:     make(map[string]string),
+		pools:        make(map[string]string),
+		reservations: make(map[string]map[string]*store.Record),
+		holders:      make(map[string]string),
+		bindings:     make(map[string]net.IP),
+		pending:      make(map[string]map[string]string),
+		tombstones:   make(map[string]map[string]*store.Record),
+		strategies:   make(map[string]string),
+		cursors:      make(map[string]net.IP),
+		released:     make(map[string]time.Time),
+		quotas:       make(map[string]store.QuotaMap),
+		used:         make(map[string]int),
+		pages:        make(map[string]*bitmap.Bitmap),
+	}
+}
+
+// Lock locks the subnet, it gives up and returns error when ctx is done.
+func (m *Memory) Lock(ctx context.Context, subnet *net.IPNet) error {
+	select {
+	case m.lock(subnet) <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock unlocks the subnet.
+func (m *Memory) Unlock(subnet *net.IPNet) error {
+	select {
+	case <-m.lock(subnet):
+		return nil
+	default:
+		return fmt.Errorf("subnet %s is not locked", subnet.String())
+	}
+}
+
+// lock returns the lock of subnet.
+func (m *Memory) lock(subnet *net.IPNet) chan struct{} {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	l, ok := m.locks[subnet.String()]
+	if !ok {
+		l = make(chan struct{}, 1)
+		m.locks[subnet.String()] = l
+	}
+	return l
+}
+
+// Close does nothing.
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Status always succeeds.
+func (m *Memory) Status() error {
+	return nil
+}
+
+// Reserve keeps the record, and marks the IP as used in the bitmap.
+func (m *Memory) Reserve(id string, r *store.Record) (bool, error) {
+	subnet := r.SubnetNet()
+	if subnet == nil {
+		return false, fmt.Errorf("invalid subnet %s of record", r.Subnet)
+	}
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	if holder, ok := m.holders[indexKey(subnet, r.IP)]; ok {
+		return holder == id, nil
+	}
+	if err := m.updatePage(subnet, r.IP, (*bitmap.Bitmap).Set); err != nil {
+		return false, err
+	}
+	delete(m.tombstones[subnet.String()], r.IP.String())
+	m.cursors[subnet.String()] = r.IP
+	record := *r
+	if record.Created.IsZero() {
+		record.Created = time.Now()
+	}
+	record.Updated = record.Created
+	record.Version = store.RecordVersion
+	if m.reservations[id] == nil {
+		m.reservations[id] = make(map[string]*store.Record)
+	}
+	m.reservations[id][r.IP.String()] = &record
+	m.holders[indexKey(subnet, r.IP)] = id
+	for _, key := range store.QuotaKeys(&record) {
+		m.used[key]++
+	}
+	if record.Pending() {
+		if m.pending[subnet.String()] == nil {
+			m.pending[subnet.String()] = make(map[string]string)
+		}
+		m.pending[subnet.String()][r.IP.String()] = id
+	}
+	return true, nil
+}
+
+// Release releases the IPs held by the container, the IPs bound to pods are kept used.
+func (m *Memory) Release(id string) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	for _, r := range m.reservations[id] {
+		if err := m.release(id, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine releases the IPs held by the container, and keeps them used until the time given.
+func (m *Memory) Quarantine(id string, until time.Time) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	for _, r := range m.reservations[id] {
+		if err := m.release(id, r); err != nil {
+			return err
+		}
+		if _, bound := m.bindings[bindingKey(r.Namespace, r.Pod, r.IP)]; bound {
+			continue
+		}
+		m.bury(r.Tombstone(store.StateQuarantined, until))
+		if err := m.updatePage(r.SubnetNet(), r.IP, (*bitmap.Bitmap).Set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Conflict releases the IPs held by the container, and keeps ip used until the mark is removed.
+func (m *Memory) Conflict(id string, ip net.IP) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	for _, r := range m.reservations[id] {
+		if err := m.release(id, r); err != nil {
+			return err
+		}
+		if !r.IP.Equal(ip) {
+			continue
+		}
+		delete(m.bindings, bindingKey(r.Namespace, r.Pod, r.IP))
+		m.bury(r.Tombstone(store.StateConflict, time.Time{}))
+		if err := m.updatePage(r.SubnetNet(), r.IP, (*bitmap.Bitmap).Set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release releases the IP reserved by the container, it must be called with guard held.
+func (m *Memory) release(id string, r *store.Record) error {
+	subnet := r.SubnetNet()
+	delete(m.holders, indexKey(subnet, r.IP))
+	delete(m.pending[subnet.String()], r.IP.String())
+	delete(m.reservations[id], r.IP.String())
+	if len(m.reservations[id]) == 0 {
+		delete(m.reservations, id)
+	}
+	for _, key := range store.QuotaKeys(r) {
+		if m.used[key]--; m.used[key] <= 0 {
+			delete(m.used, key)
+		}
+	}
+	m.released[indexKey(subnet, r.IP)] = time.Now()
+	if _, bound := m.bindings[bindingKey(r.Namespace, r.Pod, r.IP)]; bound {
+		return nil
+	}
+	return m.updatePage(subnet, r.IP, (*bitmap.Bitmap).Clear)
+}
+
+// bury keeps the tombstone of the IP, it must be called with guard held.
+func (m *Memory) bury(t *store.Record) {
+	subnet := t.SubnetNet().String()
+	if m.tombstones[subnet] == nil {
+		m.tombstones[subnet] = make(map[string]*store.Record)
+	}
+	m.tombstones[subnet][t.IP.String()] = t
+}
+
+// Commit commits the pending reservations of the container.
+func (m *Memory) Commit(id string) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for _, r := range m.reservations[id] {
+		if r.Pending() {
+			r.Commit()
+			delete(m.pending[r.SubnetNet().String()], r.IP.String())
+		}
+	}
+	return nil
+}
+
+// Reclaim releases the pending reservations in subnet which are expired,
+// and frees the IPs in subnet whose quarantine is over.
+func (m *Memory) Reclaim(subnet *net.IPNet) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	now := time.Now()
+	for ip, id := range m.pending[subnet.String()] {
+		r := m.reservations[id][ip]
+		if r == nil || !r.Expired(now) {
+			continue
+		}
+		if err := m.release(id, r); err != nil {
+			return err
+		}
+	}
+	for ip, t := range m.tombstones[subnet.String()] {
+		if !t.Expired(now) {
+			continue
+		}
+		delete(m.tombstones[subnet.String()], ip)
+		if err := m.updatePage(subnet, t.IP, (*bitmap.Bitmap).Clear); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bind binds the IP to the pod.
+func (m *Memory) Bind(namespace string, podName string, ip net.IP) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	m.bindings[bindingKey(namespace, podName, ip)] = ip
+	return nil
+}
+
+// Unbind removes the binding of the IP to the pod,
+// and marks the IP as free in the bitmap unless it is held by a container.
+func (m *Memory) Unbind(namespace string, podName string, ip net.IP) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+
+	if _, ok := m.bindings[bindingKey(namespace, podName, ip)]; !ok {
+		return nil
+	}
+	delete(m.bindings, bindingKey(namespace, podName, ip))
+	subnet := m.retrieveSubnet(ip)
+	if subnet == nil {
+		return nil
+	}
+	if _, held := m.holders[indexKey(subnet, ip)]; held {
+		return nil
+	}
+	return m.updatePage(subnet, ip, (*bitmap.Bitmap).Clear)
+}
+
+// RetrieveGateway retrieves gateway for subnet.
+func (m *Memory) RetrieveGateway(subnet *net.IPNet) net.IP {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	return net.ParseIP(m.gateways[subnet.String()])
+}
+
+// RetrieveSubnet retrieves the subnet contains ip.
+func (m *Memory) RetrieveSubnet(ip net.IP) *net.IPNet {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	return m.retrieveSubnet(ip)
+}
+
+func (m *Memory) retrieveSubnet(ip net.IP) *net.IPNet {
+	for s := range m.gateways {
+		_, subnet, err := net.ParseCIDR(s)
+		if err == nil && subnet.Contains(ip) {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// RetrieveAllocated retrieves the IPs in subnet allocated to namespace.
+func (m *Memory) RetrieveAllocated(namespace string, subnet *net.IPNet) (*utils.RangeSet, error) {
+	m.guard.Lock()
+	pool, ok := m.pools[namespace]
+	m.guard.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no IP allocated for %s found in store", namespace)
+	}
+	ret := utils.RangeSet{}
+	return ret.Concat(pool, subnet)
+}
+
+// RetrieveBitmap retrieves a copy of the page of the bitmap of used IPs in subnet.
+func (m *Memory) RetrieveBitmap(subnet *net.IPNet, page uint64) (*bitmap.Bitmap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	bm, ok := m.pages[pageKey(subnet, page)]
+	if !ok {
+		return bitmap.New(), nil
+	}
+	return bitmap.FromBytes(bm.Bytes())
+}
+
+// RetrieveHolder retrieves the ID of the container which holds the IP.
+func (m *Memory) RetrieveHolder(subnet *net.IPNet, ip net.IP) (string, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	return m.holders[indexKey(subnet, ip)], nil
+}
+
+// RetrieveTombstone retrieves a copy of the tombstone of the IP quarantined or in conflict.
+func (m *Memory) RetrieveTombstone(subnet *net.IPNet, ip net.IP) (*store.Record, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	t, ok := m.tombstones[subnet.String()][ip.String()]
+	if !ok {
+		return nil, nil
+	}
+	ret := *t
+	return &ret, nil
+}
+
+// RetrieveBindings retrieves the IPs bound to pods in namespace, keyed by pod name.
+func (m *Memory) RetrieveBindings(namespace string) (map[string][]net.IP, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	ret := make(map[string][]net.IP)
+	for _, bm := range m.allBinding() {
+		if bm.Namespace == namespace {
+			ret[bm.Pod] = append(ret[bm.Pod], net.ParseIP(bm.IP))
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveSubnets retrieves the subnets of the IPs held by the container.
+func (m *Memory) RetrieveSubnets(id string) ([]*net.IPNet, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	ret := make([]*net.IPNet, 0)
+	for _, r := range m.reservations[id] {
+		ret = append(ret, r.SubnetNet())
+	}
+	return ret, nil
+}
+
+// RetrieveReservations retrieves copies of all the reservations.
+func (m *Memory) RetrieveReservations() (map[string][]*store.Record, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	ret := make(map[string][]*store.Record)
+	for id, records := range m.reservations {
+		for _, r := range records {
+			record := *r
+			ret[id] = append(ret[id], &record)
+		}
+	}
+	return ret, nil
+}
+
+// RetrieveStrategy retrieves the allocation strategy of the namespace or the subnet.
+func (m *Memory) RetrieveStrategy(namespace string, subnet *net.IPNet) (string, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	if s, ok := m.strategies[namespace]; ok {
+		return s, nil
+	}
+	return m.strategies[subnet.String()], nil
+}
+
+// RetrieveQuotas retrieves the quotas of the namespace.
+func (m *Memory) RetrieveQuotas(namespace string) ([]store.QuotaMap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	qms := make([]store.QuotaMap, 0)
+	for _, qm := range m.quotas {
+		if qm.Namespace == namespace {
+			qms = append(qms, qm)
+		}
+	}
+	return qms, nil
+}
+
+// RetrieveUsed retrieves the number of IPs reserved which are counted by the quota.
+func (m *Memory) RetrieveUsed(qm store.QuotaMap) (int, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	return m.used[qm.Key()], nil
+}
+
+// RetrieveLabeledPools retrieves the allocate maps of the namespace with label set.
+func (m *Memory) RetrieveLabeledPools(namespace string) ([]store.AllocateMap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	ams := make([]store.AllocateMap, 0)
+	for key, allocate := range m.pools {
+		if am := store.ParseAllocateKey(key, allocate); am.Namespace == namespace && am.Label != "" {
+			ams = append(ams, am)
+		}
+	}
+	return ams, nil
+}
+
+// RetrieveCursor retrieves the IP reserved last in subnet.
+func (m *Memory) RetrieveCursor(subnet *net.IPNet) (net.IP, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	return m.cursors[subnet.String()], nil
+}
+
+// RetrieveReleased retrieves when the IPs in subnet were released last.
+func (m *Memory) RetrieveReleased(subnet *net.IPNet) (map[string]time.Time, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	ret := make(map[string]time.Time)
+	for key, released := range m.released {
+		if strings.HasPrefix(key, subnet.String()+"/") {
+			ret[strings.TrimPrefix(key, subnet.String()+"/")] = released
+		}
+	}
+	return ret, nil
+}
+
+// AllGatewayMap gets all gateway map in the store
+func (m *Memory) AllGatewayMap() (*[]store.GatewayMap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	gms := make([]store.GatewayMap, 0)
+	for subnet, gw := range m.gateways {
+		gms = append(gms, store.GatewayMap{
+			Subnet:  subnet,
+			Gateway: gw,
+		})
+	}
+	sort.Slice(gms, func(i, j int) bool { return gms[i].Subnet < gms[j].Subnet })
+	return &gms, nil
+}
+
+// InsertGatewayMap inserts a gateway map
+func (m *Memory) InsertGatewayMap(gm store.GatewayMap) error {
+	if _, _, err := net.ParseCIDR(gm.Subnet); err != nil {
+		return err
+	}
+	if net.ParseIP(gm.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %s", gm.Gateway)
+	}
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	m.gateways[gm.Subnet] = gm.Gateway
+	return nil
+}
+
+// DeleteGatewayMap deletes gateway maps
+func (m *Memory) DeleteGatewayMap(gms []store.GatewayMap) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for _, gm := range gms {
+		delete(m.gateways, gm.Subnet)
+		delete(m.strategies, gm.Subnet)
+	}
+	return nil
+}
+
+// RetrieveUsedbyNamespace retrieves the reservations of namespace, or all of them for admin.
+func (m *Memory) RetrieveUsedbyNamespace(namespace string, adminRole bool) (*[]store.Record, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	records := make([]store.Record, 0)
+	for _, rs := range m.reservations {
+		for _, r := range rs {
+			if adminRole || r.Namespace == namespace {
+				records = append(records, *r)
+			}
+		}
+	}
+	return &records, nil
+}
+
+// AllQuarantined gets the tombstones of the IPs quarantined.
+func (m *Memory) AllQuarantined() (*[]store.Record, error) {
+	return m.allTombstone(store.StateQuarantined), nil
+}
+
+// AllConflict gets the tombstones of the IPs in conflict.
+func (m *Memory) AllConflict() (*[]store.Record, error) {
+	return m.allTombstone(store.StateConflict), nil
+}
+
+// allTombstone returns the tombstones in the state given, sorted by IP.
+func (m *Memory) allTombstone(state string) *[]store.Record {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	records := make([]store.Record, 0)
+	for _, tombstones := range m.tombstones {
+		for _, t := range tombstones {
+			if t.State == state {
+				records = append(records, *t)
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].IP.String() < records[j].IP.String() })
+	return &records
+}
+
+// DeleteConflict removes the conflict marks of the IPs, and marks them as free.
+func (m *Memory) DeleteConflict(ips []net.IP) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for subnet, tombstones := range m.tombstones {
+		for _, ip := range ips {
+			t, ok := tombstones[ip.String()]
+			if !ok || !t.Conflicted() {
+				continue
+			}
+			delete(m.tombstones[subnet], ip.String())
+			if err := m.updatePage(t.SubnetNet(), t.IP, (*bitmap.Bitmap).Clear); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AllAllocate gets all allocate map
+func (m *Memory) AllAllocate() (*[]store.AllocateMap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	ams := make([]store.AllocateMap, 0)
+	for key, allocate := range m.pools {
+		ams = append(ams, store.ParseAllocateKey(key, allocate))
+	}
+	sort.Slice(ams, func(i, j int) bool { return ams[i].Key() < ams[j].Key() })
+	return &ams, nil
+}
+
+// InsertAllocateMap inserts a allocate map
+func (m *Memory) InsertAllocateMap(am store.AllocateMap) error {
+	if err := am.Validate(); err != nil {
+		return err
+	}
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	m.pools[am.Key()] = am.Allocate
+	return nil
+}
+
+// DeleteAllocateMap deletes allocate maps
+func (m *Memory) DeleteAllocateMap(ams []store.AllocateMap) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for _, am := range ams {
+		delete(m.pools, am.Key())
+		if am.Label != "" {
+			continue
+		}
+		delete(m.strategies, am.Namespace)
+		for key, qm := range m.quotas {
+			if qm.Namespace == am.Namespace {
+				delete(m.quotas, key)
+			}
+		}
+	}
+	return nil
+}
+
+// AllStrategy gets all strategy map
+func (m *Memory) AllStrategy() (*[]store.StrategyMap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	sms := make([]store.StrategyMap, 0)
+	for key, strategy := range m.strategies {
+		sm := store.StrategyMap{Namespace: key, Strategy: strategy}
+		if strings.Contains(key, "/") {
+			sm = store.StrategyMap{Subnet: key, Strategy: strategy}
+		}
+		sms = append(sms, sm)
+	}
+	sort.Slice(sms, func(i, j int) bool { return sms[i].Key() < sms[j].Key() })
+	return &sms, nil
+}
+
+// InsertStrategyMap inserts a strategy map
+func (m *Memory) InsertStrategyMap(sm store.StrategyMap) error {
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	if sm.Subnet != "" {
+		if _, ok := m.gateways[sm.Subnet]; !ok {
+			return fmt.Errorf("no gateway of %s found in store", sm.Subnet)
+		}
+		m.strategies[sm.Subnet] = sm.Strategy
+		return nil
+	}
+	if _, ok := m.pools[sm.Namespace]; !ok {
+		return fmt.Errorf("no IP allocated for %s found in store", sm.Namespace)
+	}
+	m.strategies[sm.Namespace] = sm.Strategy
+	return nil
+}
+
+// DeleteStrategyMap deletes strategy maps
+func (m *Memory) DeleteStrategyMap(sms []store.StrategyMap) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for _, sm := range sms {
+		delete(m.strategies, sm.Key())
+	}
+	return nil
+}
+
+// AllQuota gets all quota map
+func (m *Memory) AllQuota() (*[]store.QuotaMap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	qms := make([]store.QuotaMap, 0)
+	for _, qm := range m.quotas {
+		qms = append(qms, qm)
+	}
+	sort.Slice(qms, func(i, j int) bool { return qms[i].Key() < qms[j].Key() })
+	return &qms, nil
+}
+
+// InsertQuotaMap inserts a quota map
+func (m *Memory) InsertQuotaMap(qm store.QuotaMap) error {
+	if err := qm.Validate(); err != nil {
+		return err
+	}
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	if _, ok := m.pools[qm.Namespace]; !ok {
+		return fmt.Errorf("no IP allocated for %s found in store", qm.Namespace)
+	}
+	m.quotas[qm.Key()] = qm
+	return nil
+}
+
+// DeleteQuotaMap deletes quota maps
+func (m *Memory) DeleteQuotaMap(qms []store.QuotaMap) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for _, qm := range qms {
+		delete(m.quotas, qm.Key())
+	}
+	return nil
+}
+
+// AllBinding gets all binding map
+func (m *Memory) AllBinding() (*[]store.BindingMap, error) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	bms := m.allBinding()
+	return &bms, nil
+}
+
+func (m *Memory) allBinding() []store.BindingMap {
+	bms := make([]store.BindingMap, 0)
+	for key, ip := range m.bindings {
+		// Keys are in format of namespace/pod/ip
+		parts := strings.SplitN(key, "/", 3)
+		bms = append(bms, store.BindingMap{
+			IP:        ip.String(),
+			Pod:       parts[1],
+			Namespace: parts[0],
+		})
+	}
+	sort.Slice(bms, func(i, j int) bool { return bms[i].IP < bms[j].IP })
+	return bms
+}
+
+// DeleteBindingMap deletes binding maps, then the IPs could be used by other pods.
+func (m *Memory) DeleteBindingMap(bms []store.BindingMap) error {
+	for _, bm := range bms {
+		ip := net.ParseIP(bm.IP)
+		if ip == nil {
+			return fmt.Errorf("invalid IP %s", bm.IP)
+		}
+		subnet := m.RetrieveSubnet(ip)
+		if subnet == nil {
+			// The subnet is gone, nothing to update except the binding.
+			m.guard.Lock()
+			delete(m.bindings, bindingKey(bm.Namespace, bm.Pod, ip))
+			m.guard.Unlock()
+			continue
+		}
+		if err := m.unbindWithLock(subnet, bm.Namespace, bm.Pod, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) unbindWithLock(subnet *net.IPNet, namespace, pod string, ip net.IP) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	if err := m.Lock(ctx, subnet); err != nil {
+		return err
+	}
+	defer m.Unlock(subnet)
+	return m.Unbind(namespace, pod, ip)
+}
+
+// updatePage updates the bit of ip in the page, it must be called with guard held.
+func (m *Memory) updatePage(subnet *net.IPNet, ip net.IP, update func(*bitmap.Bitmap, uint32)) error {
+	page, i, err := bitmap.Locate(subnet, ip)
+	if err != nil {
+		return err
+	}
+	bm, ok := m.pages[pageKey(subnet, page)]
+	if !ok {
+		bm = bitmap.New()
+		m.pages[pageKey(subnet, page)] = bm
+	}
+	update(bm, i)
+	return nil
+}
+
+func indexKey(subnet *net.IPNet, ip net.IP) string {
+	return subnet.String() + "/" + ip.String()
+}
+
+func pageKey(subnet *net.IPNet, page uint64) string {
+	return fmt.Sprintf("%s/%d", subnet.String(), page)
+}
+
+func bindingKey(namespace, pod string, ip net.IP) string {
+	return namespace + "/" + pod + "/" + ip.String()
+}
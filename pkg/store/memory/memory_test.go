@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package memory
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hainesc/anchor/pkg/store"
+	"github.com/hainesc/anchor/pkg/store/storetest"
+)
+
+func Test_Lock(t *testing.T) {
+	m := NewMemory()
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	_, other, _ := net.ParseCIDR("10.0.2.0/24")
+	if err := m.Lock(context.Background(), subnet); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Lock(ctx, subnet); err == nil {
+		t.Fatal("expected error when the subnet is locked")
+	}
+	if err := m.Lock(context.Background(), other); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		m.Lock(context.Background(), subnet)
+		close(locked)
+	}()
+	if err := m.Unlock(subnet); err != nil {
+		t.Fatal(err.Error())
+	}
+	<-locked
+	m.Unlock(subnet)
+	if err := m.Unlock(subnet); err == nil {
+		t.Fatal("expected error when unlock twice")
+	}
+}
+
+func Test_Reserve(t *testing.T) {
+	m := NewMemory()
+	m.InsertGatewayMap(store.GatewayMap{Subnet: "10.0.1.0/24", Gateway: "10.0.1.1"})
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	ip := net.ParseIP("10.0.1.5")
+	r := &store.Record{IP: ip, Subnet: subnet.String(), Pod: "web-0", Namespace: "default"}
+
+	if ok, err := m.Reserve("a", r); err != nil || !ok {
+		t.Fatalf("expected reserved, got %v %v", ok, err)
+	}
+	if ok, _ := m.Reserve("b", r); ok {
+		t.Fatal("expected failure when the IP is held by another container")
+	}
+	if ok, _ := m.Reserve("a", r); !ok {
+		t.Fatal("expected success when the IP is reserved again by the same container")
+	}
+	bm, _ := m.RetrieveBitmap(subnet, 0)
+	if !bm.Test(5) {
+		t.Fatal("expected the IP used in the bitmap")
+	}
+	// The bitmap retrieved is a copy.
+	bm.Clear(5)
+	if bm, _ = m.RetrieveBitmap(subnet, 0); !bm.Test(5) {
+		t.Fatal("expected the bitmap unchanged")
+	}
+
+	// Bound IPs are kept used after released.
+	m.Bind("default", "web-0", ip)
+	m.Release("a")
+	if holder, _ := m.RetrieveHolder(subnet, ip); holder != "" {
+		t.Fatalf("expected no holder, got %s", holder)
+	}
+	if bm, _ = m.RetrieveBitmap(subnet, 0); !bm.Test(5) {
+		t.Fatal("expected the bound IP used in the bitmap")
+	}
+	m.Unbind("default", "web-0", ip)
+	if bm, _ = m.RetrieveBitmap(subnet, 0); bm.Test(5) {
+		t.Fatal("expected the IP free in the bitmap")
+	}
+}
+
+func Test_Conformance(t *testing.T) {
+	storetest.Suite{
+		New: func(t *testing.T) storetest.Backend { return NewMemory() },
+		// Plugins in the same process share the store.
+		Reopen: func(t *testing.T, s storetest.Backend) storetest.Backend { return s },
+	}.Run(t)
+}
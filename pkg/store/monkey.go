@@ -0,0 +1,231 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package store
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Monkey is the interface used by powder monkey to display and operate the store.
+type Monkey interface {
+	Close() error
+	AllGatewayMap() (*[]GatewayMap, error)
+	InsertGatewayMap(gm GatewayMap) error
+	DeleteGatewayMap(gms []GatewayMap) error
+	// RetrieveUsedbyNamespace retrieves the reservations of namespace, or all of them for admin.
+	RetrieveUsedbyNamespace(namespace string, adminRole bool) (*[]Record, error)
+	AllAllocate() (*[]AllocateMap, error)
+	InsertAllocateMap(am AllocateMap) error
+	DeleteAllocateMap(ams []AllocateMap) error
+	AllBinding() (*[]BindingMap, error)
+	// DeleteBindingMap deletes binding maps, then the IPs could be used by other pods.
+	DeleteBindingMap(bms []BindingMap) error
+	// AllQuarantined gets the tombstones of the IPs quarantined, see StateQuarantined.
+	AllQuarantined() (*[]Record, error)
+	// AllConflict gets the tombstones of the IPs in conflict, see StateConflict.
+	AllConflict() (*[]Record, error)
+	// DeleteConflict removes the conflict marks of the IPs, then they could be allocated again.
+	DeleteConflict(ips []net.IP) error
+	AllStrategy() (*[]StrategyMap, error)
+	// InsertStrategyMap returns error if the subnet or the namespace has no gateway map
+	// or allocate map, since the strategy is kept alongside.
+	InsertStrategyMap(sm StrategyMap) error
+	DeleteStrategyMap(sms []StrategyMap) error
+	AllQuota() (*[]QuotaMap, error)
+	// InsertQuotaMap returns error if the namespace has no allocate map, since the quotas
+	// are kept alongside. The quota with the same key is replaced.
+	InsertQuotaMap(qm QuotaMap) error
+	DeleteQuotaMap(qms []QuotaMap) error
+}
+
+// GatewayMap is the map of subnet and gateway, used by monkey
+type GatewayMap struct {
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gw"`
+}
+
+// AllocateMap is the map of dedicated IPs and the namespace, used by monkey.
+// If the label is set, the IPs are dedicated to the pods of the namespace selected
+// by it, and the other pods of the namespace do not use them.
+type AllocateMap struct {
+	Allocate  string `json:"ips"`
+	Namespace string `json:"ns"`
+	// Label selects the pods by the labels, such as app=payments,tier=backend,
+	// all of which should be matched.
+	Label string `json:"label,omitempty"`
+}
+
+// Key returns the namespace of the allocate map, followed by the label if set.
+func (am *AllocateMap) Key() string {
+	if am.Label == "" {
+		return am.Namespace
+	}
+	return am.Namespace + "/" + am.Label
+}
+
+// Validate returns error if the allocate map is invalid.
+func (am *AllocateMap) Validate() error {
+	if am.Namespace == "" {
+		return fmt.Errorf("namespace should be set for allocate map")
+	}
+	if am.Label == "" {
+		return nil
+	}
+	for _, req := range strings.Split(am.Label, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid label selector %q", am.Label)
+		}
+	}
+	return nil
+}
+
+// Selects returns true if the labels match the label selector of the allocate map.
+func (am *AllocateMap) Selects(labels map[string]string) bool {
+	if am.Label == "" {
+		return false
+	}
+	for _, req := range strings.Split(am.Label, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 {
+			return false
+		}
+		if v, ok := labels[strings.TrimSpace(kv[0])]; !ok || v != strings.TrimSpace(kv[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAllocateKey returns the allocate map of the key, which is returned by Key.
+func ParseAllocateKey(key, allocate string) AllocateMap {
+	kv := strings.SplitN(key, "/", 2)
+	am := AllocateMap{Namespace: kv[0], Allocate: allocate}
+	if len(kv) == 2 {
+		am.Label = kv[1]
+	}
+	return am
+}
+
+// StrategyMap is the map of the allocation strategy and the subnet or the namespace,
+// only one of which is set, used by monkey
+type StrategyMap struct {
+	Subnet    string `json:"subnet,omitempty"`
+	Namespace string `json:"ns,omitempty"`
+	Strategy  string `json:"strategy"`
+}
+
+// Key returns the subnet or the namespace of the strategy map.
+func (sm *StrategyMap) Key() string {
+	return sm.Subnet + sm.Namespace
+}
+
+// Validate returns error if the strategy map is invalid, and normalizes the subnet.
+func (sm *StrategyMap) Validate() error {
+	if (sm.Subnet == "") == (sm.Namespace == "") {
+		return fmt.Errorf("exactly one of subnet and namespace should be set for strategy")
+	}
+	if sm.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(sm.Subnet)
+		if err != nil {
+			return err
+		}
+		sm.Subnet = subnet.String()
+	}
+	for _, s := range Strategies {
+		if sm.Strategy == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown strategy %q", sm.Strategy)
+}
+
+// QuotaMap is the max number of IPs held by the pods of a namespace, used by monkey.
+// It counts only the IPs in the subnet, or the ones held by the pods of the controller,
+// if either is set.
+type QuotaMap struct {
+	Namespace  string `json:"ns"`
+	Subnet     string `json:"subnet,omitempty"`
+	Controller string `json:"ctrl,omitempty"`
+	Max        int    `json:"max"`
+}
+
+// Key returns the namespace of the quota map, followed by the subnet or the controller.
+func (qm *QuotaMap) Key() string {
+	switch {
+	case qm.Subnet != "":
+		return qm.Namespace + "/subnet/" + qm.Subnet
+	case qm.Controller != "":
+		return qm.Namespace + "/ctrl/" + qm.Controller
+	}
+	return qm.Namespace
+}
+
+// Validate returns error if the quota map is invalid, and normalizes the subnet.
+func (qm *QuotaMap) Validate() error {
+	if qm.Namespace == "" {
+		return fmt.Errorf("namespace should be set for quota")
+	}
+	if qm.Subnet != "" && qm.Controller != "" {
+		return fmt.Errorf("at most one of subnet and controller should be set for quota")
+	}
+	if qm.Max < 0 {
+		return fmt.Errorf("invalid max %d of quota", qm.Max)
+	}
+	if qm.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(qm.Subnet)
+		if err != nil {
+			return err
+		}
+		qm.Subnet = subnet.String()
+	}
+	return nil
+}
+
+// Counts returns true if the IP reserved by r is counted by the quota.
+func (qm *QuotaMap) Counts(r *Record) bool {
+	return r.Namespace == qm.Namespace &&
+		(qm.Subnet == "" || r.Subnet == qm.Subnet) &&
+		(qm.Controller == "" || r.Controller == qm.Controller)
+}
+
+// QuotaKeys returns the keys of all the quotas which could count the IP reserved by r,
+// the stores keep the number of IPs used by these keys, see Store.RetrieveUsed. There is
+// none if r has no namespace, since quotas are always set for namespaces.
+func QuotaKeys(r *Record) []string {
+	if r.Namespace == "" {
+		return nil
+	}
+	keys := []string{
+		(&QuotaMap{Namespace: r.Namespace}).Key(),
+		(&QuotaMap{Namespace: r.Namespace, Subnet: r.Subnet}).Key(),
+	}
+	if r.Controller != "" {
+		keys = append(keys, (&QuotaMap{Namespace: r.Namespace, Controller: r.Controller}).Key())
+	}
+	return keys
+}
+
+// BindingMap is the map of sticky IP and the pod, used by monkey
+type BindingMap struct {
+	IP        string `json:"ip"`
+	Pod       string `json:"pod"`
+	Namespace string `json:"ns"`
+}
+
+// InUsedMap is the map of ContainerID and its IP, used by monkey
+type InUsedMap struct {
+	ContainerID string `json:"id"`
+	IP          net.IP `json:"ip"`
+	Pod         string `json:"pod"`
+	Namespace   string `json:"ns"`
+	App         string `json:"app,omitempty"`
+	Service     string `json:"svc,omitempty"`
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// RecordVersion is the version of the schema of Record written by this version.
+const RecordVersion = 1
+
+// Record is the reservation of an IP, which is stored in JSON.
+type Record struct {
+	Version    int    `json:"version"`
+	IP         net.IP `json:"ip"`
+	Subnet     string `json:"subnet,omitempty"`
+	Pod        string `json:"pod"`
+	Namespace  string `json:"ns"`
+	Controller string `json:"controller,omitempty"`
+	Node       string `json:"node,omitempty"`
+	IfName     string `json:"ifname,omitempty"`
+	// Network is the name of the CNI network, a pod may be attached to several networks.
+	Network string    `json:"network,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	Updated time.Time `json:"updated,omitempty"`
+	// State is empty for the records written before leases, which are committed.
+	State string `json:"state,omitempty"`
+	// Expires is when the pending reservation is reclaimed, or the quarantine is over.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// States of reservations. A reservation is pending until the interface of the container
+// is configured, and it is reclaimed if not committed before it expires, so the IP is not
+// lost when ADD fails halfway and the DEL for cleanup fails too.
+//
+// A released IP could be quarantined for a while before allocated again, since switches and
+// firewalls may still point it to the container released. The tombstone of the IP is a
+// record in StateQuarantined, which keeps the last holder.
+//
+// An IP found in use by a host outside of anchor, such as a VM configured by hand, is
+// marked in StateConflict by a tombstone too, which never expires but is removed by monkey.
+const (
+	StatePending     = "pending"
+	StateCommitted   = "committed"
+	StateQuarantined = "quarantined"
+	StateConflict    = "conflict"
+)
+
+// Pending returns true if the reservation is not committed yet.
+func (r *Record) Pending() bool {
+	return r.State == StatePending
+}
+
+// Quarantined returns true if the record is the tombstone of an IP released.
+func (r *Record) Quarantined() bool {
+	return r.State == StateQuarantined
+}
+
+// Conflicted returns true if the record is the tombstone of an IP in conflict.
+func (r *Record) Conflicted() bool {
+	return r.State == StateConflict
+}
+
+// Expired returns true if the reservation is pending, or the record is a tombstone,
+// and it expires before now.
+func (r *Record) Expired(now time.Time) bool {
+	return (r.Pending() || r.Quarantined()) && r.Expires.Before(now)
+}
+
+// Tombstone returns the tombstone of the IP reserved in the state given, which is
+// StateQuarantined until the time given, or StateConflict.
+func (r *Record) Tombstone(state string, until time.Time) *Record {
+	t := *r
+	t.State = state
+	t.Expires = until
+	t.Updated = time.Now()
+	return &t
+}
+
+// Commit marks the reservation as committed.
+func (r *Record) Commit() {
+	r.State = StateCommitted
+	r.Expires = time.Time{}
+	r.Updated = time.Now()
+}
+
+// Marshal marshals the record in the schema of RecordVersion.
+func (r *Record) Marshal() ([]byte, error) {
+	r.Version = RecordVersion
+	return json.Marshal(r)
+}
+
+// SubnetNet returns the subnet of the record, nil if unknown.
+func (r *Record) SubnetNet() *net.IPNet {
+	_, subnet, err := net.ParseCIDR(r.Subnet)
+	if err != nil {
+		return nil
+	}
+	return subnet
+}
+
+// ParseRecord parses the record in JSON, or in comma separated values written by the
+// early versions, which is in format of ip,pod,namespace,controller[,subnet].
+func ParseRecord(value []byte) (*Record, error) {
+	s := strings.TrimSpace(string(value))
+	if strings.HasPrefix(s, "{") {
+		r := &Record{}
+		if err := json.Unmarshal(value, r); err != nil {
+			return nil, fmt.Errorf("invalid record %s: %v", s, err)
+		}
+		if r.Version > RecordVersion {
+			return nil, fmt.Errorf("record version %d is newer than %d supported", r.Version, RecordVersion)
+		}
+		if r.IP == nil {
+			return nil, fmt.Errorf("invalid record %s: missing ip", s)
+		}
+		return r, nil
+	}
+
+	row := strings.Split(s, ",")
+	if len(row) < 3 || net.ParseIP(row[0]) == nil {
+		return nil, fmt.Errorf("invalid record %s", s)
+	}
+	r := &Record{
+		IP:        net.ParseIP(row[0]),
+		Pod:       row[1],
+		Namespace: row[2],
+	}
+	if len(row) > 3 {
+		r.Controller = row[3]
+	}
+	if len(row) > 4 {
+		r.Subnet = row[4]
+	}
+	return r, nil
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+package store
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_ParseRecord(t *testing.T) {
+	legacy, err := ParseRecord([]byte("10.0.1.5,web-0,default,web,10.0.1.0/24"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !legacy.IP.Equal(net.ParseIP("10.0.1.5")) || legacy.Pod != "web-0" ||
+		legacy.Namespace != "default" || legacy.Controller != "web" || legacy.Version != 0 {
+		t.Fatalf("unexpected record %+v", legacy)
+	}
+	if legacy.SubnetNet().String() != "10.0.1.0/24" {
+		t.Fatalf("expected subnet 10.0.1.0/24, got %v", legacy.SubnetNet())
+	}
+
+	value, err := legacy.Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r, err := ParseRecord(value)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Version != RecordVersion || !r.IP.Equal(legacy.IP) || r.Subnet != legacy.Subnet {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	if _, err = ParseRecord([]byte("10.0.1.5,web-0")); err == nil {
+		t.Fatal("expected error for truncated record")
+	}
+	if _, err = ParseRecord([]byte(`{"version":99,"ip":"10.0.1.5"}`)); err == nil {
+		t.Fatal("expected error for unknown version")
+	}
+}
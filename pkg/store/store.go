@@ -8,19 +8,95 @@
 package store
 
 import (
+	"context"
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
 	"github.com/hainesc/anchor/pkg/utils"
 	"net"
+	"time"
 )
 
 // Store is the store interface for anchor
+//
+// Locks are scoped by subnet, so allocations in different subnets do not block each other.
+// Reserve, Release, Bind, Unbind and RetrieveBitmap should be called with the lock of the subnet
+// held, so that the bitmap read is not changed by others before the allocation is done. The
+// lock is an optimization rather than a guarantee: Reserve is atomic by itself, and two
+// containers never hold the same IP even if the lock is not held or not exclusive, such as
+// the lock of the crd store which locks nothing. The other retrieve methods read the
+// configuration and could be called without lock.
+//
+// The conformance tests of the contract are in package storetest.
 type Store interface {
-	Lock() error
-	Unlock() error
+	// Lock locks the subnet, it gives up and returns error when ctx is done.
+	Lock(ctx context.Context, subnet *net.IPNet) error
+	Unlock(subnet *net.IPNet) error
 	Close() error
-	Reserve(id string, ip net.IP, podName string, podNamespace string, controller string) (bool, error)
+	// Status returns error if the store is unreachable.
+	Status() error
+	// Reserve and Release keep the bitmap of used IPs up to date.
+	// Reserve returns false if the IP is held by another container, and true if it is
+	// held by the same container already.
+	Reserve(id string, r *Record) (bool, error)
+	// Release is idempotent, it is not an error if the container holds nothing.
 	Release(id string) error
+	// Quarantine releases the IPs held by the container as Release does, but keeps them
+	// used until the time given, see StateQuarantined. The IPs bound to pods are not
+	// quarantined since they are kept used anyway. Reserve lifts the quarantine, so the
+	// caller should check RetrieveTombstone before reserving an IP requested explicitly.
+	Quarantine(id string, until time.Time) error
+	// Conflict releases the IPs held by the container as Release does, but keeps ip used
+	// since it is found in use by a host outside of anchor, see StateConflict. The binding
+	// of ip is deleted, so the pod gets another IP next time. Reserve lifts the mark too,
+	// see Quarantine.
+	Conflict(id string, ip net.IP) error
+	// Commit commits the pending reservations of the container, see StatePending.
+	Commit(id string) error
+	// Reclaim releases the pending reservations in subnet which are expired, and frees
+	// the IPs in subnet whose quarantine is over.
+	Reclaim(subnet *net.IPNet) error
+	// Bind binds the IP to the pod, the binding survives Release.
+	Bind(namespace string, podName string, ip net.IP) error
+	Unbind(namespace string, podName string, ip net.IP) error
 
 	RetrieveGateway(subnet *net.IPNet) net.IP // return nil if error
+	RetrieveSubnet(ip net.IP) *net.IPNet      // return nil if error
 	RetrieveAllocated(namespace string, subnet *net.IPNet) (*utils.RangeSet, error)
-	RetrieveUsed(namespace string, subnet *net.IPNet) (*utils.RangeSet, error)
+	RetrieveBitmap(subnet *net.IPNet, page uint64) (*bitmap.Bitmap, error)
+	RetrieveHolder(subnet *net.IPNet, ip net.IP) (string, error)     // return empty if the ip is not used
+	RetrieveTombstone(subnet *net.IPNet, ip net.IP) (*Record, error) // return nil if the ip has no tombstone
+	RetrieveBindings(namespace string) (map[string][]net.IP, error)  // keyed by pod name
+	RetrieveSubnets(id string) ([]*net.IPNet, error)                 // subnets of IPs held by the container
+	RetrieveReservations() (map[string][]*Record, error)             // keyed by container ID
+
+	// RetrieveStrategy retrieves the allocation strategy of the namespace, or the one of
+	// the subnet if the namespace has none, empty means StrategyLowestFirst.
+	RetrieveStrategy(namespace string, subnet *net.IPNet) (string, error)
+	// RetrieveCursor retrieves the IP reserved last in subnet, nil if none. Reserve keeps it.
+	RetrieveCursor(subnet *net.IPNet) (net.IP, error)
+	// RetrieveReleased retrieves when the IPs in subnet were released last, keyed by IP.
+	// Release and Quarantine keep it, and the IPs never released are not found.
+	RetrieveReleased(subnet *net.IPNet) (map[string]time.Time, error)
+	// RetrieveQuotas retrieves the quotas of the namespace, empty if none.
+	RetrieveQuotas(namespace string) ([]QuotaMap, error)
+	// RetrieveUsed retrieves the number of IPs reserved which are counted by the quota.
+	// Reserve and the releases keep it, so no reservation is scanned.
+	RetrieveUsed(qm QuotaMap) (int, error)
+	// RetrieveLabeledPools retrieves the allocate maps of the namespace with label set,
+	// empty if none. RetrieveAllocated retrieves the one without label.
+	RetrieveLabeledPools(namespace string) ([]AllocateMap, error)
 }
+
+// Allocation strategies, which decide the order of the free IPs to allocate.
+const (
+	// StrategyLowestFirst allocates the lowest free IP, which is the default.
+	StrategyLowestFirst = "lowest-first"
+	// StrategyRoundRobin allocates the next free IP after the one reserved last, as host-local does.
+	StrategyRoundRobin = "round-robin"
+	// StrategyLeastRecentlyReleased allocates the free IP never released, or released earliest.
+	StrategyLeastRecentlyReleased = "least-recently-released"
+	// StrategyRandom allocates the next free IP after a random one.
+	StrategyRandom = "random"
+)
+
+// Strategies are all the allocation strategies supported.
+var Strategies = []string{StrategyLowestFirst, StrategyRoundRobin, StrategyLeastRecentlyReleased, StrategyRandom}
@@ -0,0 +1,810 @@
+/*
+ * Copyright 2018 Haines Chan
+ *
+ * This program is free software; you can redistribute and/or modify it
+ * under the terms of the standard MIT license. See LICENSE for more details
+ */
+
+// Package storetest is the conformance tests of store.Store, which every backend should pass.
+//
+// A backend runs them in its own tests, such as:
+//
+//	func Test_Conformance(t *testing.T) {
+//		storetest.Suite{New: newStore}.Run(t)
+//	}
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hainesc/anchor/pkg/allocator/bitmap"
+	"github.com/hainesc/anchor/pkg/store"
+)
+
+// Backend is a store which could be configured by monkey.
+type Backend interface {
+	store.Store
+	// The methods of store.Monkey except Close.
+	AllGatewayMap() (*[]store.GatewayMap, error)
+	InsertGatewayMap(gm store.GatewayMap) error
+	DeleteGatewayMap(gms []store.GatewayMap) error
+	RetrieveUsedbyNamespace(namespace string, adminRole bool) (*[]store.Record, error)
+	AllAllocate() (*[]store.AllocateMap, error)
+	InsertAllocateMap(am store.AllocateMap) error
+	DeleteAllocateMap(ams []store.AllocateMap) error
+	AllBinding() (*[]store.BindingMap, error)
+	DeleteBindingMap(bms []store.BindingMap) error
+	AllQuarantined() (*[]store.Record, error)
+	AllConflict() (*[]store.Record, error)
+	DeleteConflict(ips []net.IP) error
+	AllStrategy() (*[]store.StrategyMap, error)
+	InsertStrategyMap(sm store.StrategyMap) error
+	DeleteStrategyMap(sms []store.StrategyMap) error
+	AllQuota() (*[]store.QuotaMap, error)
+	InsertQuotaMap(qm store.QuotaMap) error
+	DeleteQuotaMap(qms []store.QuotaMap) error
+}
+
+// Suite is the conformance tests of a backend.
+type Suite struct {
+	// New returns an empty store, which is closed by the tests.
+	New func(t *testing.T) Backend
+	// Reopen returns another handle to the same data as s, just like another plugin on
+	// the node does. It is nil if Lock of the backend locks nothing.
+	Reopen func(t *testing.T, s Backend) Backend
+}
+
+// The subnets created for each test.
+var (
+	subnet4 = mustParseCIDR("10.0.1.0/24")
+	subnet6 = mustParseCIDR("2001:db8::/64")
+)
+
+// Run runs all the tests as subtests of t.
+func (s Suite) Run(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, b Backend)
+	}{
+		{"Gateway", testGateway},
+		{"Pool", testPool},
+		{"LabeledPool", testLabeledPool},
+		{"Reserve", testReserve},
+		{"ReserveConcurrently", testReserveConcurrently},
+		{"Release", testRelease},
+		{"Bind", testBind},
+		{"Lease", testLease},
+		{"Quarantine", testQuarantine},
+		{"Conflict", testConflict},
+		{"Strategy", testStrategy},
+		{"Quota", testQuota},
+		{"Used", testUsed},
+		{"Lock", s.testLock},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			b := s.New(t)
+			defer b.Close()
+			for _, gm := range []store.GatewayMap{
+				{Subnet: subnet4.String(), Gateway: "10.0.1.1"},
+				{Subnet: subnet6.String(), Gateway: "2001:db8::1"},
+			} {
+				if err := b.InsertGatewayMap(gm); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			test.run(t, b)
+		})
+	}
+}
+
+// testGateway tests the lookups of gateways and subnets, which need no lock.
+func testGateway(t *testing.T, b Backend) {
+	if gw := b.RetrieveGateway(subnet4); !gw.Equal(net.ParseIP("10.0.1.1")) {
+		t.Fatalf("expected gateway 10.0.1.1, got %v", gw)
+	}
+	if gw := b.RetrieveGateway(subnet6); !gw.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("expected gateway 2001:db8::1, got %v", gw)
+	}
+	if gw := b.RetrieveGateway(mustParseCIDR("10.0.2.0/24")); gw != nil {
+		t.Fatalf("expected no gateway of unknown subnet, got %v", gw)
+	}
+	for ip, expected := range map[string]*net.IPNet{
+		"10.0.1.100":    subnet4,
+		"2001:db8::100": subnet6,
+		"10.0.2.100":    nil,
+	} {
+		subnet := b.RetrieveSubnet(net.ParseIP(ip))
+		if (subnet == nil) != (expected == nil) || subnet != nil && subnet.String() != expected.String() {
+			t.Fatalf("expected subnet %v of %s, got %v", expected, ip, subnet)
+		}
+	}
+
+	gms, err := b.AllGatewayMap()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(*gms) != 2 {
+		t.Fatalf("expected 2 gateway maps, got %d", len(*gms))
+	}
+	if err = b.DeleteGatewayMap([]store.GatewayMap{{Subnet: subnet4.String(), Gateway: "10.0.1.1"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if gw := b.RetrieveGateway(subnet4); gw != nil {
+		t.Fatalf("expected no gateway after deleted, got %v", gw)
+	}
+	if err = b.InsertGatewayMap(store.GatewayMap{Subnet: "10.0.1.0", Gateway: "10.0.1.1"}); err == nil {
+		t.Fatal("expected error when the subnet is invalid")
+	}
+}
+
+// testPool tests the parsing of the IPs allocated to namespaces.
+func testPool(t *testing.T, b Backend) {
+	if err := b.InsertAllocateMap(store.AllocateMap{
+		Namespace: "default",
+		Allocate:  "10.0.1.[2-5], 10.0.1.9,2001:db8::[2-3],10.0.2.[2-5]",
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	ips, err := b.RetrieveAllocated("default", subnet4)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for ip, expected := range map[string]bool{
+		"10.0.1.2": true, "10.0.1.5": true, "10.0.1.9": true,
+		"10.0.1.6": false, "10.0.2.2": false, "2001:db8::2": false,
+	} {
+		if ips.Contains(net.ParseIP(ip)) != expected {
+			t.Fatalf("expected %s allocated to be %v in %s", ip, expected, subnet4.String())
+		}
+	}
+	if ips, err = b.RetrieveAllocated("default", subnet6); err != nil || !ips.Contains(net.ParseIP("2001:db8::3")) {
+		t.Fatalf("expected 2001:db8::3 allocated, got %v %v", ips, err)
+	}
+	if _, err = b.RetrieveAllocated("unknown", subnet4); err == nil {
+		t.Fatal("expected error when nothing is allocated to the namespace")
+	}
+
+	// Insert again to replace it.
+	if err = b.InsertAllocateMap(store.AllocateMap{Namespace: "default", Allocate: "10.0.1.[6-7]"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ips, _ = b.RetrieveAllocated("default", subnet4); ips.Contains(net.ParseIP("10.0.1.2")) {
+		t.Fatal("expected the pool replaced")
+	}
+	ams, err := b.AllAllocate()
+	if err != nil || len(*ams) != 1 {
+		t.Fatalf("expected 1 allocate map, got %v %v", ams, err)
+	}
+	if err = b.DeleteAllocateMap(*ams); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = b.RetrieveAllocated("default", subnet4); err == nil {
+		t.Fatal("expected error after the pool deleted")
+	}
+}
+
+// testLabeledPool tests the pools dedicated to the pods selected by labels.
+func testLabeledPool(t *testing.T, b Backend) {
+	for _, am := range []store.AllocateMap{
+		{Namespace: "default", Allocate: "10.0.1.[2-9]"},
+		{Namespace: "default", Label: "app=payments", Allocate: "10.0.1.[2-3]"},
+		{Namespace: "default", Label: "app=web,tier=frontend", Allocate: "10.0.1.4"},
+		{Namespace: "defaults", Label: "app=payments", Allocate: "10.0.1.5"},
+	} {
+		if err := b.InsertAllocateMap(am); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := b.InsertAllocateMap(store.AllocateMap{Namespace: "default", Label: "app", Allocate: "10.0.1.6"}); err == nil {
+		t.Fatal("expected error when the label selector is invalid")
+	}
+	if err := b.InsertQuotaMap(store.QuotaMap{Namespace: "default", Max: 2}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The pool without label is not changed by the labeled ones.
+	ips, err := b.RetrieveAllocated("default", subnet4)
+	if err != nil || ips.String() != "10.0.1.2-10.0.1.9" {
+		t.Fatalf("expected the pool of default unchanged, got %v %v", ips, err)
+	}
+	ams, err := b.RetrieveLabeledPools("default")
+	if err != nil || len(ams) != 2 {
+		t.Fatalf("expected 2 labeled pools, got %v %v", ams, err)
+	}
+	sort.Slice(ams, func(i, j int) bool { return ams[i].Label < ams[j].Label })
+	if ams[0].Label != "app=payments" || ams[0].Allocate != "10.0.1.[2-3]" || ams[1].Label != "app=web,tier=frontend" {
+		t.Fatalf("unexpected labeled pools %v", ams)
+	}
+	if !ams[1].Selects(map[string]string{"app": "web", "tier": "frontend", "pod-template-hash": "1"}) ||
+		ams[1].Selects(map[string]string{"app": "web"}) {
+		t.Fatal("expected all the labels of the selector to be matched")
+	}
+	all, err := b.AllAllocate()
+	if err != nil || len(*all) != 4 {
+		t.Fatalf("expected 4 allocate maps, got %v %v", all, err)
+	}
+
+	// Deleting the labeled pool keeps the pool and the quotas of the namespace.
+	if err = b.DeleteAllocateMap(ams[:1]); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ams, err = b.RetrieveLabeledPools("default"); err != nil || len(ams) != 1 {
+		t.Fatalf("expected 1 labeled pool after deleted, got %v %v", ams, err)
+	}
+	if ips, err = b.RetrieveAllocated("default", subnet4); err != nil || len(*ips) == 0 {
+		t.Fatalf("expected the pool of default kept, got %v %v", ips, err)
+	}
+	if qms, err := b.RetrieveQuotas("default"); err != nil || len(qms) != 1 {
+		t.Fatalf("expected the quota of default kept, got %v %v", qms, err)
+	}
+}
+
+// testReserve tests Reserve of the same IP by the same or another container.
+func testReserve(t *testing.T, b Backend) {
+	r := record("10.0.1.2", subnet4)
+	r.Node, r.IfName = "node1", "eth0"
+	for _, tc := range []struct {
+		id       string
+		r        *store.Record
+		reserved bool
+	}{
+		{"container-a", r, true},
+		{"container-a", r, true},
+		{"container-b", record("10.0.1.2", subnet4), false},
+		{"container-a", record("2001:db8::2", subnet6), true},
+	} {
+		reserved, err := b.Reserve(tc.id, tc.r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if reserved != tc.reserved {
+			t.Fatalf("expected %s reserved by %s to be %v", tc.r.IP.String(), tc.id, tc.reserved)
+		}
+	}
+
+	if holder, err := b.RetrieveHolder(subnet4, net.ParseIP("10.0.1.2")); err != nil || holder != "container-a" {
+		t.Fatalf("expected holder container-a, got %q %v", holder, err)
+	}
+	if holder, err := b.RetrieveHolder(subnet4, net.ParseIP("10.0.1.3")); err != nil || holder != "" {
+		t.Fatalf("expected no holder, got %q %v", holder, err)
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, true)
+	expectUsed(t, b, "2001:db8::2", subnet6, true)
+	expectUsed(t, b, "10.0.1.3", subnet4, false)
+
+	subnets, err := b.RetrieveSubnets("container-a")
+	if err != nil || len(subnets) != 2 {
+		t.Fatalf("expected IPs in 2 subnets, got %v %v", subnets, err)
+	}
+	reservations, err := b.RetrieveReservations()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reservations) != 1 || len(reservations["container-a"]) != 2 {
+		t.Fatalf("expected 2 IPs reserved by container-a, got %v", reservations)
+	}
+	for _, got := range reservations["container-a"] {
+		if got.IP.Equal(r.IP) && (got.Pod != r.Pod || got.Namespace != r.Namespace ||
+			got.Node != r.Node || got.IfName != r.IfName || got.Subnet != r.Subnet || got.Created.IsZero()) {
+			t.Fatalf("expected record %+v, got %+v", r, got)
+		}
+	}
+	used, err := b.RetrieveUsedbyNamespace("default", false)
+	if err != nil || len(*used) != 2 {
+		t.Fatalf("expected 2 IPs used by default, got %v %v", used, err)
+	}
+	if used, _ = b.RetrieveUsedbyNamespace("others", false); len(*used) != 0 {
+		t.Fatalf("expected no IP used by others, got %d", len(*used))
+	}
+}
+
+// testReserveConcurrently tests that an IP is reserved by only one of the containers
+// racing for it, even without lock.
+func testReserveConcurrently(t *testing.T, b Backend) {
+	const racers = 8
+	var wg sync.WaitGroup
+	results := make(chan bool, racers)
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			reserved, err := b.Reserve(id, record("10.0.1.2", subnet4))
+			if err != nil {
+				t.Error(err.Error())
+			}
+			results <- reserved
+		}(fmt.Sprintf("container-%d", i))
+	}
+	wg.Wait()
+	close(results)
+
+	winners := 0
+	for reserved := range results {
+		if reserved {
+			winners++
+		}
+	}
+	if winners != 1 {
+		t.Fatalf("expected the IP reserved by exactly one container, got %d", winners)
+	}
+	reservations, _ := b.RetrieveReservations()
+	if len(reservations) != 1 {
+		t.Fatalf("expected 1 reservation, got %d", len(reservations))
+	}
+}
+
+// testRelease tests that Release is idempotent and leaves others alone.
+func testRelease(t *testing.T, b Backend) {
+	if err := b.Release("unknown"); err != nil {
+		t.Fatalf("expected no error when releasing unknown container, got %v", err)
+	}
+	// The ID of one container may be the prefix of another's.
+	for id, ip := range map[string]string{"container-a": "10.0.1.2", "container-ab": "10.0.1.3"} {
+		if _, err := b.Reserve(id, record(ip, subnet4)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := b.Release("container-a"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, false)
+	expectUsed(t, b, "10.0.1.3", subnet4, true)
+	if holder, _ := b.RetrieveHolder(subnet4, net.ParseIP("10.0.1.2")); holder != "" {
+		t.Fatalf("expected no holder after released, got %q", holder)
+	}
+	if subnets, _ := b.RetrieveSubnets("container-a"); len(subnets) != 0 {
+		t.Fatalf("expected nothing held after released, got %v", subnets)
+	}
+	if subnets, _ := b.RetrieveSubnets("container-ab"); len(subnets) != 1 {
+		t.Fatalf("expected container-ab still holding its IP, got %v", subnets)
+	}
+
+	// The IP released could be reserved by others.
+	if reserved, err := b.Reserve("container-c", record("10.0.1.2", subnet4)); err != nil || !reserved {
+		t.Fatalf("expected the IP released reserved again, got %v %v", reserved, err)
+	}
+}
+
+// testBind tests that the IP bound to a pod is kept used until unbound.
+func testBind(t *testing.T, b Backend) {
+	ip := net.ParseIP("10.0.1.2")
+	if _, err := b.Reserve("container-a", record("10.0.1.2", subnet4)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Bind("default", "web-0", ip); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Release("container-a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, true)
+
+	bindings, err := b.RetrieveBindings("default")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(bindings["web-0"]) != 1 || !bindings["web-0"][0].Equal(ip) {
+		t.Fatalf("expected 10.0.1.2 bound to web-0, got %v", bindings)
+	}
+	if bindings, _ = b.RetrieveBindings("others"); len(bindings) != 0 {
+		t.Fatalf("expected no binding in others, got %v", bindings)
+	}
+	bms, err := b.AllBinding()
+	if err != nil || len(*bms) != 1 {
+		t.Fatalf("expected 1 binding, got %v %v", bms, err)
+	}
+
+	// The same pod comes back.
+	if reserved, err := b.Reserve("container-b", record("10.0.1.2", subnet4)); err != nil || !reserved {
+		t.Fatalf("expected the IP bound reserved, got %v %v", reserved, err)
+	}
+	if err = b.Release("container-b"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = b.DeleteBindingMap(*bms); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, false)
+	if bindings, _ = b.RetrieveBindings("default"); len(bindings) != 0 {
+		t.Fatalf("expected no binding after deleted, got %v", bindings)
+	}
+}
+
+// testLease tests that pending reservations are reclaimed once expired unless committed.
+func testLease(t *testing.T, b Backend) {
+	// Leases of etcd are in seconds and last at least about two seconds.
+	expires := time.Now().Add(time.Second)
+	for id, ip := range map[string]string{"container-a": "10.0.1.2", "container-b": "10.0.1.3"} {
+		r := record(ip, subnet4)
+		r.State, r.Expires = store.StatePending, expires
+		if reserved, err := b.Reserve(id, r); err != nil || !reserved {
+			t.Fatalf("expected %s reserved, got %v %v", ip, reserved, err)
+		}
+	}
+	committed := record("10.0.1.4", subnet4)
+	committed.State = store.StateCommitted
+	if _, err := b.Reserve("container-c", committed); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Commit("container-a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Nothing is expired yet.
+	if err := b.Reclaim(subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.3", subnet4, true)
+
+	time.Sleep(3 * time.Second)
+	if err := b.Reclaim(subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, true)
+	expectUsed(t, b, "10.0.1.3", subnet4, false)
+	expectUsed(t, b, "10.0.1.4", subnet4, true)
+	reservations, err := b.RetrieveReservations()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reservations["container-b"]) != 0 {
+		t.Fatal("expected the reservation expired reclaimed")
+	}
+	if rs := reservations["container-a"]; len(rs) != 1 || rs[0].Pending() {
+		t.Fatalf("expected the reservation committed, got %v", rs)
+	}
+	if holder, _ := b.RetrieveHolder(subnet4, net.ParseIP("10.0.1.3")); holder != "" {
+		t.Fatalf("expected no holder after reclaimed, got %q", holder)
+	}
+}
+
+// testQuarantine tests that the IPs quarantined are kept used until the quarantine is over.
+func testQuarantine(t *testing.T, b Backend) {
+	for id, ip := range map[string]string{"container-a": "10.0.1.2", "container-b": "10.0.1.3"} {
+		if _, err := b.Reserve(id, record(ip, subnet4)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := b.Quarantine("container-a", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Quarantine("container-b", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, true)
+	expectUsed(t, b, "10.0.1.3", subnet4, true)
+	if holder, _ := b.RetrieveHolder(subnet4, net.ParseIP("10.0.1.2")); holder != "" {
+		t.Fatalf("expected no holder after quarantined, got %q", holder)
+	}
+	if tombstones, err := b.AllQuarantined(); err != nil || len(*tombstones) != 2 {
+		t.Fatalf("expected 2 IPs quarantined, got %v %v", tombstones, err)
+	}
+
+	if err := b.Reclaim(subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, true)
+	expectUsed(t, b, "10.0.1.3", subnet4, false)
+	tombstones, err := b.AllQuarantined()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(*tombstones) != 1 || !(*tombstones)[0].IP.Equal(net.ParseIP("10.0.1.2")) ||
+		!(*tombstones)[0].Quarantined() || (*tombstones)[0].Pod != "web-0" {
+		t.Fatalf("expected the tombstone of 10.0.1.2 kept, got %v", *tombstones)
+	}
+	if tombstone, err := b.RetrieveTombstone(subnet4, net.ParseIP("10.0.1.2")); err != nil ||
+		tombstone == nil || !tombstone.Quarantined() {
+		t.Fatalf("expected the tombstone of 10.0.1.2 retrieved, got %v %v", tombstone, err)
+	}
+	if tombstone, err := b.RetrieveTombstone(subnet4, net.ParseIP("10.0.1.3")); err != nil || tombstone != nil {
+		t.Fatalf("expected no tombstone of 10.0.1.3, got %v %v", tombstone, err)
+	}
+
+	// Reserving the IP quarantined on purpose lifts the quarantine.
+	if reserved, err := b.Reserve("container-c", record("10.0.1.2", subnet4)); err != nil || !reserved {
+		t.Fatalf("expected the IP quarantined reserved, got %v %v", reserved, err)
+	}
+	if tombstones, _ = b.AllQuarantined(); len(*tombstones) != 0 {
+		t.Fatalf("expected the quarantine lifted, got %v", *tombstones)
+	}
+	if err = b.Release("container-c"); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, false)
+}
+
+// testConflict tests that the IPs in conflict are kept used until the mark is removed.
+func testConflict(t *testing.T, b Backend) {
+	ip := net.ParseIP("10.0.1.2")
+	for _, r := range []*store.Record{record("10.0.1.2", subnet4), record("2001:db8::2", subnet6)} {
+		if _, err := b.Reserve("container-a", r); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := b.Bind("default", "web-0", ip); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Conflict("container-a", ip); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, true)
+	expectUsed(t, b, "2001:db8::2", subnet6, false)
+	if subnets, _ := b.RetrieveSubnets("container-a"); len(subnets) != 0 {
+		t.Fatalf("expected nothing held after conflict, got %v", subnets)
+	}
+	if bindings, _ := b.RetrieveBindings("default"); len(bindings) != 0 {
+		t.Fatalf("expected the binding deleted, got %v", bindings)
+	}
+
+	// The mark never expires.
+	if err := b.Reclaim(subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, true)
+	conflicts, err := b.AllConflict()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(*conflicts) != 1 || !(*conflicts)[0].IP.Equal(ip) || !(*conflicts)[0].Conflicted() {
+		t.Fatalf("expected 10.0.1.2 in conflict, got %v", *conflicts)
+	}
+	if tombstones, _ := b.AllQuarantined(); len(*tombstones) != 0 {
+		t.Fatalf("expected nothing quarantined, got %v", *tombstones)
+	}
+
+	if err = b.DeleteConflict([]net.IP{ip}); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectUsed(t, b, "10.0.1.2", subnet4, false)
+	if conflicts, _ = b.AllConflict(); len(*conflicts) != 0 {
+		t.Fatalf("expected the mark removed, got %v", *conflicts)
+	}
+}
+
+// testQuota tests the quotas kept alongside the pools.
+func testQuota(t *testing.T, b Backend) {
+	if err := b.InsertQuotaMap(store.QuotaMap{Namespace: "default", Max: 2}); err == nil {
+		t.Fatal("expected error when inserting quota of namespace without pool")
+	}
+	if err := b.InsertQuotaMap(store.QuotaMap{Namespace: "default", Subnet: subnet4.String(), Controller: "web", Max: 2}); err == nil {
+		t.Fatal("expected error when inserting quota of both subnet and controller")
+	}
+	for _, ns := range []string{"default", "default-2"} {
+		if err := b.InsertAllocateMap(store.AllocateMap{Namespace: ns, Allocate: "10.0.1.[2-9]"}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, qm := range []store.QuotaMap{
+		{Namespace: "default", Max: 5},
+		{Namespace: "default", Subnet: "10.0.1.8/24", Max: 4},
+		{Namespace: "default", Controller: "web", Max: 2},
+		{Namespace: "default-2", Max: 1},
+		// Replaces the one of the same key.
+		{Namespace: "default", Controller: "web", Max: 3},
+	} {
+		if err := b.InsertQuotaMap(qm); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	qms, err := b.RetrieveQuotas("default")
+	if err != nil || len(qms) != 3 {
+		t.Fatalf("expected 3 quotas of default, got %v %v", qms, err)
+	}
+	for _, qm := range qms {
+		if qm.Controller == "web" && qm.Max != 3 {
+			t.Fatalf("expected the quota of web replaced, got %v", qm)
+		}
+		if qm.Subnet != "" && qm.Subnet != subnet4.String() {
+			t.Fatalf("expected the subnet of quota normalized, got %v", qm)
+		}
+	}
+	if all, err := b.AllQuota(); err != nil || len(*all) != 4 {
+		t.Fatalf("expected 4 quotas, got %v %v", all, err)
+	}
+
+	if err = b.DeleteQuotaMap([]store.QuotaMap{{Namespace: "default", Controller: "web"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if qms, _ = b.RetrieveQuotas("default"); len(qms) != 2 {
+		t.Fatalf("expected 2 quotas of default after deleted, got %v", qms)
+	}
+	// The quotas are gone with the pool.
+	if err = b.DeleteAllocateMap([]store.AllocateMap{{Namespace: "default"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if qms, _ = b.RetrieveQuotas("default"); len(qms) != 0 {
+		t.Fatalf("expected no quota of default after the pool deleted, got %v", qms)
+	}
+	if qms, _ = b.RetrieveQuotas("default-2"); len(qms) != 1 {
+		t.Fatalf("expected the quota of default-2 kept, got %v", qms)
+	}
+}
+
+// testUsed tests the numbers of IPs counted by quotas, which are kept by Reserve and the
+// releases.
+func testUsed(t *testing.T, b Backend) {
+	web := record("10.0.1.2", subnet4)
+	web.Controller = "web"
+	other := record("10.0.1.3", subnet4)
+	other.Namespace = "default-2"
+	for id, r := range map[string]*store.Record{
+		"container-a": web,
+		"container-b": record("2001:db8::2", subnet6),
+		"container-c": record("10.0.1.4", subnet4),
+		"container-d": other,
+	} {
+		if _, err := b.Reserve(id, r); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// Reserved again by the same container.
+	if _, err := b.Reserve("container-a", web); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := func(qm store.QuotaMap, expected int) {
+		if used, err := b.RetrieveUsed(qm); err != nil || used != expected {
+			t.Fatalf("expected %d IPs counted by %v, got %d %v", expected, qm, used, err)
+		}
+	}
+	expect(store.QuotaMap{Namespace: "default"}, 3)
+	expect(store.QuotaMap{Namespace: "default", Subnet: subnet4.String()}, 2)
+	expect(store.QuotaMap{Namespace: "default", Controller: "web"}, 1)
+	expect(store.QuotaMap{Namespace: "default-2"}, 1)
+
+	if err := b.Quarantine("container-a", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Release("container-b"); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect(store.QuotaMap{Namespace: "default"}, 1)
+	expect(store.QuotaMap{Namespace: "default", Subnet: subnet4.String()}, 1)
+	expect(store.QuotaMap{Namespace: "default", Controller: "web"}, 0)
+}
+
+// testStrategy tests the strategies kept alongside the pools, and the state of them.
+func testStrategy(t *testing.T, b Backend) {
+	if err := b.InsertStrategyMap(store.StrategyMap{Namespace: "default", Strategy: store.StrategyRandom}); err == nil {
+		t.Fatal("expected error when inserting strategy of namespace without pool")
+	}
+	if err := b.InsertStrategyMap(store.StrategyMap{Subnet: subnet4.String(), Strategy: "unknown"}); err == nil {
+		t.Fatal("expected error when inserting unknown strategy")
+	}
+	if err := b.InsertGatewayMap(store.GatewayMap{Subnet: subnet4.String(), Gateway: "10.0.1.1"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.InsertAllocateMap(store.AllocateMap{Namespace: "default", Allocate: "10.0.1.[2-9]"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, sm := range []store.StrategyMap{
+		{Subnet: subnet4.String(), Strategy: store.StrategyRoundRobin},
+		{Namespace: "default", Strategy: store.StrategyRandom},
+	} {
+		if err := b.InsertStrategyMap(sm); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// The strategy of the namespace wins.
+	for namespace, expected := range map[string]string{"default": store.StrategyRandom, "other": store.StrategyRoundRobin} {
+		if strategy, err := b.RetrieveStrategy(namespace, subnet4); err != nil || strategy != expected {
+			t.Fatalf("expected strategy %s of namespace %s, got %q %v", expected, namespace, strategy, err)
+		}
+	}
+	if sms, err := b.AllStrategy(); err != nil || len(*sms) != 2 {
+		t.Fatalf("expected 2 strategies, got %v %v", sms, err)
+	}
+	// The pool is kept when the strategy is set, and the strategy is kept when the pool is updated.
+	if err := b.InsertAllocateMap(store.AllocateMap{Namespace: "default", Allocate: "10.0.1.[2-5]"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if strategy, _ := b.RetrieveStrategy("default", subnet4); strategy != store.StrategyRandom {
+		t.Fatalf("expected strategy kept after the pool updated, got %q", strategy)
+	}
+	if ips, err := b.RetrieveAllocated("default", subnet4); err != nil || ips.String() != "10.0.1.2-10.0.1.5" {
+		t.Fatalf("expected the pool updated, got %v %v", ips, err)
+	}
+	if err := b.DeleteStrategyMap([]store.StrategyMap{{Namespace: "default"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if strategy, _ := b.RetrieveStrategy("default", subnet4); strategy != store.StrategyRoundRobin {
+		t.Fatalf("expected strategy of subnet after deleted, got %q", strategy)
+	}
+
+	// Reserve moves the cursor, and Release records when the IP is released.
+	if cursor, err := b.RetrieveCursor(subnet4); err != nil || cursor != nil {
+		t.Fatalf("expected no cursor, got %v %v", cursor, err)
+	}
+	for id, ip := range map[string]string{"container-a": "10.0.1.4", "container-b": "10.0.1.3"} {
+		if _, err := b.Reserve(id, record(ip, subnet4)); err != nil {
+			t.Fatal(err.Error())
+		}
+		if cursor, _ := b.RetrieveCursor(subnet4); !cursor.Equal(net.ParseIP(ip)) {
+			t.Fatalf("expected cursor %s, got %v", ip, cursor)
+		}
+	}
+	before := time.Now()
+	if err := b.Release("container-a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	released, err := b.RetrieveReleased(subnet4)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(released) != 1 || released["10.0.1.4"].Before(before.Add(-time.Second)) {
+		t.Fatalf("expected 10.0.1.4 released just now, got %v", released)
+	}
+}
+
+// testLock tests that the lock of a subnet excludes others, and subnets are locked independently.
+func (s Suite) testLock(t *testing.T, b Backend) {
+	if s.Reopen == nil {
+		t.Skip("the lock of the backend locks nothing")
+	}
+	other := s.Reopen(t, b)
+	defer other.Close()
+
+	if err := b.Lock(context.Background(), subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := other.Lock(ctx, subnet4); err == nil {
+		t.Fatal("expected error when the subnet is locked by others")
+	}
+	if err := other.Lock(context.Background(), subnet6); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := other.Unlock(subnet6); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Unlock(subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := other.Lock(context.Background(), subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := other.Unlock(subnet4); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func expectUsed(t *testing.T, b Backend, ip string, subnet *net.IPNet, expected bool) {
+	t.Helper()
+	page, i, err := bitmap.Locate(subnet, net.ParseIP(ip))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bm, err := b.RetrieveBitmap(subnet, page)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bm.Test(i) != expected {
+		t.Fatalf("expected %s used to be %v", ip, expected)
+	}
+}
+
+func record(ip string, subnet *net.IPNet) *store.Record {
+	return &store.Record{
+		IP:        net.ParseIP(ip),
+		Subnet:    subnet.String(),
+		Pod:       "web-0",
+		Namespace: "default",
+	}
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return subnet
+}
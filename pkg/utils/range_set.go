@@ -153,8 +153,10 @@ func (rs *RangeSet) String() string {
 
 // Concat concats RangeSet from string for given subnet.
 // eg: "10.0.0.[2-4], 10.0.1.4, 10.0.1.5, 10.0.1.9", 10.0.1.0/24
+// IPv6 is written in the same way, the part in brackets is in hex,
+// or in the form of start-end if the prefix is not shared.
+// eg: "2001:db8::[a-ff], 2001:db8::1:0-2001:db8::2:ffff", 2001:db8::/64
 func (rs *RangeSet) Concat(s string, subnet *net.IPNet) (*RangeSet, error) {
-	// TODO: the code is designed for ipv4, what will happens when ipv6?
 	// No special case when s is empty or rs is empty.
 	if s == "" || strings.TrimSpace(s) == "" {
 		return rs, nil
@@ -177,6 +179,24 @@ func (rs *RangeSet) Concat(s string, subnet *net.IPNet) (*RangeSet, error) {
 				return nil, fmt.Errorf("invalid IP ranges %s", r)
 			}
 
+			*rs = append(*rs, Range{
+				RangeStart: start,
+				RangeEnd:   end,
+				Subnet:     *subnet,
+			})
+		} else if strings.Contains(r, "-") {
+			// eg: 2001:db8::1:0-2001:db8::2:ffff
+			bounds := strings.Split(r, "-")
+			start := net.ParseIP(strings.TrimSpace(bounds[0]))
+			end := net.ParseIP(strings.TrimSpace(bounds[len(bounds)-1]))
+			if len(bounds) != 2 || start == nil || end == nil {
+				return nil, fmt.Errorf("invalid IP ranges %s", r)
+			}
+			if !subnet.Contains(start) {
+				// This range don't belong to the subnet, so continue here.
+				continue
+			}
+
 			*rs = append(*rs, Range{
 				RangeStart: start,
 				RangeEnd:   end,
@@ -228,6 +248,93 @@ func (rs *RangeSet) Concat(s string, subnet *net.IPNet) (*RangeSet, error) {
 	return rs, nil
 }
 
+// Intersect returns the ranges both in rs and other.
+// Both of them should be sorted and merged, just as Concat returns.
+func (rs *RangeSet) Intersect(other *RangeSet) *RangeSet {
+	ret := RangeSet{}
+	i, j := 0, 0
+	for i < len(*rs) && j < len(*other) {
+		a, b := (*rs)[i], (*other)[j]
+		start, end := a.RangeStart, a.RangeEnd
+		if ip.Cmp(b.RangeStart, start) > 0 {
+			start = b.RangeStart
+		}
+		if ip.Cmp(b.RangeEnd, end) < 0 {
+			end = b.RangeEnd
+		}
+		if ip.Cmp(start, end) <= 0 {
+			ret = append(ret, Range{
+				RangeStart: start,
+				RangeEnd:   end,
+				Subnet:     a.Subnet,
+				Gateway:    a.Gateway,
+			})
+		}
+		// Move on the one which ends first.
+		if ip.Cmp(a.RangeEnd, b.RangeEnd) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return &ret
+}
+
+// Subtract returns the ranges in rs but not in other.
+// Both of them should be sorted and merged, just as Concat returns.
+func (rs *RangeSet) Subtract(other *RangeSet) *RangeSet {
+	ret := RangeSet{}
+	j := 0
+	for _, a := range *rs {
+		start := a.RangeStart
+		// Skip the ones which end before the range.
+		for j < len(*other) && ip.Cmp((*other)[j].RangeEnd, start) < 0 {
+			j++
+		}
+		for k := j; k < len(*other) && start != nil; k++ {
+			b := (*other)[k]
+			if ip.Cmp(b.RangeStart, a.RangeEnd) > 0 {
+				break
+			}
+			if ip.Cmp(b.RangeStart, start) > 0 {
+				ret = append(ret, Range{
+					RangeStart: start,
+					RangeEnd:   ip.PrevIP(b.RangeStart),
+					Subnet:     a.Subnet,
+					Gateway:    a.Gateway,
+				})
+			}
+			start = nil
+			if ip.Cmp(b.RangeEnd, a.RangeEnd) < 0 {
+				start = ip.NextIP(b.RangeEnd)
+			}
+		}
+		if start != nil {
+			ret = append(ret, Range{
+				RangeStart: start,
+				RangeEnd:   a.RangeEnd,
+				Subnet:     a.Subnet,
+				Gateway:    a.Gateway,
+			})
+		}
+	}
+	return &ret
+}
+
+// FirstIP returns the first IP in s, which has the same format as Concat accepts.
+// eg: "10.0.0.[2-4], 10.0.1.4" returns 10.0.0.2, nil is returned if s is invalid.
+func FirstIP(s string) net.IP {
+	r := strings.TrimSpace(strings.Split(s, ",")[0])
+	if strings.HasSuffix(r, "]") {
+		segments := strings.Split(strings.TrimSuffix(r, "]"), "[")
+		if len(segments) != 2 {
+			return nil
+		}
+		return net.ParseIP(segments[0] + strings.Split(segments[1], "-")[0])
+	}
+	return net.ParseIP(strings.TrimSpace(strings.Split(r, "-")[0]))
+}
+
 func (rs RangeSet) Len() int {
 	return len(rs)
 }
@@ -29,3 +29,79 @@ func Test_Contat(t *testing.T) {
 	}
 	t.Log("test succuss")
 }
+
+func Test_Intersect(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+
+	pool, err := (&RangeSet{}).Concat("10.0.1.[10-30], 10.0.1.[50-60], 10.0.1.100", subnet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	custom, err := (&RangeSet{}).Concat("10.0.1.[20-55]", subnet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := pool.Intersect(custom).String(); got != "10.0.1.20-10.0.1.30,10.0.1.50-10.0.1.55" {
+		t.Fatalf("unexpected intersection %s", got)
+	}
+
+	outside, _ := (&RangeSet{}).Concat("10.0.1.[200-210]", subnet)
+	if got := pool.Intersect(outside); len(*got) != 0 {
+		t.Fatalf("expected empty intersection, got %s", got.String())
+	}
+}
+
+func Test_Subtract(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+
+	pool, err := (&RangeSet{}).Concat("10.0.1.[10-30], 10.0.1.[50-60], 10.0.1.100", subnet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dedicated, err := (&RangeSet{}).Concat("10.0.1.[5-12], 10.0.1.[20-25], 10.0.1.[55-70]", subnet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := pool.Subtract(dedicated).String(); got != "10.0.1.13-10.0.1.19,10.0.1.26-10.0.1.30,10.0.1.50-10.0.1.54,10.0.1.100-10.0.1.100" {
+		t.Fatalf("unexpected difference %s", got)
+	}
+	if got := pool.Subtract(&RangeSet{}).String(); got != pool.String() {
+		t.Fatalf("expected %s, got %s", pool.String(), got)
+	}
+	if got := pool.Subtract(pool); len(*got) != 0 {
+		t.Fatalf("expected empty difference, got %s", got.String())
+	}
+}
+
+func Test_FirstIP(t *testing.T) {
+	for s, want := range map[string]string{
+		"10.0.1.[20-40]":             "10.0.1.20",
+		" 10.0.1.5, 10.0.1.[20-40]":  "10.0.1.5",
+		"10.0.2.[7-9], 10.0.1.[1-2]": "10.0.2.7",
+	} {
+		if got := FirstIP(s); !got.Equal(net.ParseIP(want)) {
+			t.Fatalf("FirstIP(%q) = %v, want %s", s, got, want)
+		}
+	}
+	if got := FirstIP("10.0.1.[20-40"); got != nil {
+		t.Fatalf("expected nil for invalid range, got %v", got)
+	}
+}
+
+func Test_ConcatIPv6(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("2001:db8::/64")
+
+	rs, err := (&RangeSet{}).Concat("2001:db8::[a-ff], 2001:db8::1:0-2001:db8::2:ffff, 10.0.1.5", subnet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := rs.String(); got != "2001:db8::a-2001:db8::ff,2001:db8::1:0-2001:db8::2:ffff" {
+		t.Fatalf("unexpected range set %s", got)
+	}
+	if !rs.Contains(net.ParseIP("2001:db8::1:abcd")) {
+		t.Fatal("2001:db8::1:abcd should be in the range set")
+	}
+	if got := FirstIP("2001:db8::1:0-2001:db8::2:ffff"); !got.Equal(net.ParseIP("2001:db8::1:0")) {
+		t.Fatalf("unexpected first IP %v", got)
+	}
+}